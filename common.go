@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strings"
 
+	"golang.org/x/sys/unix"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
@@ -43,12 +45,16 @@ const (
 const (
 	// FQDN regex string according to RFC 1123
 	fqdnRegexStringRFC1123 = `^([a-zA-Z0-9]{1}[a-zA-Z0-9-]{0,62})(\.[a-zA-Z0-9]{1}[a-zA-Z0-9-]{0,62})*?(\.[a-zA-Z]{1}[a-zA-Z0-9]{0,62})\.?$` // same as hostnameRegexStringRFC1123 but must contain a non numerical TLD (possibly ending with '.')
+	// Resource name regex string. Used for names which end up in kernel resource names (ie nft tables)
+	resourceNameRegexString = `^[a-zA-Z0-9_]+$`
 )
 
 // Pattern matches
 var (
 	// parses the fqdnRegexStringRFC1123 regex
 	fqdnRegexRFC1123 = regexp.MustCompile(fqdnRegexStringRFC1123)
+	// parses the resourceNameRegexString regex
+	resourceNameRegex = regexp.MustCompile(resourceNameRegexString)
 )
 
 // Common errors
@@ -171,6 +177,21 @@ func isFqdn(s string) bool {
 	return fqdnRegexRFC1123.MatchString(s)
 }
 
+// isInterfaceName checks if a string is a valid network interface name
+// Linux interface names have at most 15 characters and can't hold '/', ':' or whitespace
+func isInterfaceName(name string) bool {
+	if name == "" || len(name) >= unix.IFNAMSIZ || name == "." || name == ".." {
+		return false
+	}
+
+	return !strings.ContainsAny(name, "/: \t\n")
+}
+
+// isResourceName checks if input string can be used in kernel resource names and returns boolean result
+func isResourceName(s string) bool {
+	return resourceNameRegex.MatchString(s)
+}
+
 // findUniqueNetIp returns a list of unique net.IP
 func findUniqueNetIp(nipl *[]net.IP) []net.IP {
 	unipl := make([]net.IP, 0)
@@ -202,3 +223,53 @@ func findDuplicateNetIp(nipl *[]net.IP) []net.IP {
 
 	return dnipl
 }
+
+// checkIpFwdDependency checks if IP forwarding is system enabled and logs the outcome
+// It is used by the load balancer engines which forward traffic in the kernel
+// In case it is not confirmed that IPv4 and IPv6 are enabled an error will not be returned
+// It will just log a warning message, because there are scenarios in which the Load Balancer can be used without
+// requiring IP packets to be forward to another server
+// An error is only returned in case the IP forwarding settings can't be read
+func checkIpFwdDependency() error {
+	LogDf("Dependencies check: checking if IP forwarding is system enabled")
+	ipF, err := checkIpFwd()
+	if err != nil {
+		return err
+	}
+
+	switch ipF {
+	case ipFwdUnknown:
+		LogWf("Dependencies check: skipped IP forwarding settings check")
+	case ipFwdNone:
+		LogWf(
+			"Dependencies check: IPv4 Forwarding Check Result: FAILED. IPv4 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv4 traffic use cases. Make sure the IPv4 forwarding is correctly configured to prevent any issues",
+		)
+		LogWf(
+			"Dependencies check: IPv6 Forwarding Check Result: FAILED. IPv6 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv6 traffic use cases. Make sure the IPv6 forwarding is correctly configured to prevent any issues",
+		)
+	case ipFwdAll:
+		LogDf(
+			"Dependencies check: IPv4 Forwarding Check Result: SUCCEEDED. IPv4 forwarding seems to be generally enabled",
+		)
+		LogDf(
+			"Dependencies check: IPv6 Forwarding Check Result: SUCCEEDED. IPv6 forwarding seems to be generally enabled",
+		)
+	case ipFwdV4Only:
+		LogDf(
+			"Dependencies check: IPv4 Forwarding Check Result: SUCCEEDED. IPv4 forwarding seems to be generally enabled",
+		)
+		LogWf(
+			"Dependencies check: IPv6 Forwarding Check Result: FAILED. IPv6 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv6 traffic use cases. Make sure the IPv6 forwarding is correctly configured to prevent any issues",
+		)
+	case ipFwdV6Only:
+		LogWf(
+			"Dependencies check: IPv4 Forwarding Check Result: FAILED. IPv4 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv4 traffic use cases. Make sure the IPv4 forwarding is correctly configured to prevent any issues",
+		)
+		LogDf(
+			"Dependencies check: IPv6 Forwarding Check Result: SUCCEEDED. IPv6 forwarding seems to be generally enabled",
+		)
+	}
+
+	LogDf("Dependencies check completed")
+	return nil
+}
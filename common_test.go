@@ -232,6 +232,53 @@ func TestIsFqdn(t *testing.T) {
 	}
 }
 
+func TestIsResourceName(t *testing.T) {
+	testCases := []struct {
+		input  string
+		result bool
+	}{
+		{input: "tenant1", result: true},
+		{input: "Tenant_1", result: true},
+		{input: "tenant-1", result: false},
+		{input: "tenant.1", result: false},
+		{input: "", result: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			r := isResourceName(tc.input)
+			if r != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.result, r)
+			}
+		})
+	}
+}
+
+func TestIsInterfaceName(t *testing.T) {
+	testCases := []struct {
+		input  string
+		result bool
+	}{
+		{input: "eth0", result: true},
+		{input: "enp0s31f6.100", result: true},
+		{input: "dmz-1", result: true},
+		{input: "", result: false},
+		{input: "..", result: false},
+		{input: "eth/0", result: false},
+		{input: "eth 0", result: false},
+		{input: "averylonginterface", result: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			r := isInterfaceName(tc.input)
+			if r != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.result, r)
+			}
+		})
+	}
+}
+
 func TestFindUniqueNetIp(t *testing.T) {
 	testCases := []struct {
 		input  []net.IP
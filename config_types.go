@@ -2,17 +2,110 @@ package main
 
 // used for config file parsing
 
+type ProbeBackoffConfig struct {
+	MaxInterval uint16 `yaml:"max_interval"`
+	Jitter      uint8  `yaml:"jitter"`
+}
+
 type ProbeConfig struct {
-	CheckInterval uint16 `yaml:"check_interval"`
-	Timeout       uint8  `yaml:"timeout"`
-	Count         uint8  `yaml:"success_count"`
+	CheckInterval     uint16             `yaml:"check_interval"`
+	Timeout           uint8              `yaml:"timeout"`
+	Count             uint8              `yaml:"success_count"`
+	FailureCount      uint8              `yaml:"failure_count"`
+	UnhealthyInterval uint16             `yaml:"unhealthy_interval"`
+	Backoff           ProbeBackoffConfig `yaml:"backoff"`
+}
+
+type HealthCheckTlsConfig struct {
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	CaFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+}
+
+type HttpHealthCheckConfig struct {
+	Method    string               `yaml:"method"`
+	Path      string               `yaml:"path"`
+	Host      string               `yaml:"host"`
+	Headers   map[string]string    `yaml:"headers"`
+	Status    []string             `yaml:"status"`
+	Body      string               `yaml:"body"`
+	BodyRegex string               `yaml:"body_regex"`
+	Tls       HealthCheckTlsConfig `yaml:"tls"`
+}
+
+type GrpcHealthCheckConfig struct {
+	Service string                `yaml:"service"`
+	Tls     *HealthCheckTlsConfig `yaml:"tls"`
+}
+
+type SendExpectConfig struct {
+	Send      string `yaml:"send"`
+	SendHex   string `yaml:"send_hex"`
+	Expect    string `yaml:"expect"`
+	ExpectHex string `yaml:"expect_hex"`
+}
+
+type TcpHealthCheckConfig struct {
+	Steps []SendExpectConfig `yaml:"steps"`
+}
+
+type RedisHealthCheckConfig struct {
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+type MysqlHealthCheckConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+type PostgresHealthCheckConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+	Role     string `yaml:"role"`
+}
+
+type IcmpHealthCheckConfig struct {
+	Count   uint8  `yaml:"count"`
+	MaxLoss *uint8 `yaml:"max_loss"`
+	MaxRtt  uint16 `yaml:"max_rtt"`
+}
+
+type DnsHealthCheckConfig struct {
+	Name      string `yaml:"name"`
+	Type      string `yaml:"type"`
+	Class     string `yaml:"class"`
+	Transport string `yaml:"transport"`
+	Rcode     string `yaml:"rcode"`
+	Answer    string `yaml:"answer"`
+}
+
+type ExecHealthCheckConfig struct {
+	Command []string `yaml:"command"`
 }
 
 type HealthCheckConfig struct {
-	Protocol       string      `yaml:"protocol"`
-	Port           uint16      `yaml:"port"`
-	StartAvailable bool        `yaml:"start_available"`
-	Probe          ProbeConfig `yaml:"probe"`
+	Protocol       string                     `yaml:"protocol"`
+	Port           uint16                     `yaml:"port"`
+	Host           string                     `yaml:"host"`
+	Source         string                     `yaml:"source"`
+	Interface      string                     `yaml:"interface"`
+	StartAvailable bool                       `yaml:"start_available"`
+	Probe          ProbeConfig                `yaml:"probe"`
+	Http           *HttpHealthCheckConfig     `yaml:"http"`
+	Grpc           *GrpcHealthCheckConfig     `yaml:"grpc"`
+	Udp            *SendExpectConfig          `yaml:"udp"`
+	Tcp            *TcpHealthCheckConfig      `yaml:"tcp"`
+	Redis          *RedisHealthCheckConfig    `yaml:"redis"`
+	Mysql          *MysqlHealthCheckConfig    `yaml:"mysql"`
+	Postgres       *PostgresHealthCheckConfig `yaml:"postgres"`
+	Icmp           *IcmpHealthCheckConfig     `yaml:"icmp"`
+	Dns            *DnsHealthCheckConfig      `yaml:"dns"`
+	Exec           *ExecHealthCheckConfig     `yaml:"exec"`
 }
 
 type UpstreamDnsConfig struct {
@@ -20,18 +113,51 @@ type UpstreamDnsConfig struct {
 	Ttl     uint32   `yaml:"ttl"`
 }
 
+type DampeningConfig struct {
+	HalfLife        uint16 `yaml:"half_life"`
+	SuppressLimit   uint16 `yaml:"suppress_limit"`
+	ReuseLimit      uint16 `yaml:"reuse_limit"`
+	MaxSuppressTime uint16 `yaml:"max_suppress_time"`
+}
+
 type UpstreamsConfig struct {
 	Name        string            `yaml:"name"`
 	Host        string            `yaml:"host"`
 	Port        uint16            `yaml:"port"`
 	Dns         UpstreamDnsConfig `yaml:"dns"`
 	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Fwmark      uint32            `yaml:"fwmark"`
+	Dampening   *DampeningConfig  `yaml:"dampening"`
+}
+
+type PersistenceConfig struct {
+	Type    string `yaml:"type"`
+	Timeout uint32 `yaml:"timeout"`
+}
+
+type OutlierDetectionConfig struct {
+	MaxFailureRatio uint8  `yaml:"max_failure_ratio"`
+	MinFlows        uint32 `yaml:"min_flows"`
+	EjectionTime    uint16 `yaml:"ejection_time"`
+	MaxEjected      uint8  `yaml:"max_ejected"`
 }
 
 type UpstreamGroupConfig struct {
-	Name         string            `yaml:"name"`
-	Distribution string            `yaml:"distribution"`
-	Upstreams    []UpstreamsConfig `yaml:"upstreams"`
+	Name             string                  `yaml:"name"`
+	Distribution     string                  `yaml:"distribution"`
+	Hash             string                  `yaml:"hash"`
+	Fwmark           uint32                  `yaml:"fwmark"`
+	Persistence      PersistenceConfig       `yaml:"persistence"`
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection"`
+	MinHealthyPct    uint8                   `yaml:"min_healthy_percent"`
+	Upstreams        []UpstreamsConfig       `yaml:"upstreams"`
+}
+
+type RouteConfig struct {
+	Sni           []string            `yaml:"sni"`
+	Host          []string            `yaml:"host"`
+	PathPrefix    string              `yaml:"path_prefix"`
+	UpstreamGroup UpstreamGroupConfig `yaml:"upstream_group"`
 }
 
 type TargetsConfig struct {
@@ -39,14 +165,19 @@ type TargetsConfig struct {
 	Protocol      string              `yaml:"protocol"`
 	Ip            string              `yaml:"ip"`
 	Port          uint16              `yaml:"port"`
+	Interfaces    []string            `yaml:"interfaces"`
+	ProxyProtocol string              `yaml:"proxy_protocol"`
 	UpstreamGroup UpstreamGroupConfig `yaml:"upstream_group"`
+	Routes        []RouteConfig       `yaml:"routes"`
 }
 
 type LbConfig struct {
+	Name          string          `yaml:"name"`
 	Engine        string          `yaml:"engine"`
 	TargetsConfig []TargetsConfig `yaml:"targets"`
 }
 
 type ConfigYaml struct {
+	Instance string     `yaml:"instance"`
 	LbConfig []LbConfig `yaml:"lb"`
 }
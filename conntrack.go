@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// conntrack netlink (ctnetlink) message and attribute types
+// See linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctnlMsgCtGet          = 1 // IPCTNL_MSG_CT_GET
+	ctaTupleReply         = 2 // CTA_TUPLE_REPLY
+	ctaProtoinfo          = 4 // CTA_PROTOINFO
+	ctaTupleIp            = 1 // CTA_TUPLE_IP
+	ctaTupleProto         = 2 // CTA_TUPLE_PROTO
+	ctaIpV4Src            = 1 // CTA_IP_V4_SRC
+	ctaIpV6Src            = 3 // CTA_IP_V6_SRC
+	ctaProtoNum           = 1 // CTA_PROTO_NUM
+	ctaProtoSrcPort       = 2 // CTA_PROTO_SRC_PORT
+	ctaProtoinfoTcp       = 1 // CTA_PROTOINFO_TCP
+	ctaProtoinfoTcpState  = 1 // CTA_PROTOINFO_TCP_STATE
+	ctTcpStateSynSent     = 1 // TCP_CONNTRACK_SYN_SENT
+	ctTcpStateEstablished = 3 // TCP_CONNTRACK_ESTABLISHED
+	ctTcpStateClose       = 7 // TCP_CONNTRACK_CLOSE
+	nfGenMsgLen           = 4 // nfgenmsg header length
+)
+
+// conntrack errors
+var (
+	errCtConn = errors.New(
+		"Failed to create a conntrack netlink connection",
+	)
+	errCtDump = errors.New(
+		"Error when dumping the conntrack table",
+	)
+	errCtParse = errors.New(
+		"Error when parsing a conntrack entry",
+	)
+)
+
+// A ctFlow holds the conntrack entry details used to count the flows per upstream
+// The address and port are the reply tuple source, which is the upstream after DNAT
+type ctFlow struct {
+	address  net.IP // reply tuple source address
+	port     uint16 // reply tuple source port
+	protocol uint8  // layer 4 protocol number
+	state    uint8  // TCP conntrack state. 0 if not TCP
+}
+
+// parseCtFlow parses a ctnetlink message payload into a ctFlow
+func parseCtFlow(b []byte) (ctFlow, error) {
+	var f ctFlow
+
+	if len(b) < nfGenMsgLen {
+		return f, fmt.Errorf("%w: message too short", errCtParse)
+	}
+
+	ad, err := netlink.NewAttributeDecoder(b[nfGenMsgLen:])
+	if err != nil {
+		return f, fmt.Errorf("%w: %w", errCtParse, err)
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleReply:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case ctaTupleIp:
+						nad.Nested(func(ipad *netlink.AttributeDecoder) error {
+							for ipad.Next() {
+								switch ipad.Type() {
+								case ctaIpV4Src, ctaIpV6Src:
+									f.address = net.IP(ipad.Bytes())
+								}
+							}
+							return nil
+						})
+					case ctaTupleProto:
+						nad.Nested(func(pad *netlink.AttributeDecoder) error {
+							for pad.Next() {
+								switch pad.Type() {
+								case ctaProtoNum:
+									f.protocol = pad.Uint8()
+								case ctaProtoSrcPort:
+									f.port = pad.Uint16()
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		case ctaProtoinfo:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaProtoinfoTcp {
+						nad.Nested(func(tad *netlink.AttributeDecoder) error {
+							for tad.Next() {
+								if tad.Type() == ctaProtoinfoTcpState {
+									f.state = tad.Uint8()
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return f, fmt.Errorf("%w: %w", errCtParse, err)
+	}
+
+	return f, nil
+}
+
+// ctFlowKey returns the key used to count flows for a given address and port
+func ctFlowKey(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// A ctStats holds the TCP flows counters of an upstream
+type ctStats struct {
+	flows  uint32 // tracked TCP flows
+	failed uint32 // TCP flows reset or without handshake reply
+}
+
+// failed checks if a flow got a reset or never got a reply to its handshake
+// Flows in the SYN_SENT state didn't get a SYN-ACK yet, and flows in the CLOSE state were reset
+func (f ctFlow) failed() bool {
+	return f.state == ctTcpStateSynSent || f.state == ctTcpStateClose
+}
+
+// ctDump dumps the IPv4 and IPv6 conntrack table and returns its flows
+// Entries which fail to be parsed are skipped
+func ctDump() ([]ctFlow, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCtConn, err)
+	}
+	defer c.Close()
+
+	msgs, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ctnlMsgCtGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		// nfgenmsg: family, version and resource id. AF_UNSPEC dumps all families
+		Data: []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCtDump, err)
+	}
+
+	flows := make([]ctFlow, 0, len(msgs))
+	for _, m := range msgs {
+		f, err := parseCtFlow(m.Data)
+		if err != nil {
+			LogDVf("LB: skipping conntrack entry: %v", err)
+			continue
+		}
+		flows = append(flows, f)
+	}
+
+	return flows, nil
+}
+
+// ctEstablishedCount dumps the conntrack table and returns
+// the amount of established TCP flows per reply tuple source address and port
+// The map keys are built with ctFlowKey
+func ctEstablishedCount() (map[string]uint32, error) {
+	flows, err := ctDump()
+	if err != nil {
+		return nil, err
+	}
+
+	count := make(map[string]uint32)
+	for _, f := range flows {
+		if f.protocol != unix.IPPROTO_TCP || f.state != ctTcpStateEstablished || f.address == nil {
+			continue
+		}
+		count[ctFlowKey(f.address, f.port)]++
+	}
+
+	return count, nil
+}
+
+// ctTcpStats returns the TCP flows counters per reply tuple source address and port
+// The map keys are built with ctFlowKey
+func ctTcpStats(flows []ctFlow) map[string]ctStats {
+	stats := make(map[string]ctStats)
+	for _, f := range flows {
+		if f.protocol != unix.IPPROTO_TCP || f.address == nil {
+			continue
+		}
+		k := ctFlowKey(f.address, f.port)
+		st := stats[k]
+		st.flows++
+		if f.failed() {
+			st.failed++
+		}
+		stats[k] = st
+	}
+
+	return stats
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ctTestMsg builds a ctnetlink message payload with the given reply tuple source and TCP state
+func ctTestMsg(t *testing.T, ip net.IP, port uint16, state uint8) []byte {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(ctaTupleReply, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIp, func(ipae *netlink.AttributeEncoder) error {
+			if ip.To4() != nil {
+				ipae.Bytes(ctaIpV4Src, ip.To4())
+			} else {
+				ipae.Bytes(ctaIpV6Src, ip.To16())
+			}
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(pae *netlink.AttributeEncoder) error {
+			pae.Uint8(ctaProtoNum, unix.IPPROTO_TCP)
+			pae.Uint16(ctaProtoSrcPort, port)
+			return nil
+		})
+		return nil
+	})
+	ae.Nested(ctaProtoinfo, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaProtoinfoTcp, func(tae *netlink.AttributeEncoder) error {
+			tae.Uint8(ctaProtoinfoTcpState, state)
+			return nil
+		})
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode test message: %v", err)
+	}
+
+	return append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, b...)
+}
+
+func TestParseCtFlow(t *testing.T) {
+	f, err := parseCtFlow(ctTestMsg(t, net.ParseIP("10.0.0.1"), 8080, ctTcpStateEstablished))
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	if !f.address.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected address '10.0.0.1', but got '%v'", f.address)
+	}
+	if f.port != 8080 {
+		t.Errorf("expected port '8080', but got '%d'", f.port)
+	}
+	if f.protocol != unix.IPPROTO_TCP {
+		t.Errorf("expected protocol '%d', but got '%d'", unix.IPPROTO_TCP, f.protocol)
+	}
+	if f.state != ctTcpStateEstablished {
+		t.Errorf("expected state '%d', but got '%d'", ctTcpStateEstablished, f.state)
+	}
+	if k := ctFlowKey(f.address, f.port); k != "10.0.0.1:8080" {
+		t.Errorf("expected key '10.0.0.1:8080', but got '%s'", k)
+	}
+
+	// IPv6 reply tuple source
+	f, err = parseCtFlow(ctTestMsg(t, net.ParseIP("2001:db8::1"), 8080, ctTcpStateEstablished))
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	if k := ctFlowKey(f.address, f.port); k != "[2001:db8::1]:8080" {
+		t.Errorf("expected key '[2001:db8::1]:8080', but got '%s'", k)
+	}
+
+	if _, err := parseCtFlow([]byte{unix.AF_INET}); !errors.Is(err, errCtParse) {
+		t.Errorf("expected '%v', but got '%v'", errCtParse, err)
+	}
+}
+
+func TestCtTcpStats(t *testing.T) {
+	u1 := net.ParseIP("10.0.0.1")
+	u2 := net.ParseIP("10.0.0.2")
+	flows := []ctFlow{
+		{address: u1, port: 80, protocol: unix.IPPROTO_TCP, state: ctTcpStateEstablished},
+		{address: u1, port: 80, protocol: unix.IPPROTO_TCP, state: ctTcpStateSynSent},
+		{address: u1, port: 80, protocol: unix.IPPROTO_TCP, state: ctTcpStateClose},
+		{address: u1, port: 81, protocol: unix.IPPROTO_TCP, state: ctTcpStateClose},
+		{address: u2, port: 80, protocol: unix.IPPROTO_TCP, state: ctTcpStateEstablished},
+		{address: u2, port: 80, protocol: unix.IPPROTO_UDP, state: 0},
+		{address: nil, port: 80, protocol: unix.IPPROTO_TCP, state: ctTcpStateClose},
+	}
+
+	stats := ctTcpStats(flows)
+	expected := map[string]ctStats{
+		"10.0.0.1:80": {flows: 3, failed: 2},
+		"10.0.0.1:81": {flows: 1, failed: 1},
+		"10.0.0.2:80": {flows: 1, failed: 0},
+	}
+	if len(stats) != len(expected) {
+		t.Errorf("expected %d keys, but got %d: %v", len(expected), len(stats), stats)
+	}
+	for k, e := range expected {
+		if stats[k] != e {
+			t.Errorf("expected '%s' stats '%+v', but got '%+v'", k, e, stats[k])
+		}
+	}
+}
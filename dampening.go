@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Flap dampening settings
+const (
+	dampPenalty          = 1000 // penalty added on each upstream state change
+	dampHalfLife         = 60   // default penalty half life in seconds
+	dampSuppressLimit    = 3000 // default penalty above which the upstream is suppressed
+	dampReuseLimit       = 1000 // default penalty below which a suppressed upstream is reused
+	dampMaxSuppressRatio = 4    // default max suppress time, in half lives
+)
+
+// Flap dampening errors
+var (
+	errDampLimits = errors.New(
+		"flap dampening 'reuse_limit' must be below the 'suppress_limit'",
+	)
+	errDampMaxSuppress = errors.New(
+		"flap dampening 'max_suppress_time' is too short for the penalty to ever reach the 'suppress_limit'",
+	)
+)
+
+// flapDampening holds the upstream flap dampening settings and state
+// Each upstream state change adds a penalty, which decays exponentially with the half life.
+// Once the penalty reaches the suppress limit, the upstream is held unavailable until the penalty
+// decays below the reuse limit. An upstream which keeps flapping while suppressed accumulates penalty,
+// so its suppression grows up to the max suppress time
+type flapDampening struct {
+	halfLife      time.Duration // penalty half life
+	suppressLimit float64       // penalty above which the upstream is suppressed
+	reuseLimit    float64       // penalty below which a suppressed upstream is reused
+	maxPenalty    float64       // penalty ceiling, so that the suppression doesn't last longer than the max suppress time
+	up            bool          // last undampened upstream availability
+	penalty       float64       // current penalty, as of updated
+	updated       time.Time     // last penalty update
+	suppressed    bool          // whether the upstream is suppressed
+	flaps         uint64        // total upstream state changes
+	suppressions  uint64        // total upstream suppressions
+}
+
+// getFlapDampening returns the flap dampening settings
+// up is the initial upstream availability
+func getFlapDampening(c *DampeningConfig, up bool) (*flapDampening, error) {
+	halfLife := uint16(dampHalfLife)
+	if c.HalfLife != 0 {
+		halfLife = c.HalfLife
+	}
+	d := &flapDampening{
+		halfLife:      time.Duration(halfLife) * time.Second,
+		suppressLimit: dampSuppressLimit,
+		reuseLimit:    dampReuseLimit,
+		up:            up,
+	}
+	if c.SuppressLimit != 0 {
+		d.suppressLimit = float64(c.SuppressLimit)
+	}
+	if c.ReuseLimit != 0 {
+		d.reuseLimit = float64(c.ReuseLimit)
+	}
+	if d.reuseLimit >= d.suppressLimit {
+		return nil, fmt.Errorf("%w: %v, %v", errDampLimits, d.reuseLimit, d.suppressLimit)
+	}
+
+	maxSuppress := time.Duration(halfLife) * dampMaxSuppressRatio * time.Second
+	if c.MaxSuppressTime != 0 {
+		maxSuppress = time.Duration(c.MaxSuppressTime) * time.Second
+	}
+	d.maxPenalty = d.reuseLimit * math.Exp2(float64(maxSuppress)/float64(d.halfLife))
+	if d.maxPenalty < d.suppressLimit {
+		return nil, fmt.Errorf("%w: %v", errDampMaxSuppress, maxSuppress)
+	}
+
+	return d, nil
+}
+
+// sameSettings checks if the flap dampening settings of d and o are the same
+func (d *flapDampening) sameSettings(o *flapDampening) bool {
+	return d.halfLife == o.halfLife &&
+		d.suppressLimit == o.suppressLimit &&
+		d.reuseLimit == o.reuseLimit &&
+		d.maxPenalty == o.maxPenalty
+}
+
+// penaltyAt returns the penalty decayed up to now
+func (d *flapDampening) penaltyAt(now time.Time) float64 {
+	if d.updated.IsZero() || !now.After(d.updated) {
+		return d.penalty
+	}
+
+	return d.penalty * math.Exp2(-float64(now.Sub(d.updated))/float64(d.halfLife))
+}
+
+// decay decays the penalty up to now
+func (d *flapDampening) decay(now time.Time) {
+	d.penalty = d.penaltyAt(now)
+	d.updated = now
+}
+
+// reuseIn returns the time until the penalty decays below the reuse limit
+func (d *flapDampening) reuseIn(now time.Time) time.Duration {
+	p := d.penaltyAt(now)
+	if p < d.reuseLimit {
+		return 0
+	}
+
+	return time.Duration(math.Log2(p/d.reuseLimit) * float64(d.halfLife))
+}
+
+// update records the undampened upstream availability and returns the dampened availability
+// A change of the undampened availability is a flap and adds a penalty
+func (d *flapDampening) update(name string, up bool, now time.Time) bool {
+	d.decay(now)
+	if up != d.up {
+		d.up = up
+		d.flaps++
+		d.penalty = math.Min(d.penalty+dampPenalty, d.maxPenalty)
+		LogDf("LB FD (%s): upstream state changed. Flap dampening penalty %.0f", name, d.penalty)
+	}
+
+	switch {
+	case !d.suppressed && d.penalty >= d.suppressLimit:
+		d.suppressed = true
+		d.suppressions++
+		LogWf(
+			"LB FD (%s): upstream is flapping. Flap dampening penalty %.0f reached the suppress limit %.0f. Upstream held unavailable for %v",
+			name,
+			d.penalty,
+			d.suppressLimit,
+			d.reuseIn(now).Truncate(time.Second),
+		)
+	case d.suppressed && d.penalty < d.reuseLimit:
+		d.suppressed = false
+		LogIf(
+			"LB FD (%s): flap dampening penalty decayed below the reuse limit %.0f. Upstream no longer suppressed",
+			name,
+			d.reuseLimit,
+		)
+	}
+
+	return up && !d.suppressed
+}
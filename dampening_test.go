@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetFlapDampening(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     DampeningConfig
+		err        error
+		halfLife   time.Duration
+		suppress   float64
+		reuse      float64
+		maxPenalty float64
+	}{
+		{name: "defaults", config: DampeningConfig{}, err: nil, halfLife: 60 * time.Second, suppress: 3000, reuse: 1000, maxPenalty: 16000},
+		{name: "settings", config: DampeningConfig{HalfLife: 10, SuppressLimit: 2000, ReuseLimit: 500, MaxSuppressTime: 30}, err: nil, halfLife: 10 * time.Second, suppress: 2000, reuse: 500, maxPenalty: 4000},
+		{name: "reuse above suppress", config: DampeningConfig{SuppressLimit: 1000, ReuseLimit: 2000}, err: errDampLimits},
+		{name: "reuse equal to suppress", config: DampeningConfig{SuppressLimit: 1000, ReuseLimit: 1000}, err: errDampLimits},
+		{name: "max suppress time too short", config: DampeningConfig{HalfLife: 60, MaxSuppressTime: 60}, err: errDampMaxSuppress},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := getFlapDampening(&tc.config, true)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if d.halfLife != tc.halfLife || d.suppressLimit != tc.suppress || d.reuseLimit != tc.reuse || d.maxPenalty != tc.maxPenalty {
+				t.Errorf(
+					"expected half life %v, limits %v/%v and max penalty %v, but got %v, %v/%v and %v",
+					tc.halfLife, tc.suppress, tc.reuse, tc.maxPenalty,
+					d.halfLife, d.suppressLimit, d.reuseLimit, d.maxPenalty,
+				)
+			}
+		})
+	}
+}
+
+func TestFlapDampening(t *testing.T) {
+	d, _ := getFlapDampening(&DampeningConfig{HalfLife: 60, SuppressLimit: 2500, ReuseLimit: 1000, MaxSuppressTime: 180}, true)
+	now := time.Now()
+
+	// three flaps within a few seconds suppress the upstream
+	steps := []struct {
+		up        bool
+		available bool
+	}{
+		{up: false, available: false},
+		{up: true, available: true},
+		{up: false, available: false},
+		{up: true, available: false},
+	}
+	for i, s := range steps {
+		if a := d.update("u1", s.up, now.Add(time.Duration(i)*time.Second)); a != s.available {
+			t.Errorf("step %d: expected available '%t', but got '%t'", i+1, s.available, a)
+		}
+	}
+	if !d.suppressed || d.flaps != 4 || d.suppressions != 1 {
+		t.Fatalf("expected a suppressed upstream after 4 flaps and 1 suppression, but got suppressed '%t', %d flaps and %d suppressions", d.suppressed, d.flaps, d.suppressions)
+	}
+
+	// the suppression lasts until the penalty decays below the reuse limit
+	reuse := d.reuseIn(now.Add(3 * time.Second))
+	if reuse <= 0 || reuse > 180*time.Second {
+		t.Fatalf("expected a reuse time up to the max suppress time, but got %v", reuse)
+	}
+	if d.update("u1", true, now.Add(reuse)) {
+		t.Errorf("expected upstream to stay suppressed before the reuse time")
+	}
+	if !d.update("u1", true, now.Add(reuse+5*time.Second)) || d.suppressed {
+		t.Errorf("expected upstream to be reused after the reuse time")
+	}
+
+	// flapping while suppressed grows the suppression up to the max suppress time
+	later := now.Add(time.Hour)
+	for i := 0; i < 20; i++ {
+		d.update("u1", i%2 == 0, later.Add(time.Duration(i)*time.Second))
+	}
+	if d.penalty > d.maxPenalty {
+		t.Errorf("expected penalty up to %v, but got %v", d.maxPenalty, d.penalty)
+	}
+	if r := d.reuseIn(later.Add(19 * time.Second)); r < 150*time.Second || r > 180*time.Second {
+		t.Errorf("expected a reuse time close to the max suppress time, but got %v", r)
+	}
+}
+
+func TestHcUpdateDampening(t *testing.T) {
+	errProbe := errors.New("connection refused")
+	d, _ := getFlapDampening(&DampeningConfig{HalfLife: 60, SuppressLimit: 2500, ReuseLimit: 1000}, true)
+	u := &upstream{
+		name:      "u1",
+		available: true,
+		healthCheck: healthCheck{
+			active:      true,
+			healthy:     true,
+			countConfig: 1,
+			failConfig:  1,
+		},
+		damp: d,
+	}
+
+	// probe results and expected availability after each of them
+	steps := []struct {
+		err       error
+		available bool
+		changed   bool
+	}{
+		{err: errProbe, available: false, changed: true},
+		{err: nil, available: true, changed: true},
+		{err: errProbe, available: false, changed: true},
+		{err: nil, available: false, changed: false}, // suppressed
+		{err: nil, available: false, changed: false},
+	}
+	for i, s := range steps {
+		if changed, _ := u.hcUpdate("127.0.0.1:80", s.err); changed != s.changed || u.available != s.available {
+			t.Errorf("step %d: expected available '%t' and changed '%t', but got '%t' and '%t'", i+1, s.available, s.changed, u.available, changed)
+		}
+	}
+	if !u.healthCheck.healthy {
+		t.Errorf("expected a healthy upstream held unavailable")
+	}
+}
@@ -1,15 +1,16 @@
 module git.borisoglebski.com/lobby
 
-go 1.20
+go 1.21
 
 require (
 	github.com/google/nftables v0.1.0
-	github.com/mdlayher/netlink v1.7.2 // indirect
+	github.com/mdlayher/netlink v1.7.2
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/miekg/dns v1.1.57
+	golang.org/x/net v0.19.0
 	golang.org/x/sys v0.15.0
 	kernel.org/pub/linux/libs/security/libcap/cap v1.2.69
 )
@@ -19,8 +20,8 @@ require (
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/socket v0.5.0 // indirect
 	golang.org/x/mod v0.14.0 // indirect
-	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.16.0 // indirect
 	kernel.org/pub/linux/libs/security/libcap/psx v1.2.69 // indirect
 )
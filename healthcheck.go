@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Health check settings
+const (
+	hcHttpMaxBody       = 64 * 1024 // max response body bytes read by http health checks
+	hcHttpDefaultMethod = "GET"     // default http health check request method
+	hcHttpDefaultPath   = "/"       // default http health check request path
+)
+
+// default http health check expected response status codes
+var hcHttpDefaultStatus = []statusRange{{min: 200, max: 399}}
+
+// Health check errors
+var (
+	errHcSettings = errors.New(
+		"health check settings don't match the health check protocol",
+	)
+	errHcHost = errors.New(
+		"invalid health check host",
+	)
+	errHcSource = errors.New(
+		"invalid health check source address",
+	)
+	errHcInterface = errors.New(
+		"invalid health check interface",
+	)
+	errHcHttpMethod = errors.New(
+		"invalid http health check method",
+	)
+	errHcHttpPath = errors.New(
+		"invalid http health check path. It must start with '/'",
+	)
+	errHcHttpStatus = errors.New(
+		"invalid http health check status. Use a status code such as '200' or a range such as '200-299'",
+	)
+	errHcHttpBodyRegex = errors.New(
+		"invalid http health check body regex",
+	)
+	errHcHttpTls = errors.New(
+		"invalid https health check tls settings",
+	)
+	errHcStatus = errors.New(
+		"unexpected response status",
+	)
+	errHcBody = errors.New(
+		"unexpected response body",
+	)
+	errHcHex = errors.New(
+		"invalid health check hex payload",
+	)
+	errHcExpect = errors.New(
+		"invalid health check expect regex. Only one of 'expect' or 'expect_hex' may be set",
+	)
+	errHcNoMatch = errors.New(
+		"no response matching the expected pattern",
+	)
+	errHcUnresolved = errors.New(
+		"upstream host address not resolved",
+	)
+)
+
+// An hcStep is a payload sent to the upstream and the response expected back
+type hcStep struct {
+	payload   []byte         // payload sent to the upstream
+	expect    *regexp.Regexp // expected response regex
+	expectHex []byte         // expected response prefix
+}
+
+// getHcStep returns the hcStep of a send/expect config
+// The payload is set either as text or as hex. The expected response either as a regex or as a hex prefix
+func getHcStep(c *SendExpectConfig) (hcStep, error) {
+	s := hcStep{payload: []byte(c.Send)}
+
+	if c.Send != "" && c.SendHex != "" {
+		return hcStep{}, fmt.Errorf("%w: only one of 'send' or 'send_hex' may be set", errHcHex)
+	}
+	if c.SendHex != "" {
+		b, err := hex.DecodeString(c.SendHex)
+		if err != nil {
+			return hcStep{}, fmt.Errorf("%w: %w", errHcHex, err)
+		}
+		s.payload = b
+	}
+
+	if c.Expect != "" && c.ExpectHex != "" {
+		return hcStep{}, errHcExpect
+	}
+	if c.Expect != "" {
+		re, err := regexp.Compile(c.Expect)
+		if err != nil {
+			return hcStep{}, fmt.Errorf("%w: %w", errHcExpect, err)
+		}
+		s.expect = re
+	}
+	if c.ExpectHex != "" {
+		b, err := hex.DecodeString(c.ExpectHex)
+		if err != nil {
+			return hcStep{}, fmt.Errorf("%w: %w", errHcHex, err)
+		}
+		s.expectHex = b
+	}
+
+	return s, nil
+}
+
+// expects checks if the step expects a response
+func (s *hcStep) expects() bool {
+	return s.expect != nil || len(s.expectHex) != 0
+}
+
+// match checks if a response matches the expected response
+func (s *hcStep) match(b []byte) bool {
+	if s.expect != nil {
+		return s.expect.Match(b)
+	}
+
+	return bytes.HasPrefix(b, s.expectHex)
+}
+
+// A statusRange is a range of http status codes
+type statusRange struct {
+	min int
+	max int
+}
+
+// hcHttp holds the http and https health check settings
+type hcHttp struct {
+	method    string            // request method
+	scheme    string            // 'http' or 'https'
+	path      string            // request path and query
+	host      string            // request Host header. The upstream address is used if empty
+	headers   map[string]string // additional request headers
+	status    []statusRange     // expected response status codes
+	body      string            // expected response body substring
+	bodyRegex *regexp.Regexp    // expected response body regex
+	client    *http.Client      // health check client. Connections aren't reused between probes
+}
+
+// parseStatusRange returns the statusRange of a status code such as '200' or a status code range such as '200-299'
+func parseStatusRange(s string) (statusRange, error) {
+	lo, hi, found := strings.Cut(strings.TrimSpace(s), "-")
+	if !found {
+		hi = lo
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("%w: '%s'", errHcHttpStatus, s)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil || from < 100 || to > 599 || from > to {
+		return statusRange{}, fmt.Errorf("%w: '%s'", errHcHttpStatus, s)
+	}
+
+	return statusRange{min: from, max: to}, nil
+}
+
+// hcServerName returns the default TLS server name of a health check
+// It is the request host without port if set, or the upstream host if it is a domain name
+func hcServerName(host, upstreamHost string) string {
+	if host != "" {
+		if hn, _, err := net.SplitHostPort(host); err == nil {
+			return hn
+		}
+		return host
+	}
+	if ht, _ := getHostType(upstreamHost); ht == hostTypeFqdn {
+		return strings.TrimSuffix(upstreamHost, ".")
+	}
+
+	return ""
+}
+
+// getHcTlsConfig returns the tls.Config of an https health check
+// The server name defaults to the request Host header or to the upstream host if it is a domain name
+func getHcTlsConfig(c *HealthCheckTlsConfig, host string) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+
+	if c.CaFile != "" {
+		pem, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errHcHttpTls, err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates found in '%s'", errHcHttpTls, c.CaFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errHcHttpTls, err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// getHcHttp returns the http or https health check settings for an upstream host
+// Unset settings use the defaults: a 'GET /' request expecting a 2xx or 3xx response status
+func getHcHttp(c *HttpHealthCheckConfig, https bool, upstreamHost string, timeout uint8, src hcSource) (*hcHttp, error) {
+	if c == nil {
+		c = &HttpHealthCheckConfig{}
+	}
+
+	h := &hcHttp{
+		method:  strings.ToUpper(c.Method),
+		scheme:  "http",
+		path:    c.Path,
+		host:    c.Host,
+		headers: c.Headers,
+		status:  hcHttpDefaultStatus,
+		body:    c.Body,
+	}
+
+	if h.method == "" {
+		h.method = hcHttpDefaultMethod
+	}
+	if strings.IndexFunc(h.method, func(r rune) bool { return r < 'A' || r > 'Z' }) != -1 {
+		return nil, fmt.Errorf("%w: '%s'", errHcHttpMethod, c.Method)
+	}
+
+	if h.path == "" {
+		h.path = hcHttpDefaultPath
+	}
+	if !strings.HasPrefix(h.path, "/") {
+		return nil, fmt.Errorf("%w: '%s'", errHcHttpPath, c.Path)
+	}
+
+	if len(c.Status) != 0 {
+		h.status = nil
+		for _, s := range c.Status {
+			sr, err := parseStatusRange(s)
+			if err != nil {
+				return nil, err
+			}
+			h.status = append(h.status, sr)
+		}
+	}
+
+	if c.BodyRegex != "" {
+		re, err := regexp.Compile(c.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errHcHttpBodyRegex, err)
+		}
+		h.bodyRegex = re
+	}
+
+	tr := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       src.dialer("tcp", 0).DialContext,
+	}
+	if https {
+		h.scheme = "https"
+		tc, err := getHcTlsConfig(&c.Tls, hcServerName(h.host, upstreamHost))
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tc
+	} else if c.Tls != (HealthCheckTlsConfig{}) {
+		return nil, fmt.Errorf("%w: tls settings require the 'https' protocol", errHcHttpTls)
+	}
+
+	h.client = &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: tr,
+		// Redirects are not followed, so the redirect status is checked
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return h, nil
+}
+
+// probe sends the health check request to addr and checks the response status and body
+func (h *hcHttp) probe(addr string) error {
+	req, err := http.NewRequest(h.method, h.scheme+"://"+addr+h.path, nil)
+	if err != nil {
+		return err
+	}
+	if h.host != "" {
+		req.Host = h.host
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	ok := false
+	for _, sr := range h.status {
+		if res.StatusCode >= sr.min && res.StatusCode <= sr.max {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: %d", errHcStatus, res.StatusCode)
+	}
+
+	if h.body == "" && h.bodyRegex == nil {
+		return nil
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, hcHttpMaxBody))
+	if err != nil {
+		return err
+	}
+	if h.body != "" && !strings.Contains(string(b), h.body) {
+		return fmt.Errorf("%w: '%s' not found", errHcBody, h.body)
+	}
+	if h.bodyRegex != nil && !h.bodyRegex.Match(b) {
+		return fmt.Errorf("%w: no match for '%s'", errHcBody, h.bodyRegex.String())
+	}
+
+	return nil
+}
+
+// An hcSource is the source address and interface the health check probes are bound to
+type hcSource struct {
+	ip    net.IP // source IP address. Chosen by the routing if nil
+	iface string // source interface. Chosen by the routing if empty
+}
+
+// getHcSource returns the health check probes source
+func getHcSource(source, iface string) (hcSource, error) {
+	var s hcSource
+
+	if source != "" {
+		s.ip = net.ParseIP(source)
+		if s.ip == nil {
+			return hcSource{}, fmt.Errorf("%w: '%s'", errHcSource, source)
+		}
+	}
+	if iface != "" {
+		if !isInterfaceName(iface) {
+			return hcSource{}, fmt.Errorf("%w: '%s'", errHcInterface, iface)
+		}
+		s.iface = iface
+	}
+
+	return s, nil
+}
+
+// bound checks if the probes are bound to a source address or interface
+func (s hcSource) bound() bool {
+	return s.ip != nil || s.iface != ""
+}
+
+// dialer returns a dialer for network bound to the source address and interface
+func (s hcSource) dialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if s.ip != nil {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			d.LocalAddr = &net.TCPAddr{IP: s.ip}
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: s.ip}
+		}
+	}
+	if s.iface != "" {
+		d.Control = s.control
+	}
+
+	return d
+}
+
+// control binds a socket to the source interface
+// It requires the CAP_NET_RAW capability
+func (s hcSource) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cErr := c.Control(func(fd uintptr) {
+		err = syscall.BindToDevice(int(fd), s.iface)
+	}); cErr != nil {
+		return cErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: '%s': %w", errHcInterface, s.iface, err)
+	}
+
+	return nil
+}
+
+// setProbe sets the probes host, source and protocol specific settings of the health check from its config
+// Settings of other protocols than the health check protocol are rejected
+func (hc *healthCheck) setProbe(c *HealthCheckConfig, upstreamHost string) error {
+	if c.Http != nil && hc.protocol != hcProtoHttp && hc.protocol != hcProtoHttps {
+		return fmt.Errorf("%w: 'http' settings require the 'http' or 'https' protocol", errHcSettings)
+	}
+	if c.Grpc != nil && hc.protocol != hcProtoGrpc {
+		return fmt.Errorf("%w: 'grpc' settings require the 'grpc' protocol", errHcSettings)
+	}
+	if c.Udp != nil && hc.protocol != hcProtoUdp {
+		return fmt.Errorf("%w: 'udp' settings require the 'udp' protocol", errHcSettings)
+	}
+	if c.Tcp != nil && hc.protocol != hcProtoTcpSendExpect {
+		return fmt.Errorf("%w: 'tcp' settings require the 'tcp-send-expect' protocol", errHcSettings)
+	}
+	if c.Redis != nil && hc.protocol != hcProtoRedis {
+		return fmt.Errorf("%w: 'redis' settings require the 'redis' protocol", errHcSettings)
+	}
+	if c.Mysql != nil && hc.protocol != hcProtoMysql {
+		return fmt.Errorf("%w: 'mysql' settings require the 'mysql' protocol", errHcSettings)
+	}
+	if c.Postgres != nil && hc.protocol != hcProtoPostgres {
+		return fmt.Errorf("%w: 'postgres' settings require the 'postgres' protocol", errHcSettings)
+	}
+	if c.Icmp != nil && hc.protocol != hcProtoIcmp {
+		return fmt.Errorf("%w: 'icmp' settings require the 'icmp' protocol", errHcSettings)
+	}
+	if c.Dns != nil && hc.protocol != hcProtoDns {
+		return fmt.Errorf("%w: 'dns' settings require the 'dns' protocol", errHcSettings)
+	}
+	if c.Exec != nil && hc.protocol != hcProtoExec {
+		return fmt.Errorf("%w: 'exec' settings require the 'exec' protocol", errHcSettings)
+	}
+
+	if c.Host != "" {
+		if _, err := getHostType(c.Host); err != nil {
+			return fmt.Errorf("%w: %w", errHcHost, err)
+		}
+		hc.host = c.Host
+	}
+	src, err := getHcSource(c.Source, c.Interface)
+	if err != nil {
+		return err
+	}
+	hc.source = src
+
+	switch hc.protocol {
+	case hcProtoHttp, hcProtoHttps:
+		hc.http, err = getHcHttp(c.Http, hc.protocol == hcProtoHttps, upstreamHost, hc.timeout, hc.source)
+	case hcProtoGrpc:
+		hc.grpc, err = getHcGrpc(c.Grpc, upstreamHost, hc.timeout, hc.source)
+	case hcProtoUdp:
+		hc.udp, err = getHcUdp(c.Udp, hc.timeout, hc.source)
+	case hcProtoTcpSendExpect, hcProtoRedis, hcProtoMysql, hcProtoPostgres, hcProtoSmtp, hcProtoFtp:
+		hc.tcp, err = getHcTcp(c, hc.protocol, hc.timeout, hc.source)
+	case hcProtoIcmp:
+		hc.icmp, err = getHcIcmp(c.Icmp, hc.timeout, hc.source)
+	case hcProtoDns:
+		hc.dns, err = getHcDns(c.Dns, hc.timeout, hc.source)
+	case hcProtoExec:
+		hc.exec, err = getHcExec(c.Exec, upstreamHost, hc.timeout)
+	}
+
+	return err
+}
+
+// probe runs a health check toward addr according to the health check protocol
+func (hc *healthCheck) probe(addr string) error {
+	switch hc.protocol {
+	case hcProtoHttp, hcProtoHttps:
+		return hc.http.probe(addr)
+	case hcProtoGrpc:
+		return hc.grpc.probe(addr)
+	case hcProtoUdp:
+		return hc.udp.probe(addr)
+	case hcProtoTcpSendExpect, hcProtoRedis, hcProtoMysql, hcProtoPostgres, hcProtoSmtp, hcProtoFtp:
+		return hc.tcp.probe(addr)
+	case hcProtoIcmp:
+		return hc.icmp.probe(addr)
+	case hcProtoDns:
+		return hc.dns.probe(addr)
+	case hcProtoExec:
+		return hc.exec.probe(addr)
+	}
+
+	c, err := hc.source.dialer(
+		hc.protocol.String(),
+		time.Duration(hc.timeout)*time.Second,
+	).Dial(hc.protocol.String(), addr)
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// nextInterval returns the interval until the next health check
+// While the upstream is unavailable, the unhealthy interval is used. With backoff, it doubles on each
+// consecutive failed check after the upstream became unavailable, up to the backoff max interval,
+// and varies randomly by the jitter percentage
+func (hc *healthCheck) nextInterval(available bool) time.Duration {
+	if available {
+		return time.Duration(hc.checkInterval) * time.Second
+	}
+
+	i := time.Duration(hc.unhealthyInterval) * time.Second
+	if hc.backoffMax == 0 {
+		return i
+	}
+
+	max := time.Duration(hc.backoffMax) * time.Second
+	for n := int(hc.failCount) - int(hc.failConfig); n > 0 && i < max; n-- {
+		i *= 2
+	}
+	if i > max {
+		i = max
+	}
+	if hc.jitter != 0 {
+		i += time.Duration((rand.Float64()*2 - 1) * float64(hc.jitter) / 100 * float64(i))
+		if i < time.Second {
+			i = time.Second
+		}
+	}
+
+	return i
+}
+
+// hcRun probes the upstream and updates its availability with the probe result
+// The health check host override is probed instead of the upstream address when set.
+// While the upstream host address isn't resolved, the probe is skipped and accounted as failed,
+// so the upstream doesn't become available without an address to load balance to
+// It returns true if the upstream availability changed and the interval until the next health check
+func (u *upstream) hcRun() (bool, time.Duration) {
+	if u.address == nil {
+		LogDVf("LB HC (%s): Host '%s' with unresolved address. Health check paused while host address is not available", u.name, u.host)
+		return u.hcUpdate("", errHcUnresolved)
+	}
+
+	hcHost := u.address.String()
+	if u.healthCheck.host != "" {
+		// Health check target override
+		hcHost = u.healthCheck.host
+	}
+	addr := net.JoinHostPort(hcHost, strconv.Itoa(int(u.healthCheck.port)))
+
+	LogDVf(
+		"LB HC (%s): healthchecking upstream host: '%s'; Port: '%d'; Protocol: '%s'; Timeout: '%d' seconds",
+		u.name,
+		hcHost,
+		u.healthCheck.port,
+		u.healthCheck.protocol.String(),
+		u.healthCheck.timeout,
+	)
+
+	return u.hcUpdate(addr, u.healthCheck.probe(addr))
+}
+
+// hcUpdate updates the upstream health check counters and availability with a probe result
+// The upstream becomes unhealthy after failConfig consecutive failed probes
+// and healthy after countConfig consecutive successful probes
+// A healthy upstream is available unless it's ejected by the outlier detection or its flaps are dampened
+// It returns true if the upstream availability changed and the interval until the next health check
+func (u *upstream) hcUpdate(addr string, err error) (bool, time.Duration) {
+	hc := &u.healthCheck
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	now := time.Now()
+	hc.probes++
+	hc.lastProbe = now
+	hc.lastErr = err
+
+	wasHealthy := hc.healthy
+	wasAvailable := u.available
+	if err != nil {
+		hc.failures++
+		// Reset health_check count to 0
+		hc.count = 0
+		if hc.failCount < math.MaxUint8 {
+			hc.failCount++
+		}
+		if hc.healthy && hc.failCount >= hc.failConfig {
+			hc.healthy = false
+		}
+	} else {
+		hc.failCount = 0
+		if !hc.healthy {
+			// Increment health_check count
+			hc.count++
+			if hc.count >= hc.countConfig {
+				hc.healthy = true
+			}
+		}
+	}
+	hc.interval = hc.nextInterval(hc.healthy)
+	u.refreshAvailability(now)
+
+	switch {
+	case err != nil && !wasHealthy:
+		LogIf(
+			"LB HC (%s): healthcheck for upstream failed. Retrying in %v. Error: %v",
+			u.name,
+			hc.interval,
+			err,
+		)
+	case err != nil:
+		LogIf(
+			"LB HC (%s): healthcheck for available upstream failed. %d/%d failures. Retrying in %v. Error: %v",
+			u.name,
+			hc.failCount,
+			hc.failConfig,
+			hc.interval,
+			err,
+		)
+		if !hc.healthy {
+			LogIf(
+				"LB HC (%s): upstream became unavailable due to health_check failure",
+				u.name,
+			)
+		}
+	case wasHealthy:
+		LogDVf("LB HC (%s): upstream continues available at %s", u.name, addr)
+	default:
+		LogIf("LB HC (%s): upstream is unavailable at '%s', but health_check succeeded. %d/%d tests succeeded", u.name, addr, hc.count, hc.countConfig)
+		if hc.healthy {
+			LogIf("LB HC (%s): upstream became available at '%s'", u.name, addr)
+		}
+	}
+	if hc.healthy && !u.available {
+		LogDf("LB HC (%s): health_check succeeded, but upstream is held unavailable: %s", u.name, u.holdReason(now))
+	}
+
+	return u.available != wasAvailable, hc.interval
+}
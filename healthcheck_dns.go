@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS health check errors
+var (
+	errHcDnsName = errors.New(
+		"dns health check requires a query 'name'",
+	)
+	errHcDnsType = errors.New(
+		"invalid dns health check query 'type'",
+	)
+	errHcDnsClass = errors.New(
+		"invalid dns health check query 'class'",
+	)
+	errHcDnsTransport = errors.New(
+		"invalid dns health check 'transport'. Chose one of 'udp', 'tcp'",
+	)
+	errHcDnsRcodeConf = errors.New(
+		"invalid dns health check 'rcode'",
+	)
+	errHcDnsAnswerConf = errors.New(
+		"invalid dns health check 'answer' regex",
+	)
+	errHcDnsRcode = errors.New(
+		"unexpected dns response code",
+	)
+	errHcDnsAnswer = errors.New(
+		"no dns answer matching the expected value",
+	)
+)
+
+// hcDns holds the dns health check settings
+type hcDns struct {
+	msg    *dns.Msg       // health check query
+	rcode  int            // expected response code
+	answer *regexp.Regexp // expected answer record value regex. Any answer, or none, is accepted if nil
+	client *dns.Client    // dns client
+}
+
+// getHcDns returns the dns health check settings
+// The query type defaults to A, the class to IN, the transport to udp and the expected response code to NOERROR
+func getHcDns(c *DnsHealthCheckConfig, timeout uint8, src hcSource) (*hcDns, error) {
+	if c == nil || c.Name == "" {
+		return nil, errHcDnsName
+	}
+	if _, ok := dns.IsDomainName(c.Name); !ok {
+		return nil, fmt.Errorf("%w: '%s' is not a valid domain name", errHcDnsName, c.Name)
+	}
+
+	qType := dns.TypeA
+	if c.Type != "" {
+		t, ok := dns.StringToType[strings.ToUpper(c.Type)]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s'", errHcDnsType, c.Type)
+		}
+		qType = t
+	}
+
+	qClass := uint16(dns.ClassINET)
+	if c.Class != "" {
+		cl, ok := dns.StringToClass[strings.ToUpper(c.Class)]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s'", errHcDnsClass, c.Class)
+		}
+		qClass = cl
+	}
+
+	transport := "udp"
+	switch c.Transport {
+	case "", "udp":
+	case "tcp":
+		transport = "tcp"
+	default:
+		return nil, fmt.Errorf("%w: '%s'", errHcDnsTransport, c.Transport)
+	}
+
+	h := &hcDns{
+		msg:   new(dns.Msg),
+		rcode: dns.RcodeSuccess,
+		client: &dns.Client{
+			Net:     transport,
+			Timeout: time.Duration(timeout) * time.Second,
+		},
+	}
+	if src.bound() {
+		h.client.Dialer = src.dialer(transport, h.client.Timeout)
+	}
+	h.msg.SetQuestion(dns.Fqdn(c.Name), qType)
+	h.msg.Question[0].Qclass = qClass
+
+	if c.Rcode != "" {
+		r, ok := dns.StringToRcode[strings.ToUpper(c.Rcode)]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s'", errHcDnsRcodeConf, c.Rcode)
+		}
+		h.rcode = r
+	}
+
+	if c.Answer != "" {
+		re, err := regexp.Compile(c.Answer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errHcDnsAnswerConf, err)
+		}
+		h.answer = re
+	}
+
+	return h, nil
+}
+
+// rrValue returns the value of a resource record in presentation format, without the record header
+func rrValue(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// probe sends the health check query to addr and checks the response code and answer records
+func (h *hcDns) probe(addr string) error {
+	// A copy of the query is sent, as the message id is set on each exchange
+	m := h.msg.Copy()
+	m.Id = dns.Id()
+
+	in, _, err := h.client.Exchange(m, addr)
+	if err != nil {
+		return err
+	}
+
+	if in.Rcode != h.rcode {
+		return fmt.Errorf("%w: '%s'", errHcDnsRcode, dns.RcodeToString[in.Rcode])
+	}
+
+	if h.answer == nil {
+		return nil
+	}
+	for _, rr := range in.Answer {
+		if h.answer.MatchString(rrValue(rr)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: '%s'", errHcDnsAnswer, h.answer.String())
+}
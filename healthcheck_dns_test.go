@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serveDns starts a dns server on a local address for the network, answering 'ok.test.' A queries with 192.0.2.1
+// and refusing everything else
+func serveDns(t *testing.T, network string) string {
+	t.Helper()
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "ok.test." && q.Qtype == dns.TypeA && q.Qclass == dns.ClassINET:
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+		case q.Name == "ok.test.":
+		default:
+			m.SetRcode(r, dns.RcodeRefused)
+		}
+		w.WriteMsg(m)
+	})
+
+	s := &dns.Server{Net: network, Handler: h}
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		s.PacketConn = pc
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		s.Listener = l
+	}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+
+	if s.PacketConn != nil {
+		return s.PacketConn.LocalAddr().String()
+	}
+	return s.Listener.Addr().String()
+}
+
+func TestGetHcDns(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config *DnsHealthCheckConfig
+		err    error
+	}{
+		{name: "defaults", config: &DnsHealthCheckConfig{Name: "example.com"}, err: nil},
+		{name: "all settings", config: &DnsHealthCheckConfig{Name: "example.com.", Type: "aaaa", Class: "IN", Transport: "tcp", Rcode: "NXDOMAIN", Answer: "^2001:db8::"}, err: nil},
+		{name: "no settings", config: nil, err: errHcDnsName},
+		{name: "no name", config: &DnsHealthCheckConfig{Type: "A"}, err: errHcDnsName},
+		{name: "invalid name", config: &DnsHealthCheckConfig{Name: "example..com"}, err: errHcDnsName},
+		{name: "invalid type", config: &DnsHealthCheckConfig{Name: "example.com", Type: "AAA"}, err: errHcDnsType},
+		{name: "invalid class", config: &DnsHealthCheckConfig{Name: "example.com", Class: "INET"}, err: errHcDnsClass},
+		{name: "invalid transport", config: &DnsHealthCheckConfig{Name: "example.com", Transport: "tls"}, err: errHcDnsTransport},
+		{name: "invalid rcode", config: &DnsHealthCheckConfig{Name: "example.com", Rcode: "OK"}, err: errHcDnsRcodeConf},
+		{name: "invalid answer", config: &DnsHealthCheckConfig{Name: "example.com", Answer: "("}, err: errHcDnsAnswerConf},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcDns(tc.config, 1, hcSource{}); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcDnsProbe(t *testing.T) {
+	addrs := map[string]string{
+		"udp": serveDns(t, "udp"),
+		"tcp": serveDns(t, "tcp"),
+	}
+
+	testCases := []struct {
+		name   string
+		config DnsHealthCheckConfig
+		err    error
+	}{
+		{name: "noerror", config: DnsHealthCheckConfig{Name: "ok.test"}, err: nil},
+		{name: "answer", config: DnsHealthCheckConfig{Name: "ok.test", Answer: `^192\.0\.2\.1$`}, err: nil},
+		{name: "no matching answer", config: DnsHealthCheckConfig{Name: "ok.test", Answer: `^192\.0\.2\.2$`}, err: errHcDnsAnswer},
+		{name: "no answer", config: DnsHealthCheckConfig{Name: "ok.test", Type: "AAAA", Answer: "."}, err: errHcDnsAnswer},
+		{name: "refused", config: DnsHealthCheckConfig{Name: "example.com"}, err: errHcDnsRcode},
+		{name: "expected rcode", config: DnsHealthCheckConfig{Name: "example.com", Rcode: "REFUSED"}, err: nil},
+		{name: "class", config: DnsHealthCheckConfig{Name: "ok.test", Class: "CH", Answer: "."}, err: errHcDnsAnswer},
+	}
+	for _, transport := range []string{"udp", "tcp"} {
+		for _, tc := range testCases {
+			t.Run(transport+" "+tc.name, func(t *testing.T) {
+				c := tc.config
+				c.Transport = transport
+				h, err := getHcDns(&c, 1, hcSource{})
+				if err != nil {
+					t.Fatalf("expected no error, but got '%v'", err)
+				}
+				if err := h.probe(addrs[transport]); !errors.Is(err, tc.err) {
+					t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// External command health check settings
+const (
+	hcExecMaxOutput = 1024                     // max command output bytes reported on failure
+	hcExecWaitDelay = 1 * time.Second          // time to wait for the command output to be closed after it's killed
+	hcExecEnvHost   = "LOBBY_UPSTREAM_HOST"    // environment variable with the upstream host, as configured
+	hcExecEnvAddr   = "LOBBY_UPSTREAM_ADDRESS" // environment variable with the upstream IP address
+	hcExecEnvPort   = "LOBBY_UPSTREAM_PORT"    // environment variable with the health check port
+)
+
+// External command health check errors
+var (
+	errHcExecCommand = errors.New(
+		"exec health check requires a 'command'",
+	)
+	errHcExecTimeout = errors.New(
+		"command timed out",
+	)
+)
+
+// hcExec holds the external command health check settings
+type hcExec struct {
+	command []string      // command path and arguments
+	host    string        // upstream host, as configured
+	timeout time.Duration // time after which the command is killed
+}
+
+// A limitedBuffer is a bytes.Buffer discarding the writes beyond its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+// Write writes p to the buffer up to its limit. It never fails, so that the command isn't interrupted
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if r := b.limit - b.Len(); r > 0 {
+		if len(p) > r {
+			b.Buffer.Write(p[:r])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+// getHcExec returns the external command health check settings
+// The command is looked up in the PATH if it doesn't contain a slash
+func getHcExec(c *ExecHealthCheckConfig, upstreamHost string, timeout uint8) (*hcExec, error) {
+	if c == nil || len(c.Command) == 0 || c.Command[0] == "" {
+		return nil, errHcExecCommand
+	}
+	path, err := exec.LookPath(c.Command[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errHcExecCommand, err)
+	}
+
+	return &hcExec{
+		command: append([]string{path}, c.Command[1:]...),
+		host:    upstreamHost,
+		timeout: time.Duration(timeout) * time.Second,
+	}, nil
+}
+
+// probe runs the command with the upstream address and port of addr in the environment
+// The command succeeds if it exits with status 0 within the timeout. Otherwise, it's killed
+func (h *hcExec) probe(addr string) error {
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = append(
+		os.Environ(),
+		hcExecEnvHost+"="+h.host,
+		hcExecEnvAddr+"="+ip,
+		hcExecEnvPort+"="+port,
+	)
+	// The command runs in its own process group, so that its child processes are killed on timeout as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hcExecWaitDelay
+	out := &limitedBuffer{limit: hcExecMaxOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w after %v", errHcExecTimeout, h.timeout)
+	}
+	if err != nil {
+		if o := strings.TrimSpace(out.String()); o != "" {
+			return fmt.Errorf("%w: %s", err, o)
+		}
+		return err
+	}
+
+	return nil
+}
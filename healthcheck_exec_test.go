@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetHcExec(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config *ExecHealthCheckConfig
+		err    error
+	}{
+		{name: "path lookup", config: &ExecHealthCheckConfig{Command: []string{"sh", "-c", "exit 0"}}, err: nil},
+		{name: "no settings", config: nil, err: errHcExecCommand},
+		{name: "no command", config: &ExecHealthCheckConfig{}, err: errHcExecCommand},
+		{name: "command not found", config: &ExecHealthCheckConfig{Command: []string{"/nonexistent/check"}}, err: errHcExecCommand},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcExec(tc.config, "example.com", 1); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcExecProbe(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	testCases := []struct {
+		name   string
+		script string
+		err    error
+		output string
+	}{
+		{name: "success", script: "exit 0", err: nil},
+		{name: "environment", script: `[ "$LOBBY_UPSTREAM_HOST" = example.com ] && [ "$LOBBY_UPSTREAM_ADDRESS" = 2001:db8::1 ] && [ "$LOBBY_UPSTREAM_PORT" = 5432 ]`, err: nil},
+		{name: "failure", script: "echo replication lag 30s >&2; exit 2", output: "exit status 2: replication lag 30s"},
+		{name: "timeout", script: "sleep 5", err: errHcExecTimeout},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcExec(&ExecHealthCheckConfig{Command: []string{"sh", "-c", tc.script}}, "example.com", 1)
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			start := time.Now()
+			err = h.probe("[2001:db8::1]:5432")
+			if tc.output != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.output) {
+					t.Errorf("expected error containing '%s', but got '%v'", tc.output, err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if d := time.Since(start); d > h.timeout+hcExecWaitDelay {
+				t.Errorf("expected the probe to end within the timeout, but it took %v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// gRPC health checking protocol settings
+// See https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+const (
+	hcGrpcPath       = "/grpc.health.v1.Health/Check" // health check method path
+	hcGrpcMaxMsg     = 4096                           // max response bytes read by grpc health checks
+	hcGrpcMsgHdrLen  = 5                              // gRPC message prefix. Compressed flag and message length
+	hcGrpcServing    = 1                              // HealthCheckResponse SERVING status
+	hcGrpcStatusOk   = "0"                            // gRPC OK status code
+	hcGrpcStatusTag  = 0x08                           // HealthCheckResponse status field. Field 1, varint
+	hcGrpcServiceTag = 0x0A                           // HealthCheckRequest service field. Field 1, length delimited
+)
+
+// gRPC health check errors
+var (
+	errHcGrpcStatus = errors.New(
+		"gRPC call failed",
+	)
+	errHcGrpcMsg = errors.New(
+		"malformed gRPC health check response",
+	)
+	errHcGrpcNotServing = errors.New(
+		"gRPC service not serving",
+	)
+)
+
+// hcGrpc holds the grpc health check settings
+type hcGrpc struct {
+	service   string           // checked service name. The server overall health if empty
+	scheme    string           // 'http' for plaintext or 'https' for TLS
+	transport *http2.Transport // HTTP/2 transport. Connections aren't reused between probes
+	client    *http.Client     // health check client
+}
+
+// hcGrpcStatusName returns the name of a HealthCheckResponse status
+func hcGrpcStatusName(s uint64) string {
+	switch s {
+	case 0:
+		return "UNKNOWN"
+	case 1:
+		return "SERVING"
+	case 2:
+		return "NOT_SERVING"
+	case 3:
+		return "SERVICE_UNKNOWN"
+	}
+
+	return fmt.Sprintf("%d", s)
+}
+
+// getHcGrpc returns the grpc health check settings for an upstream host
+// The connection is plaintext (h2c), unless tls settings are set
+func getHcGrpc(c *GrpcHealthCheckConfig, upstreamHost string, timeout uint8, src hcSource) (*hcGrpc, error) {
+	if c == nil {
+		c = &GrpcHealthCheckConfig{}
+	}
+
+	g := &hcGrpc{
+		service:   c.Service,
+		scheme:    "http",
+		transport: &http2.Transport{},
+	}
+
+	if c.Tls != nil {
+		tc, err := getHcTlsConfig(c.Tls, hcServerName("", upstreamHost))
+		if err != nil {
+			return nil, err
+		}
+		g.scheme = "https"
+		g.transport.TLSClientConfig = tc
+		if src.bound() {
+			g.transport.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				d := tls.Dialer{NetDialer: src.dialer(network, 0), Config: cfg}
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+	} else {
+		g.transport.AllowHTTP = true
+		g.transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return src.dialer(network, 0).DialContext(ctx, network, addr)
+		}
+	}
+
+	g.client = &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: g.transport,
+	}
+
+	return g, nil
+}
+
+// grpcHealthRequest returns the length prefixed HealthCheckRequest message for a service
+func grpcHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, hcGrpcServiceTag)
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+
+	b := make([]byte, hcGrpcMsgHdrLen, hcGrpcMsgHdrLen+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+
+	return append(b, msg...)
+}
+
+// parseGrpcHealthResponse returns the status of a length prefixed HealthCheckResponse message
+// Unknown fields are skipped
+func parseGrpcHealthResponse(b []byte) (uint64, error) {
+	if len(b) < hcGrpcMsgHdrLen || b[0] != 0 {
+		return 0, errHcGrpcMsg
+	}
+	l := binary.BigEndian.Uint32(b[1:hcGrpcMsgHdrLen])
+	if uint64(len(b)-hcGrpcMsgHdrLen) < uint64(l) {
+		return 0, errHcGrpcMsg
+	}
+	msg := b[hcGrpcMsgHdrLen : hcGrpcMsgHdrLen+int(l)]
+
+	var status uint64
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errHcGrpcMsg
+		}
+		msg = msg[n:]
+
+		var skip uint64
+		switch key & 0x7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errHcGrpcMsg
+			}
+			if key == hcGrpcStatusTag {
+				status = v
+			}
+			skip = uint64(n)
+		case 1: // 64-bit
+			skip = 8
+		case 2: // length delimited
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errHcGrpcMsg
+			}
+			skip = uint64(n) + v
+		case 5: // 32-bit
+			skip = 4
+		default:
+			return 0, errHcGrpcMsg
+		}
+		if skip > uint64(len(msg)) {
+			return 0, errHcGrpcMsg
+		}
+		msg = msg[skip:]
+	}
+
+	return status, nil
+}
+
+// probe calls the grpc.health.v1.Health/Check method at addr
+// Only the SERVING status is considered healthy
+func (g *hcGrpc) probe(addr string) error {
+	defer g.transport.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodPost, g.scheme+"://"+addr+hcGrpcPath, bytes.NewReader(grpcHealthRequest(g.service)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %d", errHcStatus, res.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, hcGrpcMaxMsg))
+	if err != nil {
+		return err
+	}
+
+	// The gRPC status is sent in the trailers, or in the headers for errors without a message
+	gs := res.Trailer.Get("Grpc-Status")
+	if gs == "" {
+		gs = res.Header.Get("Grpc-Status")
+	}
+	if gs != hcGrpcStatusOk {
+		return fmt.Errorf("%w: status '%s': %s", errHcGrpcStatus, gs, res.Trailer.Get("Grpc-Message")+res.Header.Get("Grpc-Message"))
+	}
+
+	s, err := parseGrpcHealthResponse(b)
+	if err != nil {
+		return err
+	}
+	if s != hcGrpcServing {
+		return fmt.Errorf("%w: %s", errHcGrpcNotServing, hcGrpcStatusName(s))
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGrpcHealthRequest(t *testing.T) {
+	testCases := []struct {
+		service string
+		result  []byte
+	}{
+		{service: "", result: []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{service: "db", result: []byte{0x00, 0x00, 0x00, 0x00, 0x04, 0x0A, 0x02, 'd', 'b'}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.service, func(t *testing.T) {
+			if result := grpcHealthRequest(tc.service); !bytes.Equal(result, tc.result) {
+				t.Errorf("expected '%v', but got '%v'", tc.result, result)
+			}
+		})
+	}
+}
+
+func TestParseGrpcHealthResponse(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  []byte
+		err    error
+		result uint64
+	}{
+		{name: "serving", input: []byte{0x00, 0x00, 0x00, 0x00, 0x02, 0x08, 0x01}, err: nil, result: 1},
+		{name: "not serving", input: []byte{0x00, 0x00, 0x00, 0x00, 0x02, 0x08, 0x02}, err: nil, result: 2},
+		{name: "default status", input: []byte{0x00, 0x00, 0x00, 0x00, 0x00}, err: nil, result: 0},
+		{name: "truncated field", input: []byte{0x00, 0x00, 0x00, 0x00, 0x0A, 0x12, 0x02, 'o', 'k', 0x08, 0x01, 0x1D, 0x00, 0x00, 0x00}, err: errHcGrpcMsg, result: 0},
+		{name: "unknown fields skipped", input: []byte{0x00, 0x00, 0x00, 0x00, 0x0B, 0x12, 0x02, 'o', 'k', 0x08, 0x01, 0x1D, 0x00, 0x00, 0x00, 0x00}, err: nil, result: 1},
+		{name: "compressed", input: []byte{0x01, 0x00, 0x00, 0x00, 0x02, 0x08, 0x01}, err: errHcGrpcMsg, result: 0},
+		{name: "truncated", input: []byte{0x00, 0x00, 0x00, 0x00, 0x03, 0x08, 0x01}, err: errHcGrpcMsg, result: 0},
+		{name: "short", input: []byte{0x00, 0x00}, err: errHcGrpcMsg, result: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parseGrpcHealthResponse(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if result != tc.result {
+				t.Errorf("expected '%d', but got '%d'", tc.result, result)
+			}
+		})
+	}
+}
+
+// grpcHealthHandler is a minimal grpc.health.v1.Health/Check server
+// The server overall status is SERVING and the 'db' service status is NOT_SERVING. Other services are not found
+func grpcHealthHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.URL.Path != hcGrpcPath || r.Header.Get("Content-Type") != "application/grpc" || len(b) < hcGrpcMsgHdrLen {
+			t.Errorf("unexpected gRPC health check request '%s' '%v'", r.URL.Path, b)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		var status byte
+		switch string(b[hcGrpcMsgHdrLen:]) {
+		case "":
+			status = 1
+		case "\x0A\x02db":
+			status = 2
+		default:
+			// trailers-only NOT_FOUND response
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown service")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x02, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	})
+}
+
+func TestHcGrpcProbe(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(grpcHealthHandler(t), &http2.Server{}))
+	defer srv.Close()
+	tlsSrv := httptest.NewUnstartedServer(grpcHealthHandler(t))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	testCases := []struct {
+		name   string
+		config *GrpcHealthCheckConfig
+		addr   string
+		err    error
+	}{
+		{name: "serving", config: nil, addr: srv.Listener.Addr().String(), err: nil},
+		{name: "not serving", config: &GrpcHealthCheckConfig{Service: "db"}, addr: srv.Listener.Addr().String(), err: errHcGrpcNotServing},
+		{name: "unknown service", config: &GrpcHealthCheckConfig{Service: "cache"}, addr: srv.Listener.Addr().String(), err: errHcGrpcStatus},
+		{name: "TLS serving", config: &GrpcHealthCheckConfig{Tls: &HealthCheckTlsConfig{InsecureSkipVerify: true}}, addr: tlsSrv.Listener.Addr().String(), err: nil},
+		{name: "TLS not serving", config: &GrpcHealthCheckConfig{Service: "db", Tls: &HealthCheckTlsConfig{InsecureSkipVerify: true}}, addr: tlsSrv.Listener.Addr().String(), err: errHcGrpcNotServing},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := getHcGrpc(tc.config, "127.0.0.1", 2, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := g.probe(tc.addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	// TLS verification failure
+	g, _ := getHcGrpc(&GrpcHealthCheckConfig{Tls: &HealthCheckTlsConfig{}}, "127.0.0.1", 2, hcSource{})
+	if err := g.probe(tlsSrv.Listener.Addr().String()); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected a certificate verification error, but got '%v'", err)
+	}
+}
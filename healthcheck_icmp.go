@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMP health check settings
+const (
+	hcIcmpCount    = 3                      // default amount of echo requests per probe
+	hcIcmpMaxLoss  = 0                      // default max lost echo replies percentage
+	hcIcmpInterval = 100 * time.Millisecond // interval between the echo requests of a probe
+	hcIcmpMaxMsg   = 1500                   // max ICMP message size read
+	hcIcmpProto    = 1                      // ICMP IP protocol number
+	hcIcmpv6Proto  = 58                     // ICMPv6 IP protocol number
+)
+
+// hcIcmpIds generates the echo identifiers of the icmp health check probes
+var hcIcmpIds atomic.Uint32
+
+// ICMP health check errors
+var (
+	errHcIcmpCount = errors.New(
+		"icmp health check 'count' echo requests must be sent within the probe timeout. Each echo request is sent 100ms after the previous one",
+	)
+	errHcIcmpMaxLoss = errors.New(
+		"icmp health check 'max_loss' must be a percentage between 0 and 100",
+	)
+	errHcIcmpAddr = errors.New(
+		"invalid icmp health check address",
+	)
+	errHcIcmpLoss = errors.New(
+		"echo replies lost",
+	)
+	errHcIcmpRtt = errors.New(
+		"echo replies average round trip time above threshold",
+	)
+)
+
+// hcIcmp holds the icmp health check settings
+type hcIcmp struct {
+	count   int           // amount of echo requests per probe
+	maxLoss int           // max lost echo replies percentage
+	maxRtt  time.Duration // max echo replies average round trip time. No threshold if 0
+	timeout time.Duration // time to wait for the echo replies
+	src     hcSource      // probe source
+}
+
+// getHcIcmp returns the icmp health check settings
+func getHcIcmp(c *IcmpHealthCheckConfig, timeout uint8, src hcSource) (*hcIcmp, error) {
+	h := &hcIcmp{
+		count:   hcIcmpCount,
+		maxLoss: hcIcmpMaxLoss,
+		timeout: time.Duration(timeout) * time.Second,
+		src:     src,
+	}
+
+	if c != nil {
+		if c.Count != 0 {
+			h.count = int(c.Count)
+		}
+		if c.MaxLoss != nil {
+			if *c.MaxLoss > 100 {
+				return nil, fmt.Errorf("%w: %d", errHcIcmpMaxLoss, *c.MaxLoss)
+			}
+			h.maxLoss = int(*c.MaxLoss)
+		}
+		h.maxRtt = time.Duration(c.MaxRtt) * time.Millisecond
+	}
+
+	if time.Duration(h.count-1)*hcIcmpInterval >= h.timeout {
+		return nil, fmt.Errorf("%w: %d echo requests", errHcIcmpCount, h.count)
+	}
+
+	return h, nil
+}
+
+// icmpListen opens an ICMP or ICMPv6 socket bound to src
+// A raw socket is used if CAP_NET_RAW is granted. Otherwise, an unprivileged datagram socket,
+// which requires the process group to be in the net.ipv4.ping_group_range sysctl.
+// Binding to an interface requires a raw socket
+func icmpListen(v6 bool, src hcSource) (net.PacketConn, bool, error) {
+	network, address, dgram := "ip4:icmp", "0.0.0.0", "udp4"
+	if v6 {
+		network, address, dgram = "ip6:ipv6-icmp", "::", "udp6"
+	}
+	if src.ip != nil {
+		address = src.ip.String()
+	}
+
+	if src.iface != "" {
+		lc := net.ListenConfig{Control: src.control}
+		c, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			return nil, false, err
+		}
+		return c, true, nil
+	}
+
+	c, err := icmp.ListenPacket(network, address)
+	if err == nil {
+		return c, true, nil
+	}
+	c, dErr := icmp.ListenPacket(dgram, address)
+	if dErr != nil {
+		return nil, false, fmt.Errorf("%w: %w", err, dErr)
+	}
+
+	return c, false, nil
+}
+
+// probe sends count echo requests to the addr host and checks the lost echo replies and their average round trip time
+// The addr port is ignored. ICMPv6 is used for IPv6 hosts
+func (h *hcIcmp) probe(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errHcIcmpAddr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Health check host override
+		a, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errHcIcmpAddr, err)
+		}
+		ip = a.IP
+	}
+	v6 := ip.To4() == nil
+
+	c, privileged, err := icmpListen(v6, h.src)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(h.timeout))
+
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := hcIcmpProto
+	if v6 {
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = hcIcmpv6Proto
+	}
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if !privileged {
+		dst = &net.UDPAddr{IP: ip}
+	}
+	// The kernel sets the identifier of unprivileged sockets and only delivers their own echo replies
+	id := (os.Getpid() + int(hcIcmpIds.Add(1))) & 0xffff
+
+	// Send the echo requests with the send time as data
+	sendErr := make(chan error, 1)
+	go func() {
+		for seq := 0; seq < h.count; seq++ {
+			if seq != 0 {
+				time.Sleep(hcIcmpInterval)
+			}
+			m := icmp.Message{
+				Type: echoType,
+				Body: &icmp.Echo{
+					ID:   id,
+					Seq:  seq,
+					Data: binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())),
+				},
+			}
+			b, err := m.Marshal(nil)
+			if err == nil {
+				_, err = c.WriteTo(b, dst)
+			}
+			if err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+
+	// Read the echo replies until all are received or the timeout
+	replies := make(map[int]bool, h.count)
+	var rtt time.Duration
+	b := make([]byte, hcIcmpMaxMsg)
+	for len(replies) < h.count {
+		n, peer, err := c.ReadFrom(b)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return err
+		}
+		now := time.Now()
+
+		var peerIp net.IP
+		switch a := peer.(type) {
+		case *net.IPAddr:
+			peerIp = a.IP
+		case *net.UDPAddr:
+			peerIp = a.IP
+		}
+		if !peerIp.Equal(ip) {
+			continue
+		}
+		m, err := icmp.ParseMessage(proto, b[:n])
+		if err != nil || m.Type != replyType {
+			continue
+		}
+		echo, ok := m.Body.(*icmp.Echo)
+		if !ok || (privileged && echo.ID != id) || echo.Seq < 0 || echo.Seq >= h.count || replies[echo.Seq] || len(echo.Data) < 8 {
+			continue
+		}
+		replies[echo.Seq] = true
+		rtt += now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(echo.Data))))
+	}
+
+	// Closing the socket stops the echo requests still being sent
+	c.Close()
+	if err := <-sendErr; err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	lost := h.count - len(replies)
+	if lost*100 > h.maxLoss*h.count {
+		return fmt.Errorf("%w: %d/%d", errHcIcmpLoss, lost, h.count)
+	}
+	if len(replies) != 0 && h.maxRtt != 0 {
+		if avg := rtt / time.Duration(len(replies)); avg > h.maxRtt {
+			return fmt.Errorf("%w: %v", errHcIcmpRtt, avg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetHcIcmp(t *testing.T) {
+	loss := func(l uint8) *uint8 { return &l }
+
+	testCases := []struct {
+		name    string
+		config  *IcmpHealthCheckConfig
+		timeout uint8
+		err     error
+	}{
+		{name: "default", config: nil, timeout: 1, err: nil},
+		{name: "thresholds", config: &IcmpHealthCheckConfig{Count: 5, MaxLoss: loss(40), MaxRtt: 100}, timeout: 1, err: nil},
+		{name: "no loss tolerated", config: &IcmpHealthCheckConfig{MaxLoss: loss(0)}, timeout: 1, err: nil},
+		{name: "invalid max loss", config: &IcmpHealthCheckConfig{MaxLoss: loss(101)}, timeout: 1, err: errHcIcmpMaxLoss},
+		{name: "count above timeout", config: &IcmpHealthCheckConfig{Count: 11}, timeout: 1, err: errHcIcmpCount},
+		{name: "count within timeout", config: &IcmpHealthCheckConfig{Count: 11}, timeout: 2, err: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcIcmp(tc.config, tc.timeout, hcSource{}); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcIcmpProbe(t *testing.T) {
+	if c, _, err := icmpListen(false, hcSource{}); err != nil {
+		t.Skipf("ICMP sockets not permitted: %v", err)
+	} else {
+		c.Close()
+	}
+
+	loss := func(l uint8) *uint8 { return &l }
+
+	testCases := []struct {
+		name   string
+		addr   string
+		config *IcmpHealthCheckConfig
+		err    error
+	}{
+		{name: "loopback", addr: "127.0.0.1:0", config: nil, err: nil},
+		{name: "rtt threshold", addr: "127.0.0.1:0", config: &IcmpHealthCheckConfig{Count: 2, MaxRtt: 500}, err: nil},
+		// TEST-NET-2 documentation address. No echo replies are expected
+		{name: "no replies", addr: "198.51.100.1:0", config: &IcmpHealthCheckConfig{Count: 2}, err: errHcIcmpLoss},
+		{name: "no replies tolerated", addr: "198.51.100.1:0", config: &IcmpHealthCheckConfig{Count: 2, MaxLoss: loss(100)}, err: nil},
+		{name: "host name", addr: "localhost:0", config: nil, err: nil},
+		{name: "invalid address", addr: "host.invalid:0", config: nil, err: errHcIcmpAddr},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcIcmp(tc.config, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(tc.addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	// ICMPv6
+	if c, _, err := icmpListen(true, hcSource{}); err == nil {
+		c.Close()
+		h, _ := getHcIcmp(nil, 1, hcSource{})
+		if err := h.probe("[::1]:0"); err != nil {
+			t.Errorf("expected no error, but got '%v'", err)
+		}
+	}
+}
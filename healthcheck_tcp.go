@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol aware TCP health check settings
+const (
+	hcTcpMaxMsg          = 64 * 1024                    // max response bytes read by protocol aware tcp health checks
+	hcBannerCode         = "220"                        // SMTP and FTP service ready reply code
+	hcDbRolePrimary      = "primary"                    // database primary role, accepting writes
+	hcDbRoleReplica      = "replica"                    // database read-only replica role
+	hcMysqlProtoVersion  = 10                           // MySQL initial handshake packet protocol version
+	hcMysqlOkPacket      = 0x00                         // MySQL OK packet header
+	hcMysqlMoreData      = 0x01                         // MySQL AuthMoreData packet header
+	hcMysqlEofPacket     = 0xfe                         // MySQL EOF and AuthSwitchRequest packet header
+	hcMysqlErrPacket     = 0xff                         // MySQL error packet header
+	hcMysqlComQuit       = 0x01                         // MySQL COM_QUIT command
+	hcMysqlComQuery      = 0x03                         // MySQL COM_QUERY command
+	hcMysqlCharset       = 45                           // MySQL utf8mb4_general_ci character set
+	hcMysqlClientCaps    = 0x8a201                      // MySQL LONG_PASSWORD, PROTOCOL_41, TRANSACTIONS, SECURE_CONNECTION and PLUGIN_AUTH capabilities
+	hcMysqlNativeAuth    = "mysql_native_password"      // MySQL SHA1 authentication plugin
+	hcMysqlSha2Auth      = "caching_sha2_password"      // MySQL SHA256 authentication plugin
+	hcMysqlRoleQuery     = "SELECT @@read_only"         // MySQL role query
+	hcPgSslRequestCode   = 80877103                     // PostgreSQL SSLRequest code
+	hcPgProtoVersion     = 196608                       // PostgreSQL protocol version 3.0
+	hcPgAuthOk           = 0                            // PostgreSQL AuthenticationOk
+	hcPgAuthCleartext    = 3                            // PostgreSQL AuthenticationCleartextPassword
+	hcPgAuthMd5          = 5                            // PostgreSQL AuthenticationMD5Password
+	hcPgAuthSasl         = 10                           // PostgreSQL AuthenticationSASL
+	hcPgAuthSaslContinue = 11                           // PostgreSQL AuthenticationSASLContinue
+	hcPgAuthSaslFinal    = 12                           // PostgreSQL AuthenticationSASLFinal
+	hcPgScramMech        = "SCRAM-SHA-256"              // PostgreSQL SASL mechanism
+	hcPgScramMaxIter     = 1 << 20                      // max SCRAM iterations, bounding the probe cpu usage
+	hcPgRoleQuery        = "SELECT pg_is_in_recovery()" // PostgreSQL role query
+	hcRedisRoleMaster    = "master"                     // redis INFO primary role
+	hcRedisRoleReplica   = "slave"                      // redis INFO replica role
+	hcRedisRoleInfoField = "role:"                      // redis INFO role field
+)
+
+// Protocol aware TCP health check errors
+var (
+	errHcTcpSteps = errors.New(
+		"tcp-send-expect health check requires a list of steps, each with a payload to send and/or a response to expect",
+	)
+	errHcRedisRoleConf = errors.New(
+		"invalid redis health check role. Chose one of 'master', 'replica'",
+	)
+	errHcDbRoleConf = errors.New(
+		"invalid database health check role. Chose one of 'primary', 'replica'",
+	)
+	errHcMysqlConf = errors.New(
+		"mysql health check 'password' and 'role' require a 'user'",
+	)
+	errHcPgConf = errors.New(
+		"postgres health check 'database', 'password' and 'role' require a 'user'",
+	)
+	errHcProtocol = errors.New(
+		"unexpected protocol response",
+	)
+	errHcRedis = errors.New(
+		"redis error reply",
+	)
+	errHcRedisRole = errors.New(
+		"unexpected redis role",
+	)
+	errHcAuth = errors.New(
+		"unsupported authentication method",
+	)
+	errHcDbRole = errors.New(
+		"unexpected database role",
+	)
+	errHcMysql = errors.New(
+		"mysql error",
+	)
+	errHcPg = errors.New(
+		"postgres error",
+	)
+	errHcBanner = errors.New(
+		"unexpected banner",
+	)
+)
+
+// hcTcp holds the protocol aware tcp health check settings
+type hcTcp struct {
+	protocol   hcProto       // health check protocol
+	timeout    time.Duration // probe timeout
+	steps      []hcStep      // tcp-send-expect steps
+	redisAuth  string        // redis AUTH password
+	redisRole  string        // expected redis INFO role. Any role if empty
+	mysqlUser  string        // mysql login user. Only the initial handshake is checked if empty
+	mysqlPass  string        // mysql login password
+	mysqlRole  string        // expected mysql role. Any role if empty
+	pgUser     string        // postgres startup user. An SSLRequest is sent instead of a startup message if empty
+	pgPass     string        // postgres password. The authentication is only completed if a password or a role is set
+	pgDatabase string        // postgres startup database
+	pgRole     string        // expected postgres role. Any role if empty
+	src        hcSource      // probe source
+}
+
+// getHcTcp returns the protocol aware tcp health check settings
+func getHcTcp(c *HealthCheckConfig, p hcProto, timeout uint8, src hcSource) (*hcTcp, error) {
+	h := &hcTcp{
+		protocol: p,
+		timeout:  time.Duration(timeout) * time.Second,
+		src:      src,
+	}
+
+	switch p {
+	case hcProtoTcpSendExpect:
+		if c.Tcp == nil || len(c.Tcp.Steps) == 0 {
+			return nil, errHcTcpSteps
+		}
+		for i := range c.Tcp.Steps {
+			s, err := getHcStep(&c.Tcp.Steps[i])
+			if err != nil {
+				return nil, err
+			}
+			if len(s.payload) == 0 && !s.expects() {
+				return nil, fmt.Errorf("%w: empty step %d", errHcTcpSteps, i+1)
+			}
+			h.steps = append(h.steps, s)
+		}
+	case hcProtoRedis:
+		if c.Redis != nil {
+			h.redisAuth = c.Redis.Password
+			switch c.Redis.Role {
+			case "":
+			case "master":
+				h.redisRole = hcRedisRoleMaster
+			case "replica":
+				h.redisRole = hcRedisRoleReplica
+			default:
+				return nil, fmt.Errorf("%w: '%s'", errHcRedisRoleConf, c.Redis.Role)
+			}
+		}
+	case hcProtoMysql:
+		if c.Mysql != nil {
+			if (c.Mysql.Password != "" || c.Mysql.Role != "") && c.Mysql.User == "" {
+				return nil, errHcMysqlConf
+			}
+			if err := checkHcDbRole(c.Mysql.Role); err != nil {
+				return nil, err
+			}
+			h.mysqlUser = c.Mysql.User
+			h.mysqlPass = c.Mysql.Password
+			h.mysqlRole = c.Mysql.Role
+		}
+	case hcProtoPostgres:
+		if c.Postgres != nil {
+			if (c.Postgres.Database != "" || c.Postgres.Password != "" || c.Postgres.Role != "") && c.Postgres.User == "" {
+				return nil, errHcPgConf
+			}
+			if err := checkHcDbRole(c.Postgres.Role); err != nil {
+				return nil, err
+			}
+			h.pgUser = c.Postgres.User
+			h.pgPass = c.Postgres.Password
+			h.pgDatabase = c.Postgres.Database
+			h.pgRole = c.Postgres.Role
+		}
+	}
+
+	return h, nil
+}
+
+// checkHcDbRole checks the expected database role
+func checkHcDbRole(role string) error {
+	switch role {
+	case "", hcDbRolePrimary, hcDbRoleReplica:
+		return nil
+	}
+
+	return fmt.Errorf("%w: '%s'", errHcDbRoleConf, role)
+}
+
+// probe connects to addr and runs the health check protocol exchange
+func (h *hcTcp) probe(addr string) error {
+	c, err := h.src.dialer("tcp", h.timeout).Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(h.timeout))
+
+	r := bufio.NewReader(c)
+	switch h.protocol {
+	case hcProtoRedis:
+		return h.probeRedis(c, r)
+	case hcProtoMysql:
+		return h.probeMysql(c, r)
+	case hcProtoPostgres:
+		return h.probePostgres(c, r)
+	case hcProtoSmtp, hcProtoFtp:
+		return probeBanner(c, r)
+	}
+
+	return h.probeSteps(c)
+}
+
+// probeSteps sends each step payload and waits for its expected response
+func (h *hcTcp) probeSteps(c net.Conn) error {
+	b := make([]byte, hcTcpMaxMsg)
+	for i, s := range h.steps {
+		if len(s.payload) != 0 {
+			if _, err := c.Write(s.payload); err != nil {
+				return err
+			}
+		}
+		if !s.expects() {
+			continue
+		}
+
+		// Read until the response matches
+		n := 0
+		for {
+			if n == len(b) {
+				return fmt.Errorf("%w: step %d", errHcNoMatch, i+1)
+			}
+			m, err := c.Read(b[n:])
+			n += m
+			if s.match(b[:n]) {
+				break
+			}
+			if err != nil {
+				var ne net.Error
+				if n != 0 && (errors.Is(err, io.EOF) || (errors.As(err, &ne) && ne.Timeout())) {
+					return fmt.Errorf("%w: step %d", errHcNoMatch, i+1)
+				}
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redisCmd sends a redis command and returns its reply
+// Simple string, integer and bulk string replies are supported
+func redisCmd(c net.Conn, r *bufio.Reader, args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errHcProtocol
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("%w: %s", errHcRedis, line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 || n > hcTcpMaxMsg {
+			return "", errHcProtocol
+		}
+		bulk := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return "", err
+		}
+		return string(bulk[:n]), nil
+	}
+
+	return "", errHcProtocol
+}
+
+// probeRedis authenticates if required, checks the PING reply and the replication role
+func (h *hcTcp) probeRedis(c net.Conn, r *bufio.Reader) error {
+	if h.redisAuth != "" {
+		if _, err := redisCmd(c, r, "AUTH", h.redisAuth); err != nil {
+			return err
+		}
+	}
+
+	pong, err := redisCmd(c, r, "PING")
+	if err != nil {
+		return err
+	}
+	if pong != "PONG" {
+		return fmt.Errorf("%w: '%s'", errHcProtocol, pong)
+	}
+
+	if h.redisRole != "" {
+		info, err := redisCmd(c, r, "INFO", "replication")
+		if err != nil {
+			return err
+		}
+		var role string
+		for _, l := range strings.Split(info, "\n") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(l), hcRedisRoleInfoField); ok {
+				role = v
+			}
+		}
+		if role != h.redisRole {
+			return fmt.Errorf("%w: '%s'", errHcRedisRole, role)
+		}
+	}
+
+	return nil
+}
+
+// mysqlRecv reads a mysql packet and returns its sequence id and payload
+// Error packets are returned as errors
+func mysqlRecv(r *bufio.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	l := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if l == 0 || l > hcTcpMaxMsg {
+		return 0, nil, errHcProtocol
+	}
+	p := make([]byte, l)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, nil, err
+	}
+	if p[0] != hcMysqlErrPacket {
+		return hdr[3], p, nil
+	}
+
+	// Error code, then the SQL state marker and SQL state, except in the initial handshake
+	if len(p) < 3 {
+		return 0, nil, errHcProtocol
+	}
+	msg := p[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		msg = msg[6:]
+	}
+	return 0, nil, fmt.Errorf("%w: %d: %s", errHcMysql, binary.LittleEndian.Uint16(p[1:3]), msg)
+}
+
+// mysqlSend writes a mysql packet
+func mysqlSend(c net.Conn, seq byte, p []byte) error {
+	_, err := c.Write(append([]byte{byte(len(p)), byte(len(p) >> 8), byte(len(p) >> 16), seq}, p...))
+	return err
+}
+
+// mysqlScramble returns the plugin authentication data of the password
+func mysqlScramble(plugin, password string, scramble []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+
+	var h1, h2 []byte
+	switch plugin {
+	case hcMysqlNativeAuth:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		s1 := sha1.Sum([]byte(password))
+		s2 := sha1.Sum(s1[:])
+		s3 := sha1.Sum(append(bytes.Clone(scramble), s2[:]...))
+		h1, h2 = s1[:], s3[:]
+	case hcMysqlSha2Auth:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		s1 := sha256.Sum256([]byte(password))
+		s2 := sha256.Sum256(s1[:])
+		s3 := sha256.Sum256(append(s2[:], scramble...))
+		h1, h2 = s1[:], s3[:]
+	default:
+		return nil, fmt.Errorf("%w: mysql '%s'", errHcAuth, plugin)
+	}
+
+	for i := range h1 {
+		h1[i] ^= h2[i]
+	}
+	return h1, nil
+}
+
+// mysqlHandshake parses the initial handshake packet and returns the scramble and authentication plugin
+func mysqlHandshake(p []byte) ([]byte, string, error) {
+	// Protocol version, null terminated server version, connection id, scramble first part, filler and capabilities
+	v := bytes.IndexByte(p, 0)
+	if v < 0 || len(p) < v+16 {
+		return nil, "", errHcProtocol
+	}
+	i := v + 5
+	scramble := bytes.Clone(p[i : i+8])
+	i += 9
+	caps := uint32(binary.LittleEndian.Uint16(p[i:]))
+	i += 2
+
+	// Character set, status, capabilities upper bytes, scramble length, reserved, scramble second part and plugin
+	if len(p) < i+16 {
+		return nil, "", fmt.Errorf("%w: mysql authentication plugins unsupported", errHcAuth)
+	}
+	caps |= uint32(binary.LittleEndian.Uint16(p[i+3:])) << 16
+	n := max(13, int(p[i+5])-8)
+	i += 16
+	if caps&hcMysqlClientCaps != hcMysqlClientCaps || len(p) < i+n {
+		return nil, "", fmt.Errorf("%w: mysql authentication plugins unsupported", errHcAuth)
+	}
+	scramble = append(scramble, bytes.TrimSuffix(p[i:i+n], []byte{0})...)
+	plugin, _, _ := bytes.Cut(p[i+n:], []byte{0})
+
+	return scramble, string(plugin), nil
+}
+
+// probeMysql checks the server initial handshake packet
+// Servers refusing connections, for instance due to too many connections, send an error packet instead
+// When a user is set, logs in and checks the role from the read_only system variable
+func (h *hcTcp) probeMysql(c net.Conn, r *bufio.Reader) error {
+	seq, p, err := mysqlRecv(r)
+	if err != nil {
+		return err
+	}
+	if p[0] != hcMysqlProtoVersion {
+		return fmt.Errorf("%w: mysql protocol version %d", errHcProtocol, p[0])
+	}
+	if h.mysqlUser == "" {
+		return nil
+	}
+
+	scramble, plugin, err := mysqlHandshake(p)
+	if err != nil {
+		return err
+	}
+	if err := h.mysqlAuth(c, r, seq, scramble, plugin); err != nil {
+		return err
+	}
+	defer mysqlSend(c, 0, []byte{hcMysqlComQuit})
+	if h.mysqlRole == "" {
+		return nil
+	}
+
+	// Column count, column definitions and rows, each followed by an EOF packet
+	if err := mysqlSend(c, 0, append([]byte{hcMysqlComQuery}, hcMysqlRoleQuery...)); err != nil {
+		return err
+	}
+	if _, p, err = mysqlRecv(r); err != nil {
+		return err
+	}
+	if p[0] != 1 {
+		return fmt.Errorf("%w: mysql column count %d", errHcProtocol, p[0])
+	}
+	var readOnly string
+	for eofs := 0; eofs < 2; {
+		if _, p, err = mysqlRecv(r); err != nil {
+			return err
+		}
+		switch {
+		case p[0] == hcMysqlEofPacket && len(p) < 9:
+			eofs++
+		case eofs == 1:
+			// Length encoded string
+			if int(p[0]) >= len(p) {
+				return fmt.Errorf("%w: mysql row", errHcProtocol)
+			}
+			readOnly = string(p[1 : 1+p[0]])
+		}
+	}
+
+	role := hcDbRolePrimary
+	switch readOnly {
+	case "0":
+	case "1":
+		role = hcDbRoleReplica
+	default:
+		return fmt.Errorf("%w: mysql read_only '%s'", errHcProtocol, readOnly)
+	}
+	if role != h.mysqlRole {
+		return fmt.Errorf("%w: '%s'", errHcDbRole, role)
+	}
+
+	return nil
+}
+
+// mysqlAuth sends the handshake response and completes the authentication
+// The caching_sha2_password full authentication encrypts the password with the server RSA public key
+func (h *hcTcp) mysqlAuth(c net.Conn, r *bufio.Reader, seq byte, scramble []byte, plugin string) error {
+	auth, err := mysqlScramble(plugin, h.mysqlPass, scramble)
+	if err != nil {
+		return err
+	}
+
+	// Capabilities, max packet size, character set, filler, user, authentication data and plugin
+	p := binary.LittleEndian.AppendUint32(nil, hcMysqlClientCaps)
+	p = binary.LittleEndian.AppendUint32(p, hcTcpMaxMsg)
+	p = append(p, hcMysqlCharset)
+	p = append(p, make([]byte, 23)...)
+	p = append(p, h.mysqlUser+"\x00"...)
+	p = append(p, byte(len(auth)))
+	p = append(p, auth...)
+	p = append(p, plugin+"\x00"...)
+	if err := mysqlSend(c, seq+1, p); err != nil {
+		return err
+	}
+
+	for {
+		if seq, p, err = mysqlRecv(r); err != nil {
+			return err
+		}
+
+		switch {
+		case p[0] == hcMysqlOkPacket:
+			return nil
+		case p[0] == hcMysqlEofPacket:
+			// AuthSwitchRequest with the plugin and its scramble
+			name, data, _ := bytes.Cut(p[1:], []byte{0})
+			plugin, scramble = string(name), bytes.TrimSuffix(data, []byte{0})
+			if auth, err = mysqlScramble(plugin, h.mysqlPass, scramble); err != nil {
+				return err
+			}
+		case p[0] == hcMysqlMoreData && plugin == hcMysqlSha2Auth && len(p) == 2 && p[1] == 3:
+			// Fast authentication success, followed by an OK packet
+			continue
+		case p[0] == hcMysqlMoreData && plugin == hcMysqlSha2Auth && len(p) == 2 && p[1] == 4:
+			// Full authentication. Request the public key
+			if err := mysqlSend(c, seq+1, []byte{2}); err != nil {
+				return err
+			}
+			if seq, p, err = mysqlRecv(r); err != nil {
+				return err
+			}
+			if p[0] != hcMysqlMoreData {
+				return fmt.Errorf("%w: mysql public key", errHcProtocol)
+			}
+			if auth, err = mysqlEncryptPass(p[1:], h.mysqlPass, scramble); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: mysql authentication packet %#x", errHcProtocol, p[0])
+		}
+
+		if err := mysqlSend(c, seq+1, auth); err != nil {
+			return err
+		}
+	}
+}
+
+// mysqlEncryptPass encrypts the null terminated password, XORed with the scramble, with the PEM public key
+func mysqlEncryptPass(key []byte, password string, scramble []byte) ([]byte, error) {
+	b, _ := pem.Decode(key)
+	if b == nil {
+		return nil, fmt.Errorf("%w: mysql public key", errHcProtocol)
+	}
+	pub, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(b.Bytes); err != nil {
+			return nil, fmt.Errorf("%w: mysql public key: %w", errHcProtocol, err)
+		}
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok || len(scramble) == 0 {
+		return nil, fmt.Errorf("%w: mysql public key", errHcProtocol)
+	}
+
+	msg := []byte(password + "\x00")
+	for i := range msg {
+		msg[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaPub, msg, nil)
+}
+
+// pgRecv reads a postgres message and returns its type and body
+// ErrorResponse messages are returned as errors
+func pgRecv(r *bufio.Reader) (byte, []byte, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	l := int(binary.BigEndian.Uint32(hdr))
+	if l < 4 || l > hcTcpMaxMsg {
+		return 0, nil, fmt.Errorf("%w: postgres message '%c'", errHcProtocol, t)
+	}
+	body := make([]byte, l-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	if t != 'E' {
+		return t, body, nil
+	}
+
+	// ErrorResponse fields. A field type byte followed by a null terminated string
+	for _, f := range strings.Split(string(body), "\x00") {
+		if strings.HasPrefix(f, "M") {
+			return 0, nil, fmt.Errorf("%w: %s", errHcPg, f[1:])
+		}
+	}
+	return 0, nil, errHcPg
+}
+
+// pgSend writes a postgres message
+func pgSend(c net.Conn, t byte, body []byte) error {
+	msg := binary.BigEndian.AppendUint32([]byte{t}, uint32(4+len(body)))
+	_, err := c.Write(append(msg, body...))
+	return err
+}
+
+// probePostgres sends an SSLRequest, or a startup message if a user is set
+// A startup message is answered with an authentication request once the server accepts connections,
+// and with an error while it's starting up, shutting down or in recovery without hot standby
+// When a password or a role is set, completes the authentication and checks the role from pg_is_in_recovery()
+func (h *hcTcp) probePostgres(c net.Conn, r *bufio.Reader) error {
+	if h.pgUser == "" {
+		msg := binary.BigEndian.AppendUint32(nil, 8)
+		msg = binary.BigEndian.AppendUint32(msg, hcPgSslRequestCode)
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 'S' && b != 'N' {
+			return fmt.Errorf("%w: SSLRequest reply '%c'", errHcProtocol, b)
+		}
+		return nil
+	}
+
+	params := "user\x00" + h.pgUser + "\x00"
+	if h.pgDatabase != "" {
+		params += "database\x00" + h.pgDatabase + "\x00"
+	}
+	params += "\x00"
+	msg := binary.BigEndian.AppendUint32(nil, uint32(8+len(params)))
+	msg = binary.BigEndian.AppendUint32(msg, hcPgProtoVersion)
+	msg = append(msg, params...)
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	defer pgSend(c, 'X', nil)
+
+	if h.pgPass == "" && h.pgRole == "" {
+		t, _, err := pgRecv(r)
+		if err != nil {
+			return err
+		}
+		if t != 'R' {
+			return fmt.Errorf("%w: startup reply '%c'", errHcProtocol, t)
+		}
+		return nil
+	}
+
+	if err := h.pgAuth(c, r); err != nil {
+		return err
+	}
+	// Parameters and backend key until ready for query
+	if err := pgReady(r, nil); err != nil {
+		return err
+	}
+	if h.pgRole == "" {
+		return nil
+	}
+
+	if err := pgSend(c, 'Q', []byte(hcPgRoleQuery+"\x00")); err != nil {
+		return err
+	}
+	var recovery string
+	err := pgReady(r, func(body []byte) {
+		// Column count, then the length and value of each column
+		if len(body) >= 6 && binary.BigEndian.Uint16(body) == 1 && int(int32(binary.BigEndian.Uint32(body[2:]))) == len(body)-6 {
+			recovery = string(body[6:])
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	role := hcDbRolePrimary
+	switch recovery {
+	case "f":
+	case "t":
+		role = hcDbRoleReplica
+	default:
+		return fmt.Errorf("%w: pg_is_in_recovery '%s'", errHcProtocol, recovery)
+	}
+	if role != h.pgRole {
+		return fmt.Errorf("%w: '%s'", errHcDbRole, role)
+	}
+
+	return nil
+}
+
+// pgReady reads the messages until ReadyForQuery, passing the DataRow messages to row
+func pgReady(r *bufio.Reader, row func(body []byte)) error {
+	for {
+		t, body, err := pgRecv(r)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case 'Z':
+			return nil
+		case 'D':
+			if row != nil {
+				row(body)
+			}
+		}
+	}
+}
+
+// pgAuth answers the authentication requests until AuthenticationOk
+// Cleartext, MD5 and SCRAM-SHA-256 password authentications are supported
+func (h *hcTcp) pgAuth(c net.Conn, r *bufio.Reader) error {
+	var scram *pgScram
+	for {
+		t, body, err := pgRecv(r)
+		if err != nil {
+			return err
+		}
+		if t != 'R' || len(body) < 4 {
+			return fmt.Errorf("%w: authentication message '%c'", errHcProtocol, t)
+		}
+
+		var resp []byte
+		data := body[4:]
+		switch binary.BigEndian.Uint32(body) {
+		case hcPgAuthOk:
+			return nil
+		case hcPgAuthCleartext:
+			resp = []byte(h.pgPass + "\x00")
+		case hcPgAuthMd5:
+			// "md5" + md5(md5(password + user) + salt)
+			if len(data) < 4 {
+				return fmt.Errorf("%w: md5 salt", errHcProtocol)
+			}
+			s := md5.Sum([]byte(h.pgPass + h.pgUser))
+			s = md5.Sum(append([]byte(hex.EncodeToString(s[:])), data[:4]...))
+			resp = []byte("md5" + hex.EncodeToString(s[:]) + "\x00")
+		case hcPgAuthSasl:
+			if !strings.Contains("\x00"+string(data), "\x00"+hcPgScramMech+"\x00") {
+				return fmt.Errorf("%w: postgres SASL mechanisms '%s'", errHcAuth, strings.Trim(string(data), "\x00"))
+			}
+			if scram, err = newPgScram(h.pgUser, h.pgPass); err != nil {
+				return err
+			}
+			first := scram.clientFirst()
+			resp = append([]byte(hcPgScramMech+"\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+			resp = append(resp, first...)
+		case hcPgAuthSaslContinue:
+			if scram == nil {
+				return fmt.Errorf("%w: unexpected SASL continue", errHcProtocol)
+			}
+			if resp, err = scram.clientFinal(string(data)); err != nil {
+				return err
+			}
+		case hcPgAuthSaslFinal:
+			if scram == nil {
+				return fmt.Errorf("%w: unexpected SASL final", errHcProtocol)
+			}
+			if err := scram.verify(string(data)); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("%w: postgres authentication request %d", errHcAuth, binary.BigEndian.Uint32(body))
+		}
+
+		if err := pgSend(c, 'p', resp); err != nil {
+			return err
+		}
+	}
+}
+
+// pgScram holds the SCRAM-SHA-256 exchange state
+type pgScram struct {
+	user     string // SCRAM user. Ignored by postgres in favour of the startup user
+	password string // password
+	nonce    string // client nonce
+	authMsg  string // auth message signed by both sides
+	saltedPw []byte // salted password
+}
+
+// newPgScram returns a SCRAM-SHA-256 exchange with a random client nonce
+func newPgScram(user, password string) (*pgScram, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &pgScram{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// clientFirstBare returns the client first message without the channel binding header
+func (s *pgScram) clientFirstBare() string {
+	return "n=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user) + ",r=" + s.nonce
+}
+
+// clientFirst returns the client first message, without channel binding
+func (s *pgScram) clientFirst() string {
+	return "n,," + s.clientFirstBare()
+}
+
+// clientFinal returns the client final message with the proof for the server first message
+func (s *pgScram) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("%w: SCRAM salt", errHcProtocol)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 || iter > hcPgScramMaxIter {
+		return nil, fmt.Errorf("%w: SCRAM iterations '%s'", errHcProtocol, attrs["i"])
+	}
+	if len(attrs["r"]) <= len(s.nonce) || !strings.HasPrefix(attrs["r"], s.nonce) {
+		return nil, fmt.Errorf("%w: SCRAM nonce", errHcProtocol)
+	}
+
+	s.saltedPw = pbkdf2Sha256([]byte(s.password), salt, iter)
+	final := "c=biws,r=" + attrs["r"]
+	s.authMsg = s.clientFirstBare() + "," + serverFirst + "," + final
+
+	// ClientProof = ClientKey XOR HMAC(H(ClientKey), AuthMessage)
+	key := hmacSha256(s.saltedPw, "Client Key")
+	stored := sha256.Sum256(key)
+	sig := hmacSha256(stored[:], s.authMsg)
+	for i := range key {
+		key[i] ^= sig[i]
+	}
+
+	return []byte(final + ",p=" + base64.StdEncoding.EncodeToString(key)), nil
+}
+
+// verify checks the server signature of the server final message
+func (s *pgScram) verify(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("%w: SCRAM %s", errHcPg, e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(v, hmacSha256(hmacSha256(s.saltedPw, "Server Key"), s.authMsg)) {
+		return fmt.Errorf("%w: SCRAM server signature", errHcProtocol)
+	}
+
+	return nil
+}
+
+// scramAttrs returns the attributes of a SCRAM message
+func scramAttrs(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, a := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(a, "="); ok {
+			attrs[k] = v
+		}
+	}
+
+	return attrs
+}
+
+// hmacSha256 returns the HMAC-SHA-256 of msg
+func hmacSha256(key []byte, msg string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+// pbkdf2Sha256 returns the PBKDF2-HMAC-SHA-256 key of the SHA-256 size, a single block
+func pbkdf2Sha256(password, salt []byte, iter int) []byte {
+	m := hmac.New(sha256.New, password)
+	m.Write(salt)
+	m.Write([]byte{0, 0, 0, 1})
+	u := m.Sum(nil)
+	key := bytes.Clone(u)
+	for i := 1; i < iter; i++ {
+		m.Reset()
+		m.Write(u)
+		u = m.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// probeBanner checks the SMTP or FTP service ready banner
+func probeBanner(c net.Conn, r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, hcBannerCode) {
+		return fmt.Errorf("%w: '%s'", errHcBanner, strings.TrimSpace(line))
+	}
+	c.Write([]byte("QUIT\r\n"))
+
+	return nil
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveTcp accepts connections on a local listener and handles each with fn
+func serveTcp(t *testing.T, fn func(c net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				fn(c)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// readRedisCmd reads a RESP array command
+func readRedisCmd(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		a, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSpace(a))
+	}
+
+	return args, nil
+}
+
+func TestGetHcTcp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		protocol hcProto
+		config   HealthCheckConfig
+		err      error
+	}{
+		{name: "steps", protocol: hcProtoTcpSendExpect, config: HealthCheckConfig{Tcp: &TcpHealthCheckConfig{Steps: []SendExpectConfig{{Send: "PING\r\n", Expect: "^PONG"}, {Send: "QUIT\r\n"}}}}, err: nil},
+		{name: "expect only step", protocol: hcProtoTcpSendExpect, config: HealthCheckConfig{Tcp: &TcpHealthCheckConfig{Steps: []SendExpectConfig{{Expect: "^220"}}}}, err: nil},
+		{name: "no steps", protocol: hcProtoTcpSendExpect, config: HealthCheckConfig{}, err: errHcTcpSteps},
+		{name: "empty step", protocol: hcProtoTcpSendExpect, config: HealthCheckConfig{Tcp: &TcpHealthCheckConfig{Steps: []SendExpectConfig{{}}}}, err: errHcTcpSteps},
+		{name: "invalid step", protocol: hcProtoTcpSendExpect, config: HealthCheckConfig{Tcp: &TcpHealthCheckConfig{Steps: []SendExpectConfig{{SendHex: "fg"}}}}, err: errHcHex},
+		{name: "redis", protocol: hcProtoRedis, config: HealthCheckConfig{}, err: nil},
+		{name: "redis role", protocol: hcProtoRedis, config: HealthCheckConfig{Redis: &RedisHealthCheckConfig{Role: "replica"}}, err: nil},
+		{name: "invalid redis role", protocol: hcProtoRedis, config: HealthCheckConfig{Redis: &RedisHealthCheckConfig{Role: "primary"}}, err: errHcRedisRoleConf},
+		{name: "postgres", protocol: hcProtoPostgres, config: HealthCheckConfig{Postgres: &PostgresHealthCheckConfig{User: "lobby", Database: "app"}}, err: nil},
+		{name: "postgres database without user", protocol: hcProtoPostgres, config: HealthCheckConfig{Postgres: &PostgresHealthCheckConfig{Database: "app"}}, err: errHcPgConf},
+		{name: "postgres role", protocol: hcProtoPostgres, config: HealthCheckConfig{Postgres: &PostgresHealthCheckConfig{User: "lobby", Password: "secret", Role: "primary"}}, err: nil},
+		{name: "postgres role without user", protocol: hcProtoPostgres, config: HealthCheckConfig{Postgres: &PostgresHealthCheckConfig{Role: "replica"}}, err: errHcPgConf},
+		{name: "invalid postgres role", protocol: hcProtoPostgres, config: HealthCheckConfig{Postgres: &PostgresHealthCheckConfig{User: "lobby", Role: "master"}}, err: errHcDbRoleConf},
+		{name: "mysql role", protocol: hcProtoMysql, config: HealthCheckConfig{Mysql: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "replica"}}, err: nil},
+		{name: "mysql password without user", protocol: hcProtoMysql, config: HealthCheckConfig{Mysql: &MysqlHealthCheckConfig{Password: "secret"}}, err: errHcMysqlConf},
+		{name: "invalid mysql role", protocol: hcProtoMysql, config: HealthCheckConfig{Mysql: &MysqlHealthCheckConfig{User: "lobby", Role: "slave"}}, err: errHcDbRoleConf},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcTcp(&tc.config, tc.protocol, 1, hcSource{}); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcTcpSendExpectProbe(t *testing.T) {
+	// server sending a banner, replying 'PONG' to 'PING' and an error otherwise
+	addr := serveTcp(t, func(c net.Conn) {
+		c.Write([]byte("+OK ready\r\n"))
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "PING\r\n" {
+				c.Write([]byte("PONG\r\n"))
+				continue
+			}
+			c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	})
+
+	testCases := []struct {
+		name  string
+		steps []SendExpectConfig
+		err   error
+	}{
+		{name: "banner", steps: []SendExpectConfig{{Expect: "^\\+OK"}}, err: nil},
+		{name: "banner and ping", steps: []SendExpectConfig{{Expect: "ready\r\n$"}, {Send: "PING\r\n", Expect: "^PONG"}}, err: nil},
+		{name: "hex", steps: []SendExpectConfig{{ExpectHex: "2b4f4b"}}, err: nil},
+		{name: "send only", steps: []SendExpectConfig{{Send: "PING\r\n"}}, err: nil},
+		{name: "no match", steps: []SendExpectConfig{{Expect: "^-ERR"}}, err: errHcNoMatch},
+		{name: "second step no match", steps: []SendExpectConfig{{Expect: "ready\r\n$"}, {Send: "ECHO\r\n", Expect: "ECHO"}}, err: errHcNoMatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcTcp(&HealthCheckConfig{Tcp: &TcpHealthCheckConfig{Steps: tc.steps}}, hcProtoTcpSendExpect, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcRedisProbe(t *testing.T) {
+	// password protected master
+	addr := serveTcp(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		auth := false
+		for {
+			args, err := readRedisCmd(r)
+			if err != nil || len(args) == 0 {
+				return
+			}
+			switch {
+			case args[0] == "AUTH" && len(args) == 2 && args[1] == "secret":
+				auth = true
+				c.Write([]byte("+OK\r\n"))
+			case args[0] == "AUTH":
+				c.Write([]byte("-WRONGPASS invalid password\r\n"))
+			case !auth:
+				c.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			case args[0] == "PING":
+				c.Write([]byte("+PONG\r\n"))
+			case args[0] == "INFO":
+				info := "# Replication\r\nrole:master\r\nconnected_slaves:0\r\n"
+				c.Write([]byte("$" + strconv.Itoa(len(info)) + "\r\n" + info + "\r\n"))
+			}
+		}
+	})
+
+	testCases := []struct {
+		name   string
+		config *RedisHealthCheckConfig
+		err    error
+	}{
+		{name: "auth", config: &RedisHealthCheckConfig{Password: "secret"}, err: nil},
+		{name: "auth and role", config: &RedisHealthCheckConfig{Password: "secret", Role: "master"}, err: nil},
+		{name: "no auth", config: nil, err: errHcRedis},
+		{name: "wrong password", config: &RedisHealthCheckConfig{Password: "wrong"}, err: errHcRedis},
+		{name: "wrong role", config: &RedisHealthCheckConfig{Password: "secret", Role: "replica"}, err: errHcRedisRole},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcTcp(&HealthCheckConfig{Redis: tc.config}, hcProtoRedis, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcMysqlProbe(t *testing.T) {
+	// mysqlPacket returns a mysql packet with sequence id 0
+	mysqlPacket := func(p []byte) []byte {
+		return append([]byte{byte(len(p)), byte(len(p) >> 8), byte(len(p) >> 16), 0}, p...)
+	}
+
+	testCases := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{name: "handshake", packet: mysqlPacket(append([]byte{10}, "8.0.36\x00"...)), err: nil},
+		{name: "error packet", packet: mysqlPacket(append([]byte{0xff, 0x10, 0x04}, "Too many connections"...)), err: errHcMysql},
+		{name: "unsupported protocol", packet: mysqlPacket([]byte{9, 0}), err: errHcProtocol},
+		{name: "empty packet", packet: mysqlPacket(nil), err: errHcProtocol},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := serveTcp(t, func(c net.Conn) {
+				c.Write(tc.packet)
+			})
+			h, _ := getHcTcp(&HealthCheckConfig{}, hcProtoMysql, 1, hcSource{})
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+// serveMysql serves a mysql server accepting the 'lobby' user with the 'secret' password
+// The handshake announces the hsPlugin authentication plugin and switches to plugin if they differ
+// caching_sha2_password runs the full authentication if an RSA key is set, and the fast authentication otherwise
+func serveMysql(t *testing.T, hsPlugin, plugin string, key *rsa.PrivateKey, readOnly string) string {
+	t.Helper()
+	scramble := []byte("0123456789abcdefghij")
+	errPacket := append([]byte{hcMysqlErrPacket, 0x15, 0x04}, "#28000Access denied"...)
+
+	return serveTcp(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		hs := append([]byte{hcMysqlProtoVersion}, "8.0.36\x00"...)
+		hs = binary.LittleEndian.AppendUint32(hs, 1)
+		hs = append(hs, scramble[:8]...)
+		hs = append(hs, 0)
+		hs = binary.LittleEndian.AppendUint16(hs, uint16(hcMysqlClientCaps&0xffff))
+		hs = append(hs, hcMysqlCharset, 2, 0)
+		hs = binary.LittleEndian.AppendUint16(hs, uint16(hcMysqlClientCaps>>16))
+		hs = append(hs, byte(len(scramble)+1))
+		hs = append(hs, make([]byte, 10)...)
+		hs = append(hs, scramble[8:]...)
+		hs = append(hs, 0)
+		hs = append(hs, hsPlugin+"\x00"...)
+		mysqlSend(c, 0, hs)
+
+		// Handshake response
+		seq, p, err := mysqlRecv(r)
+		if err != nil || len(p) < 32 {
+			return
+		}
+		user, rest, _ := bytes.Cut(p[32:], []byte{0})
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return
+		}
+		auth := rest[1 : 1+rest[0]]
+		if hsPlugin != plugin {
+			mysqlSend(c, seq+1, append(append([]byte{hcMysqlEofPacket}, plugin+"\x00"...), append(scramble, 0)...))
+			if seq, auth, err = mysqlRecv(r); err != nil {
+				return
+			}
+		}
+
+		var pass string
+		switch {
+		case plugin == hcMysqlSha2Auth && key != nil:
+			// Full authentication, sending the public key on request
+			mysqlSend(c, seq+1, []byte{hcMysqlMoreData, 4})
+			if seq, p, err = mysqlRecv(r); err != nil || !bytes.Equal(p, []byte{2}) {
+				return
+			}
+			der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			mysqlSend(c, seq+1, append([]byte{hcMysqlMoreData}, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...))
+			if seq, p, err = mysqlRecv(r); err != nil {
+				return
+			}
+			b, err := rsa.DecryptOAEP(sha1.New(), nil, key, p, nil)
+			if err != nil {
+				return
+			}
+			for i := range b {
+				b[i] ^= scramble[i%len(scramble)]
+			}
+			pass = strings.TrimSuffix(string(b), "\x00")
+		default:
+			if expected, _ := mysqlScramble(plugin, "secret", scramble); bytes.Equal(auth, expected) {
+				pass = "secret"
+			}
+			if plugin == hcMysqlSha2Auth && pass != "" {
+				// Fast authentication success
+				seq++
+				mysqlSend(c, seq, []byte{hcMysqlMoreData, 3})
+			}
+		}
+		if string(user) != "lobby" || pass != "secret" {
+			mysqlSend(c, seq+1, errPacket)
+			return
+		}
+		mysqlSend(c, seq+1, []byte{hcMysqlOkPacket, 0, 0, 2, 0, 0, 0})
+
+		// Queries, answered with a single column and a single row
+		eof := []byte{hcMysqlEofPacket, 0, 0, 2, 0}
+		for {
+			_, p, err := mysqlRecv(r)
+			if err != nil || p[0] != hcMysqlComQuery {
+				return
+			}
+			mysqlSend(c, 1, []byte{1})
+			mysqlSend(c, 2, append([]byte{3}, "def"...))
+			mysqlSend(c, 3, eof)
+			mysqlSend(c, 4, append([]byte{byte(len(readOnly))}, readOnly...))
+			mysqlSend(c, 5, eof)
+		}
+	})
+}
+
+func TestHcMysqlRoleProbe(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate the rsa key: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		hsPlugin string
+		plugin   string
+		key      *rsa.PrivateKey
+		readOnly string
+		config   *MysqlHealthCheckConfig
+		err      error
+	}{
+		{name: "native login", hsPlugin: hcMysqlNativeAuth, plugin: hcMysqlNativeAuth, readOnly: "0", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret"}, err: nil},
+		{name: "native primary", hsPlugin: hcMysqlNativeAuth, plugin: hcMysqlNativeAuth, readOnly: "0", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "primary"}, err: nil},
+		{name: "sha2 fast replica", hsPlugin: hcMysqlSha2Auth, plugin: hcMysqlSha2Auth, readOnly: "1", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "replica"}, err: nil},
+		{name: "sha2 full replica", hsPlugin: hcMysqlSha2Auth, plugin: hcMysqlSha2Auth, key: key, readOnly: "1", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "replica"}, err: nil},
+		{name: "auth switch", hsPlugin: hcMysqlSha2Auth, plugin: hcMysqlNativeAuth, readOnly: "0", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "primary"}, err: nil},
+		{name: "unexpected role", hsPlugin: hcMysqlNativeAuth, plugin: hcMysqlNativeAuth, readOnly: "1", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret", Role: "primary"}, err: errHcDbRole},
+		{name: "wrong password", hsPlugin: hcMysqlSha2Auth, plugin: hcMysqlSha2Auth, key: key, readOnly: "0", config: &MysqlHealthCheckConfig{User: "lobby", Password: "wrong", Role: "primary"}, err: errHcMysql},
+		{name: "unsupported plugin", hsPlugin: "auth_gssapi_client", plugin: "auth_gssapi_client", readOnly: "0", config: &MysqlHealthCheckConfig{User: "lobby", Password: "secret"}, err: errHcAuth},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := serveMysql(t, tc.hsPlugin, tc.plugin, tc.key, tc.readOnly)
+			h, err := getHcTcp(&HealthCheckConfig{Mysql: tc.config}, hcProtoMysql, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcPostgresProbe(t *testing.T) {
+	// server declining SSL and accepting the 'lobby' user without a password, the 'clear' and 'md5' users with
+	// the 'secret' password and refusing other users. The 'replica' database is in recovery
+	addr := serveTcp(t, func(c net.Conn) {
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		l := binary.BigEndian.Uint32(hdr[:4])
+		code := binary.BigEndian.Uint32(hdr[4:])
+		if code == hcPgSslRequestCode {
+			c.Write([]byte{'N'})
+			return
+		}
+		params := make([]byte, l-8)
+		if _, err := io.ReadFull(c, params); err != nil {
+			return
+		}
+		if code != hcPgProtoVersion {
+			return
+		}
+		kv := strings.Split(string(params), "\x00")
+		startup := map[string]string{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			startup[kv[i]] = kv[i+1]
+		}
+		pgError := func(msg string) {
+			fields := "SFATAL\x00C28000\x00M" + msg + "\x00\x00"
+			pgSend(c, 'E', []byte(fields))
+		}
+
+		r := bufio.NewReader(c)
+		salt := []byte{1, 2, 3, 4}
+		switch startup["user"] {
+		case "lobby":
+		case "clear", "md5":
+			var expected string
+			if startup["user"] == "clear" {
+				pgSend(c, 'R', binary.BigEndian.AppendUint32(nil, hcPgAuthCleartext))
+				expected = "secret\x00"
+			} else {
+				pgSend(c, 'R', append(binary.BigEndian.AppendUint32(nil, hcPgAuthMd5), salt...))
+				// md5 of "secret" + "md5", then of its hex and the salt
+				expected = "md508f71aa6fbd70be3f2ee0eeb998b20be\x00"
+			}
+			typ, body, err := pgRecv(r)
+			if err != nil || typ != 'p' {
+				return
+			}
+			if string(body) != expected {
+				pgError("password authentication failed")
+				return
+			}
+		default:
+			pgError("role does not exist")
+			return
+		}
+
+		// AuthenticationOk, a parameter status, the backend key and ready for query
+		pgSend(c, 'R', binary.BigEndian.AppendUint32(nil, hcPgAuthOk))
+		pgSend(c, 'S', []byte("server_version\x0016.2\x00"))
+		pgSend(c, 'K', make([]byte, 8))
+		pgSend(c, 'Z', []byte{'I'})
+		for {
+			typ, body, err := pgRecv(r)
+			if err != nil || typ != 'Q' {
+				return
+			}
+			if string(body) != hcPgRoleQuery+"\x00" {
+				pgError("unexpected query")
+				continue
+			}
+			recovery := "f"
+			if startup["database"] == "replica" {
+				recovery = "t"
+			}
+			pgSend(c, 'T', append([]byte{0, 1}, "pg_is_in_recovery\x00"...))
+			pgSend(c, 'D', append([]byte{0, 1, 0, 0, 0, 1}, recovery...))
+			pgSend(c, 'C', []byte("SELECT 1\x00"))
+			pgSend(c, 'Z', []byte{'I'})
+		}
+	})
+
+	testCases := []struct {
+		name   string
+		config *PostgresHealthCheckConfig
+		err    error
+	}{
+		{name: "ssl request", config: nil, err: nil},
+		{name: "startup", config: &PostgresHealthCheckConfig{User: "lobby", Database: "app"}, err: nil},
+		{name: "startup error", config: &PostgresHealthCheckConfig{User: "unknown"}, err: errHcPg},
+		{name: "startup without password", config: &PostgresHealthCheckConfig{User: "md5"}, err: nil},
+		{name: "trust primary", config: &PostgresHealthCheckConfig{User: "lobby", Database: "app", Role: "primary"}, err: nil},
+		{name: "cleartext login", config: &PostgresHealthCheckConfig{User: "clear", Password: "secret"}, err: nil},
+		{name: "md5 replica", config: &PostgresHealthCheckConfig{User: "md5", Password: "secret", Database: "replica", Role: "replica"}, err: nil},
+		{name: "unexpected role", config: &PostgresHealthCheckConfig{User: "md5", Password: "secret", Database: "replica", Role: "primary"}, err: errHcDbRole},
+		{name: "wrong password", config: &PostgresHealthCheckConfig{User: "md5", Password: "wrong", Role: "primary"}, err: errHcPg},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcTcp(&HealthCheckConfig{Postgres: tc.config}, hcProtoPostgres, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestPgScram(t *testing.T) {
+	// RFC 7677 SCRAM-SHA-256 test vector
+	s := &pgScram{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if first := s.clientFirst(); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("unexpected client first message '%s'", first)
+	}
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != expected {
+		t.Errorf("expected client final message '%s', but got '%s'", expected, final)
+	}
+
+	testCases := []struct {
+		name        string
+		serverFinal string
+		err         error
+	}{
+		{name: "server signature", serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", err: nil},
+		{name: "wrong server signature", serverFinal: "v=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", err: errHcProtocol},
+		{name: "server error", serverFinal: "e=invalid-proof", err: errHcPg},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := s.verify(tc.serverFinal); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcBannerProbe(t *testing.T) {
+	testCases := []struct {
+		name     string
+		protocol hcProto
+		banner   string
+		err      error
+	}{
+		{name: "smtp", protocol: hcProtoSmtp, banner: "220 mail.example.com ESMTP ready\r\n", err: nil},
+		{name: "smtp multiline", protocol: hcProtoSmtp, banner: "220-mail.example.com ESMTP\r\n220 ready\r\n", err: nil},
+		{name: "smtp unavailable", protocol: hcProtoSmtp, banner: "421 Service not available\r\n", err: errHcBanner},
+		{name: "ftp", protocol: hcProtoFtp, banner: "220 FTP server ready\r\n", err: nil},
+		{name: "ftp busy", protocol: hcProtoFtp, banner: "120 Service ready in 5 minutes\r\n", err: errHcBanner},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := serveTcp(t, func(c net.Conn) {
+				c.Write([]byte(tc.banner))
+				bufio.NewReader(c).ReadString('\n')
+			})
+			h, _ := getHcTcp(&HealthCheckConfig{}, tc.protocol, 1, hcSource{})
+			if err := h.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	testCases := []struct {
+		input  string
+		err    error
+		result statusRange
+	}{
+		{input: "200", err: nil, result: statusRange{min: 200, max: 200}},
+		{input: "200-299", err: nil, result: statusRange{min: 200, max: 299}},
+		{input: " 300 - 399 ", err: nil, result: statusRange{min: 300, max: 399}},
+		{input: "299-200", err: errHcHttpStatus, result: statusRange{}},
+		{input: "99", err: errHcHttpStatus, result: statusRange{}},
+		{input: "200-600", err: errHcHttpStatus, result: statusRange{}},
+		{input: "2xx", err: errHcHttpStatus, result: statusRange{}},
+		{input: "", err: errHcHttpStatus, result: statusRange{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			result, err := parseStatusRange(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if result != tc.result {
+				t.Errorf("expected '%v', but got '%v'", tc.result, result)
+			}
+		})
+	}
+}
+
+func TestGetHcHttp(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config *HttpHealthCheckConfig
+		https  bool
+		err    error
+	}{
+		{name: "defaults", config: nil, err: nil},
+		{name: "method", config: &HttpHealthCheckConfig{Method: "head"}, err: nil},
+		{name: "invalid method", config: &HttpHealthCheckConfig{Method: "GET /"}, err: errHcHttpMethod},
+		{name: "invalid path", config: &HttpHealthCheckConfig{Path: "healthz"}, err: errHcHttpPath},
+		{name: "invalid status", config: &HttpHealthCheckConfig{Status: []string{"200", "3xx"}}, err: errHcHttpStatus},
+		{name: "invalid body regex", config: &HttpHealthCheckConfig{BodyRegex: "("}, err: errHcHttpBodyRegex},
+		{name: "tls without https", config: &HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{InsecureSkipVerify: true}}, err: errHcHttpTls},
+		{name: "missing CA file", config: &HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{CaFile: "/nonexistent/ca.pem"}}, https: true, err: errHcHttpTls},
+		{name: "missing key file", config: &HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{CertFile: "/nonexistent/cert.pem"}}, https: true, err: errHcHttpTls},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcHttp(tc.config, tc.https, "1.1.1.1", 1, hcSource{}); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	// https server name defaults
+	snTestCases := []struct {
+		name   string
+		config *HttpHealthCheckConfig
+		host   string
+		result string
+	}{
+		{name: "IP upstream", config: nil, host: "1.1.1.1", result: ""},
+		{name: "FQDN upstream", config: nil, host: "www.example.com.", result: "www.example.com"},
+		{name: "Host header", config: &HttpHealthCheckConfig{Host: "api.example.com:8443"}, host: "www.example.com.", result: "api.example.com"},
+		{name: "server name", config: &HttpHealthCheckConfig{Host: "api.example.com", Tls: HealthCheckTlsConfig{ServerName: "sni.example.com"}}, host: "www.example.com.", result: "sni.example.com"},
+	}
+	for _, tc := range snTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcHttp(tc.config, true, tc.host, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if sn := h.client.Transport.(*http.Transport).TLSClientConfig.ServerName; sn != tc.result {
+				t.Errorf("expected server name '%s', but got '%s'", tc.result, sn)
+			}
+		})
+	}
+}
+
+func TestHcHttpProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/redirect":
+			http.Redirect(w, r, "/", http.StatusFound)
+		case r.URL.Path != "/healthz":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Host != "app.example.com" || r.Header.Get("X-Check") != "lobby":
+			w.WriteHeader(http.StatusBadRequest)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Write([]byte("status: ok"))
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	h := map[string]string{"X-Check": "lobby"}
+	testCases := []struct {
+		name   string
+		config HttpHealthCheckConfig
+		err    error
+	}{
+		{name: "success", config: HttpHealthCheckConfig{Path: "/healthz", Host: "app.example.com", Headers: h}, err: nil},
+		{name: "method", config: HttpHealthCheckConfig{Method: "HEAD", Path: "/healthz", Host: "app.example.com", Headers: h, Status: []string{"204"}}, err: nil},
+		{name: "not found", config: HttpHealthCheckConfig{Host: "app.example.com", Headers: h}, err: errHcStatus},
+		{name: "missing Host and headers", config: HttpHealthCheckConfig{Path: "/healthz"}, err: errHcStatus},
+		{name: "redirect not followed", config: HttpHealthCheckConfig{Path: "/redirect"}, err: nil},
+		{name: "redirect not expected", config: HttpHealthCheckConfig{Path: "/redirect", Status: []string{"200"}}, err: errHcStatus},
+		{name: "expected status list", config: HttpHealthCheckConfig{Status: []string{"200-299", "404"}}, err: nil},
+		{name: "body", config: HttpHealthCheckConfig{Path: "/healthz", Host: "app.example.com", Headers: h, Body: "ok"}, err: nil},
+		{name: "unexpected body", config: HttpHealthCheckConfig{Path: "/healthz", Host: "app.example.com", Headers: h, Body: "ready"}, err: errHcBody},
+		{name: "body regex", config: HttpHealthCheckConfig{Path: "/healthz", Host: "app.example.com", Headers: h, BodyRegex: "^status: (ok|ready)$"}, err: nil},
+		{name: "unexpected body regex", config: HttpHealthCheckConfig{Path: "/healthz", Host: "app.example.com", Headers: h, BodyRegex: "^ready$"}, err: errHcBody},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc, err := getHcHttp(&tc.config, false, "127.0.0.1", 2, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := hc.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	// connection failure
+	srv.Close()
+	hc, _ := getHcHttp(&testCases[0].config, false, "127.0.0.1", 2, hcSource{})
+	if err := hc.probe(addr); err == nil {
+		t.Errorf("expected an error on a closed server")
+	}
+}
+
+func TestHcHttpsProbe(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	// CA bundle with the test server certificate
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		config  HttpHealthCheckConfig
+		success bool
+	}{
+		{name: "unknown CA", config: HttpHealthCheckConfig{}, success: false},
+		{name: "skip verification", config: HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{InsecureSkipVerify: true}}, success: true},
+		{name: "CA bundle", config: HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{CaFile: caFile, ServerName: "example.com"}}, success: true},
+		{name: "CA bundle with wrong server name", config: HttpHealthCheckConfig{Tls: HealthCheckTlsConfig{CaFile: caFile, ServerName: "example.org"}}, success: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := getHcHttp(&tc.config, true, "127.0.0.1", 2, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := h.probe(addr); (err == nil) != tc.success {
+				t.Errorf("expected success '%v', but got '%v'", tc.success, err)
+			}
+		})
+	}
+}
+
+func TestHcUpdate(t *testing.T) {
+	errProbe := errors.New("connection refused")
+	u := &upstream{
+		name:      "u1",
+		available: true,
+		healthCheck: healthCheck{
+			active:      true,
+			healthy:     true,
+			countConfig: 2,
+			failConfig:  3,
+		},
+	}
+
+	// probe results and expected availability after each of them
+	steps := []struct {
+		err       error
+		available bool
+		changed   bool
+	}{
+		{err: errProbe, available: true, changed: false},
+		{err: errProbe, available: true, changed: false},
+		{err: nil, available: true, changed: false}, // a success resets the consecutive failures
+		{err: errProbe, available: true, changed: false},
+		{err: errProbe, available: true, changed: false},
+		{err: errProbe, available: false, changed: true},
+		{err: errProbe, available: false, changed: false},
+		{err: nil, available: false, changed: false},
+		{err: errProbe, available: false, changed: false}, // a failure resets the consecutive successes
+		{err: nil, available: false, changed: false},
+		{err: nil, available: true, changed: true},
+	}
+	for i, s := range steps {
+		if changed, _ := u.hcUpdate("127.0.0.1:80", s.err); changed != s.changed || u.available != s.available {
+			t.Errorf("step %d: expected available '%t' and changed '%t', but got '%t' and '%t'", i+1, s.available, s.changed, u.available, changed)
+		}
+	}
+
+	if u.healthCheck.probes != uint64(len(steps)) || u.healthCheck.failures != 7 {
+		t.Errorf("expected %d probes and 7 failures, but got %d and %d", len(steps), u.healthCheck.probes, u.healthCheck.failures)
+	}
+}
+
+func TestHcRunHostOverride(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	u := &upstream{
+		name: "u1",
+		host: "u1.example.com",
+		healthCheck: healthCheck{
+			active:      true,
+			protocol:    hcProtoTcp,
+			host:        "127.0.0.1",
+			port:        uint16(ln.Addr().(*net.TCPAddr).Port),
+			timeout:     1,
+			countConfig: 1,
+			failConfig:  1,
+		},
+	}
+
+	// the reachable host override doesn't make an upstream without address available
+	if changed, _ := u.hcRun(); changed || u.available || !errors.Is(u.healthCheck.lastErr, errHcUnresolved) {
+		t.Errorf("expected unavailable upstream with error '%v', but got available '%t' with error '%v'", errHcUnresolved, u.available, u.healthCheck.lastErr)
+	}
+
+	// the host override is probed once the address is resolved
+	u.address = net.ParseIP("192.0.2.1")
+	if changed, _ := u.hcRun(); !changed || !u.available {
+		t.Errorf("expected available upstream, but got available '%t' with error '%v'", u.available, u.healthCheck.lastErr)
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+	testCases := []struct {
+		name      string
+		hc        *healthCheck
+		available bool
+		min       time.Duration
+		max       time.Duration
+	}{
+		{name: "available", hc: &healthCheck{checkInterval: 10, unhealthyInterval: 60}, available: true, min: 10 * time.Second, max: 10 * time.Second},
+		{name: "unavailable", hc: &healthCheck{checkInterval: 10, unhealthyInterval: 60}, available: false, min: 60 * time.Second, max: 60 * time.Second},
+		{name: "backoff not started", hc: &healthCheck{unhealthyInterval: 5, backoffMax: 300, failConfig: 3, failCount: 3}, available: false, min: 5 * time.Second, max: 5 * time.Second},
+		{name: "backoff", hc: &healthCheck{unhealthyInterval: 5, backoffMax: 300, failConfig: 3, failCount: 6}, available: false, min: 40 * time.Second, max: 40 * time.Second},
+		{name: "backoff max", hc: &healthCheck{unhealthyInterval: 5, backoffMax: 300, failConfig: 1, failCount: 255}, available: false, min: 300 * time.Second, max: 300 * time.Second},
+		{name: "jitter", hc: &healthCheck{unhealthyInterval: 100, backoffMax: 100, jitter: 20}, available: false, min: 80 * time.Second, max: 120 * time.Second},
+		{name: "full jitter", hc: &healthCheck{unhealthyInterval: 1, backoffMax: 1, jitter: 100}, available: false, min: time.Second, max: 2 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if d := tc.hc.nextInterval(tc.available); d < tc.min || d > tc.max {
+					t.Fatalf("expected an interval between %v and %v, but got %v", tc.min, tc.max, d)
+				}
+			}
+		})
+	}
+}
+
+func TestGetHcSource(t *testing.T) {
+	testCases := []struct {
+		name   string
+		source string
+		iface  string
+		err    error
+		bound  bool
+	}{
+		{name: "unbound", source: "", iface: "", err: nil, bound: false},
+		{name: "ipv4 source", source: "127.0.0.1", iface: "", err: nil, bound: true},
+		{name: "ipv6 source", source: "::1", iface: "", err: nil, bound: true},
+		{name: "interface", source: "", iface: "lo", err: nil, bound: true},
+		{name: "invalid source", source: "localhost", iface: "", err: errHcSource, bound: false},
+		{name: "invalid interface", source: "", iface: "eth0:1", err: errHcInterface, bound: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := getHcSource(tc.source, tc.iface)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if s.bound() != tc.bound {
+				t.Errorf("expected bound '%t', but got '%t'", tc.bound, s.bound())
+			}
+		})
+	}
+}
+
+func TestHcSourceProbe(t *testing.T) {
+	src, _ := getHcSource("127.0.0.2", "")
+
+	// tcp probe
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	defer ln.Close()
+	remote := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		remote <- c.RemoteAddr().(*net.TCPAddr).IP.String()
+		c.Close()
+	}()
+	hc := &healthCheck{protocol: hcProtoTcp, timeout: 1, source: src}
+	if err := hc.probe(ln.Addr().String()); err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	if r := <-remote; r != "127.0.0.2" {
+		t.Errorf("expected tcp probe from '127.0.0.2', but got '%s'", r)
+	}
+
+	// http probe
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, _ := net.SplitHostPort(r.RemoteAddr); host != "127.0.0.2" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	h, err := getHcHttp(nil, false, "127.0.0.1", 1, src)
+	if err != nil {
+		t.Fatalf("expected no error, but got '%v'", err)
+	}
+	if err := h.probe(srv.Listener.Addr().String()); err != nil {
+		t.Errorf("expected no error, but got '%v'", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const hcUdpMaxMsg = 65535 // max datagram size read by udp health checks
+
+// UDP health check errors
+var (
+	errHcUdpSend = errors.New(
+		"udp health check requires one of 'send' or 'send_hex'",
+	)
+)
+
+// hcUdp holds the udp health check settings
+type hcUdp struct {
+	step    hcStep        // datagram sent to the upstream and expected response. Any response is accepted if no response is expected
+	timeout time.Duration // time to wait for a matching response
+	src     hcSource      // probe source
+}
+
+// getHcUdp returns the udp health check settings
+func getHcUdp(c *SendExpectConfig, timeout uint8, src hcSource) (*hcUdp, error) {
+	if c == nil || (c.Send == "") == (c.SendHex == "") {
+		return nil, errHcUdpSend
+	}
+
+	s, err := getHcStep(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hcUdp{
+		step:    s,
+		timeout: time.Duration(timeout) * time.Second,
+		src:     src,
+	}, nil
+}
+
+// probe sends the payload to addr and waits for a matching response until the timeout
+// Non matching responses are ignored. As the socket is connected, an ICMP port unreachable
+// makes the read fail immediately with a connection refused error
+func (u *hcUdp) probe(addr string) error {
+	c, err := u.src.dialer("udp", u.timeout).Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(u.timeout))
+	if _, err := c.Write(u.step.payload); err != nil {
+		return err
+	}
+
+	b := make([]byte, hcUdpMaxMsg)
+	mismatch := false
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			var ne net.Error
+			if mismatch && errors.As(err, &ne) && ne.Timeout() {
+				return errHcNoMatch
+			}
+			return err
+		}
+		if !u.step.expects() || u.step.match(b[:n]) {
+			return nil
+		}
+		mismatch = true
+	}
+}
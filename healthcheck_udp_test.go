@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGetHcUdp(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config *SendExpectConfig
+		err    error
+	}{
+		{name: "text", config: &SendExpectConfig{Send: "ping", Expect: "^pong"}, err: nil},
+		{name: "hex", config: &SendExpectConfig{SendHex: "ff00", ExpectHex: "ff01"}, err: nil},
+		{name: "no settings", config: nil, err: errHcUdpSend},
+		{name: "no payload", config: &SendExpectConfig{Expect: "pong"}, err: errHcUdpSend},
+		{name: "text and hex payload", config: &SendExpectConfig{Send: "ping", SendHex: "ff"}, err: errHcUdpSend},
+		{name: "invalid hex payload", config: &SendExpectConfig{SendHex: "fg"}, err: errHcHex},
+		{name: "invalid hex expect", config: &SendExpectConfig{Send: "ping", ExpectHex: "f"}, err: errHcHex},
+		{name: "invalid regex", config: &SendExpectConfig{Send: "ping", Expect: "("}, err: errHcExpect},
+		{name: "regex and hex expect", config: &SendExpectConfig{Send: "ping", Expect: "pong", ExpectHex: "ff"}, err: errHcExpect},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getHcUdp(tc.config, 1, hcSource{}); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHcUdpProbe(t *testing.T) {
+	// server replying 'pong <payload>' to text payloads and the payload with the last byte incremented otherwise
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer c.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, a, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(string(b[:n]), "ping") {
+				c.WriteTo(append([]byte("pong "), b[:n]...), a)
+				continue
+			}
+			b[n-1]++
+			c.WriteTo(b[:n], a)
+		}
+	}()
+	addr := c.LocalAddr().String()
+
+	testCases := []struct {
+		name   string
+		config SendExpectConfig
+		err    error
+	}{
+		{name: "any response", config: SendExpectConfig{Send: "ping"}, err: nil},
+		{name: "text", config: SendExpectConfig{Send: "ping", Expect: "^pong ping$"}, err: nil},
+		{name: "hex", config: SendExpectConfig{SendHex: "ff00", ExpectHex: "ff01"}, err: nil},
+		{name: "no match", config: SendExpectConfig{Send: "ping", Expect: "^ok"}, err: errHcNoMatch},
+		{name: "hex no match", config: SendExpectConfig{SendHex: "ff00", ExpectHex: "ff00"}, err: errHcNoMatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := getHcUdp(&tc.config, 1, hcSource{})
+			if err != nil {
+				t.Fatalf("expected no error, but got '%v'", err)
+			}
+			if err := u.probe(addr); !errors.Is(err, tc.err) {
+				t.Errorf("expected error '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	// ICMP port unreachable fails before the timeout
+	c.Close()
+	u, _ := getHcUdp(&SendExpectConfig{Send: "ping"}, 5, hcSource{})
+	start := time.Now()
+	if err := u.probe(addr); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected error '%v', but got '%v'", syscall.ECONNREFUSED, err)
+	}
+	if d := time.Since(start); d >= u.timeout {
+		t.Errorf("expected the probe to fail before the timeout, but it took %v", d)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// uspUpstreamKey is the request context key of the upstream selected for an HTTP request
+type uspUpstreamKey struct{}
+
+// matchHosts returns how specifically a host matches a list of route hosts
+// 2 for an exact match, 1 for a wildcard match and 0 if the route has no hosts
+// -1 is returned if the host doesn't match
+func matchHosts(hosts []string, host string) int {
+	if len(hosts) == 0 {
+		return 0
+	}
+
+	m := -1
+	for _, h := range hosts {
+		if !matchSni(h, host) {
+			continue
+		}
+		if !strings.HasPrefix(h, sniWildcardPrefix) {
+			return 2
+		}
+		m = 1
+	}
+
+	return m
+}
+
+// matchPathPrefix checks if a path matches a route path prefix
+// Path segments must match fully, so '/api' matches '/api' and '/api/v1', but not '/apis'
+// An empty prefix matches any path
+func matchPathPrefix(prefix, path string) bool {
+	if prefix == "" || prefix == path {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// isPathPrefix checks if a string is a valid route path prefix
+func isPathPrefix(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.ContainsAny(s, "?# \t")
+}
+
+// forwardedHeader returns the RFC 7239 Forwarded header value of an HTTP request
+func forwardedHeader(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	f := "for=" + ip
+	if strings.Contains(ip, ":") {
+		f = `for="[` + ip + `]"`
+	}
+
+	host := r.Host
+	if strings.Contains(host, ":") {
+		host = `"` + host + `"`
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	return f + ";host=" + host + ";proto=" + proto
+}
+
+// httpHandler returns the HTTP handler of a target
+// Requests are routed by host and path to an upstream group and proxied to its next available upstream
+// The client address is sent to the upstreams in the X-Forwarded-For and Forwarded headers
+// Forwarding headers received from the clients are replaced
+func (n *usp) httpHandler(t *target) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			u := pr.In.Context().Value(uspUpstreamKey{}).(uspUpstream)
+			pr.SetURL(&url.URL{Scheme: "http", Host: u.address})
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set("Forwarded", forwardedHeader(pr.In))
+		},
+		Transport: n.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			u := r.Context().Value(uspUpstreamKey{}).(uspUpstream)
+			LogIf("USP: failed to proxy request from '%s' to upstream '%s': %v", r.RemoteAddr, u.name, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ug := t.routeHttp(r.Host, r.URL.Path)
+		cs := n.candidates(ug)
+		if len(cs) == 0 {
+			LogIf("USP: failed to proxy request from '%s' for target '%s': %v", r.RemoteAddr, t.name, errUspNoUpstream)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		LogDVf("USP: proxying request from '%s' for '%s%s' to upstream '%s'", r.RemoteAddr, r.Host, r.URL.Path, cs[0].name)
+		rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uspUpstreamKey{}, cs[0])))
+	})
+}
+
+// ServeHTTP proxies the HTTP requests with the handler of the engine the listener is currently set to
+func (ul *uspListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ul.m.Lock()
+	h := ul.h
+	ul.m.Unlock()
+
+	h.ServeHTTP(w, r)
+}
+
+// serve serves the HTTP requests of a target until the server is closed
+func (ul *uspListener) serve(cs *uspConns) {
+	defer cs.wg.Done()
+
+	err := ul.srv.Serve(ul.ln)
+	_, t := ul.get()
+	if errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+		LogDf("USP: stopped listening for target '%s'", t.name)
+		return
+	}
+	LogWf("USP: stopped serving target '%s': %v", t.name, err)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestMatchHosts(t *testing.T) {
+	testCases := []struct {
+		name  string
+		hosts []string
+		host  string
+		want  int
+	}{
+		{name: "no hosts", hosts: nil, host: "www.example.com", want: 0},
+		{name: "exact", hosts: []string{"*.example.com", "www.example.com"}, host: "www.example.com", want: 2},
+		{name: "wildcard", hosts: []string{"*.example.com"}, host: "www.example.com", want: 1},
+		{name: "no match", hosts: []string{"*.example.com"}, host: "www.example.org", want: -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchHosts(tc.hosts, tc.host); got != tc.want {
+				t.Errorf("expected '%d', but got '%d'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchPathPrefix(t *testing.T) {
+	testCases := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{prefix: "", path: "/", want: true},
+		{prefix: "/", path: "/api", want: true},
+		{prefix: "/api", path: "/api", want: true},
+		{prefix: "/api", path: "/api/v1", want: true},
+		{prefix: "/api/", path: "/api/v1", want: true},
+		{prefix: "/api", path: "/apis", want: false},
+		{prefix: "/api/", path: "/api", want: false},
+		{prefix: "/api", path: "/", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.prefix+" "+tc.path, func(t *testing.T) {
+			if got := matchPathPrefix(tc.prefix, tc.path); got != tc.want {
+				t.Errorf("expected '%v', but got '%v'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIsPathPrefix(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want bool
+	}{
+		{s: "/", want: true},
+		{s: "/api/v1", want: true},
+		{s: "api", want: false},
+		{s: "/api?v=1", want: false},
+		{s: "", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			if got := isPathPrefix(tc.s); got != tc.want {
+				t.Errorf("expected '%v', but got '%v'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		tls        bool
+		want       string
+	}{
+		{name: "IPv4", remoteAddr: "192.0.2.1:40000", host: "example.com", want: "for=192.0.2.1;host=example.com;proto=http"},
+		{name: "IPv6", remoteAddr: "[2001:db8::1]:40000", host: "example.com", want: `for="[2001:db8::1]";host=example.com;proto=http`},
+		{name: "host with port", remoteAddr: "192.0.2.1:40000", host: "example.com:8080", want: `for=192.0.2.1;host="example.com:8080";proto=http`},
+		{name: "TLS", remoteAddr: "192.0.2.1:40000", host: "example.com", tls: true, want: "for=192.0.2.1;host=example.com;proto=https"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tc.remoteAddr, Host: tc.host}
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := forwardedHeader(r); got != tc.want {
+				t.Errorf("expected '%s', but got '%s'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteHttp(t *testing.T) {
+	def := &upstreamGroup{name: "default"}
+	api := &upstreamGroup{name: "api"}
+	apiV2 := &upstreamGroup{name: "api-v2"}
+	wc := &upstreamGroup{name: "wildcard"}
+	admin := &upstreamGroup{name: "admin"}
+	tg := &target{
+		upstreamGroup: def,
+		routes: []*route{
+			{pathPrefix: "/api", upstreamGroup: api},
+			{pathPrefix: "/api/v2", upstreamGroup: apiV2},
+			{host: []string{"*.example.com"}, upstreamGroup: wc},
+			{host: []string{"admin.example.com"}, pathPrefix: "/", upstreamGroup: admin},
+		},
+	}
+
+	testCases := []struct {
+		host string
+		path string
+		want *upstreamGroup
+	}{
+		{host: "example.org", path: "/", want: def},
+		{host: "example.org", path: "/api/v1", want: api},
+		{host: "example.org", path: "/api/v2/users", want: apiV2},
+		{host: "www.example.com", path: "/api", want: wc},
+		{host: "www.example.com:8080", path: "/", want: wc},
+		{host: "admin.example.com", path: "/api", want: admin},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.host+tc.path, func(t *testing.T) {
+			if got := tg.routeHttp(tc.host, tc.path); got != tc.want {
+				t.Errorf("expected upstream group '%s', but got '%s'", tc.want.name, got.name)
+			}
+		})
+	}
+}
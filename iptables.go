@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// Some hardcoded settings
+const (
+	iptChainTimeFormat     = "150405.000"           // time format suffix to be used in the iptables chain names. The '.' is removed
+	lobbyIptChainPattern   = `^%s-\d{%d}-`          // iptables chain name pattern
+	iptPrerChainSuffix     = "PRER"                 // suffix of the chain jumped to from the 'PREROUTING' chain
+	iptPostrChainSuffix    = "POSTR"                // suffix of the chain jumped to from the 'POSTROUTING' chain
+	iptTargetChainPrefix   = "T"                    // prefix of the target chains
+	iptUpstreamChainPrefix = "U"                    // prefix of the upstream chains
+	iptTable               = "nat"                  // iptables table used for load balancing
+	iptBuiltinPrerChain    = "PREROUTING"           // iptables built-in prerouting chain
+	iptBuiltinPostrChain   = "POSTROUTING"          // iptables built-in postrouting chain
+	iptMaxChainNameLen     = 28                     // iptables maximum chain name length
+	iptRestoreNoFlushFlag  = "--noflush"            // iptables-restore flag to not flush the table contents
+	iptSaveTableFlag       = "-t"                   // iptables-save flag to select the table to be dumped
+	iptCommentMatch        = "-m comment --comment" // iptables comment match
+)
+
+var (
+	// iptables-restore binaries, in order of preference
+	iptRestoreBins = []string{"iptables-legacy-restore", "iptables-restore"}
+	// iptables-save binaries, in order of preference. Must match iptRestoreBins order
+	iptSaveBins = []string{"iptables-legacy-save", "iptables-save"}
+	// supported lb engine protocols and distribution modes
+	iptSuppCapabilities = map[lbProto]map[distMode]bool{
+		lbProtoTcp: {
+			distModeRR: true,
+		},
+	}
+)
+
+// iptables struct
+type ipt struct {
+	prefix     string               // chain name prefix. Unique for each iptables engine instance
+	restoreBin string               // iptables-restore binary path
+	saveBin    string               // iptables-save binary path
+	chains     []string             // user chains created by the engine
+	tChains    map[*target]string   // target chain names
+	uChains    map[*upstream]string // upstream chain names
+	m          sync.Mutex           // iptables changes mutex
+}
+
+// iptables errors
+var (
+	errIptDep = errors.New(
+		"Error during iptables lb engine dependencies check. Neither 'iptables-legacy-restore' nor 'iptables-restore' were found in PATH",
+	)
+	errIptPerm = errors.New(
+		"Error during iptables lb engine permissions check",
+	)
+	errIptPermCap = errors.New(
+		"When running as unprivileged user, then the app process capability must have 'e' (Effective) and 'p' (Permitted) flags set for NET_ADMIN and NET_RAW capabilities. On most linux systems this can be set with `setcap 'cap_net_admin,cap_net_raw+ep' /path/to/lobby`.\nRestart the load balancer iptables engine after fixing the permissions or re-run the load balancer as a privileged/root user",
+	)
+	errIptPrep = errors.New(
+		"Error while preparing iptables",
+	)
+	errIptInit = errors.New(
+		"Error while initializing iptables",
+	)
+	errIptReconfig = errors.New(
+		"Error while reconfiguring iptables",
+	)
+	errIptAssert = errors.New(
+		"Error when asserting lb engine of type ipt",
+	)
+	errIptRestore = errors.New(
+		"Error when applying iptables rules with iptables-restore",
+	)
+	errIptSave = errors.New(
+		"Error when listing iptables rules with iptables-save",
+	)
+	errIptChainName = errors.New(
+		"iptables chain name exceeds the maximum length",
+	)
+	errIptUpdateTarget = errors.New(
+		"Error updating target",
+	)
+	errIptUpdateUpstream = errors.New(
+		"Error during iptables upstream update",
+	)
+	errIptStop = errors.New(
+		"Error during iptables stop process",
+	)
+)
+
+// chainName returns the name of an engine chain given its suffix
+// An errIptChainName error is returned if the name exceeds iptables limits
+func (n *ipt) chainName(suffix string) (string, error) {
+	cn := n.prefix + "-" + suffix
+	if len(cn) > iptMaxChainNameLen {
+		return "", fmt.Errorf("%w: '%s'", errIptChainName, cn)
+	}
+
+	return cn, nil
+}
+
+// iptMaxChainName returns the longest chain name the engine may create for a load balancer configuration
+// with the given resource prefix
+func iptMaxChainName(prefix string, lbc *LbConfig) string {
+	suffix := iptPostrChainSuffix
+	for i, t := range lbc.TargetsConfig {
+		for _, s := range []string{
+			fmt.Sprintf("%s%d", iptTargetChainPrefix, i),
+			fmt.Sprintf("%s%d-%d", iptUpstreamChainPrefix, i, max(len(t.UpstreamGroup.Upstreams)-1, 0)),
+		} {
+			if len(s) > len(suffix) {
+				suffix = s
+			}
+		}
+	}
+
+	return prefix + "-" + strings.Repeat("0", len(iptChainTimeFormat)-1) + "-" + suffix
+}
+
+// pushIpt applies the provided nat table rules with iptables-restore
+// The rules are applied in a single transaction without flushing the existing nat table rules
+func (n *ipt) pushIpt(rules []string) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	payload := iptRestorePayload(rules)
+	LogDVf("IPT: applying rules:\n%s", payload)
+
+	cmd := exec.Command(n.restoreBin, iptRestoreNoFlushFlag)
+	cmd.Stdin = strings.NewReader(payload)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %w: %s", errIptRestore, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// iptRestorePayload wraps the nat table rules in the iptables-restore format
+func iptRestorePayload(rules []string) string {
+	var b strings.Builder
+
+	b.WriteString("*" + iptTable + "\n")
+	for _, r := range rules {
+		b.WriteString(r + "\n")
+	}
+	b.WriteString("COMMIT\n")
+
+	return b.String()
+}
+
+// iptComment returns a comment match so the rules can be traced back to lobby objects
+func iptComment(c string) string {
+	return fmt.Sprintf("%s %s", iptCommentMatch, strconv.Quote(c))
+}
+
+// iptUpstreamRules returns the rules of an upstream chain
+// The chain is declared so it is flushed and then it DNATs to the upstream address
+// Upstreams without an IPv4 address have an empty chain
+func iptUpstreamRules(chain string, u *upstream) []string {
+	rules := []string{":" + chain + " - [0:0]"}
+
+	if u.address == nil || u.address.To4() == nil {
+		LogDf("IPT: upstream '%s' has no IPv4 address. Its chain will be left empty", u.name)
+		return rules
+	}
+
+	rules = append(rules, fmt.Sprintf(
+		"-A %s -p %s %s -j DNAT --to-destination %s:%d",
+		chain,
+		u.protocol.String(),
+		iptComment(u.name),
+		u.address.To4().String(),
+		u.port,
+	))
+
+	return rules
+}
+
+// iptTargetRules returns the rules of a target chain
+// The chain is declared so it is flushed and then one rule per serving upstream is added
+// The 'statistic' match in 'nth' mode is used for round-robin distribution
+// As only the first packet of a connection traverses the nat table, connections are distributed
+// In case there are no available upstreams the chain is left empty and the traffic
+// continues to be processed by the host
+func iptTargetRules(chain string, t *target, uChains map[*upstream]string) []string {
+	rules := []string{":" + chain + " - [0:0]"}
+
+	au := t.upstreamGroup.servingUpstreams()
+
+	for i, u := range au {
+		if i < len(au)-1 {
+			rules = append(rules, fmt.Sprintf(
+				"-A %s -m statistic --mode nth --every %d --packet 0 -j %s",
+				chain,
+				len(au)-i,
+				uChains[u],
+			))
+		} else {
+			rules = append(rules, fmt.Sprintf("-A %s -j %s", chain, uChains[u]))
+		}
+	}
+
+	return rules
+}
+
+// iptPrerRules returns the rules of the prerouting chain which jump to a target chain
+// There is one rule per target ingress interface, or a single rule for all interfaces if none is set
+func iptPrerRules(chain string, t *target, tChain string) []string {
+	rule := fmt.Sprintf(
+		"-A %s -p %s --dport %d %s -j %s",
+		chain,
+		t.protocol.String(),
+		t.port,
+		iptComment(t.name),
+		tChain,
+	)
+	if len(t.interfaces) == 0 {
+		return []string{rule}
+	}
+
+	var rules []string
+	for _, i := range t.interfaces {
+		rules = append(rules, fmt.Sprintf(
+			"-A %s -i %s -p %s --dport %d %s -j %s",
+			chain,
+			i,
+			t.protocol.String(),
+			t.port,
+			iptComment(t.name),
+			tChain,
+		))
+	}
+
+	return rules
+}
+
+// iptMasqueradeRules returns the rules of the postrouting chain
+// The chain is declared so it is flushed and a masquerade rule is added per unique upstream IPv4 address
+func iptMasqueradeRules(chain string, lip *[]net.IP) []string {
+	rules := []string{":" + chain + " - [0:0]"}
+
+	for _, ip := range findUniqueNetIp(lip) {
+		if ip.To4() == nil {
+			continue
+		}
+		rules = append(rules, fmt.Sprintf("-A %s -d %s/32 -j MASQUERADE", chain, ip.To4().String()))
+	}
+
+	return rules
+}
+
+// iptChainRegex returns the regex string to match the chain names of a given chain name prefix
+func iptChainRegex(prefix string) string {
+	return fmt.Sprintf(
+		lobbyIptChainPattern,
+		regexp.QuoteMeta(prefix),
+		len(iptChainTimeFormat)-1,
+	)
+}
+
+// iptInstanceChainRegex returns the regex string to match the chain names
+// of all the load balancers of a given instance identifier
+func iptInstanceChainRegex(instance string) string {
+	return fmt.Sprintf(
+		lobbyIptChainPattern,
+		instancePrefixRegex(instance),
+		len(iptChainTimeFormat)-1,
+	)
+}
+
+// prepareIptables checks if there are nat table chains which match the given chain name regex
+// If it finds a match it means this could be some leftover from a previous instance
+// The leftovers can happen for instance upon some kind of crash or uncontrolled failure
+// The function removes the jumps to those chains from the built-in chains and deletes them
+// The regex is scoped to the instance identifier, and to the load balancer name except on start-up cleanup
+func (n *ipt) prepareIptables(cnRegex string) error {
+	out, err := exec.Command(n.saveBin, iptSaveTableFlag, iptTable).Output()
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", errIptPrep, errIptSave, err)
+	}
+
+	rules := iptCleanupRules(out, regexp.MustCompile(cnRegex))
+	if len(rules) == 0 {
+		LogDf("IPT: iptables preparation completed")
+		return nil
+	}
+
+	LogDf(
+		"IPT: Found iptables chains matching the pattern (%s) lobby uses as chain name. Deleting the existing chains to not interfere",
+		cnRegex,
+	)
+	if err := n.pushIpt(rules); err != nil {
+		return fmt.Errorf("%w: %w", errIptPrep, err)
+	}
+
+	LogDf("IPT: iptables preparation completed")
+	return nil
+}
+
+// iptCleanupRules parses an iptables-save dump and returns the rules to delete the chains matching the regex
+// Rules from the built-in chains jumping to matching chains are deleted first
+// Then the matching chains are flushed and only after deleted, as they may reference each other
+func iptCleanupRules(dump []byte, regex *regexp.Regexp) []string {
+	var (
+		jumps  []string
+		chains []string
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(dump))
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+			cn := strings.Fields(line[1:])[0]
+			if regex.MatchString(cn) {
+				chains = append(chains, cn)
+			}
+		case strings.HasPrefix(line, "-A "+iptBuiltinPrerChain+" "),
+			strings.HasPrefix(line, "-A "+iptBuiltinPostrChain+" "):
+			f := strings.Fields(line)
+			if f[len(f)-2] == "-j" && regex.MatchString(f[len(f)-1]) {
+				jumps = append(jumps, "-D"+strings.TrimPrefix(line, "-A"))
+			}
+		}
+	}
+
+	rules := jumps
+	for _, cn := range chains {
+		rules = append(rules, "-F "+cn)
+	}
+	for _, cn := range chains {
+		rules = append(rules, "-X "+cn)
+	}
+
+	return rules
+}
+
+// start calls startOrReconfig as the same function can be used for either start or reconfig
+func (n *ipt) start(l *lb) error {
+	return n.startOrReconfig(l, false)
+}
+
+// startOrReconfig sets up the iptables chains based on the load balancer current definition
+// All chains and rules are applied in a single iptables-restore transaction
+// When reconfiguring, the new chains are inserted before the previous ones
+// so that at no point in time during the transition the traffic is left without rules
+func (n *ipt) startOrReconfig(l *lb, refresh bool) error {
+	if !refresh {
+		LogDf("IPT: iptables initialization requested")
+		if err := n.prepareIptables(iptChainRegex(l.resourcePrefix())); err != nil {
+			return fmt.Errorf("%w: %w", errIptInit, err)
+		}
+	} else {
+		LogDf("IPT: iptables reconfig requested")
+	}
+
+	n.prefix = l.resourcePrefix() + "-" + strings.ReplaceAll(time.Now().Format(iptChainTimeFormat), ".", "")
+	n.tChains = make(map[*target]string)
+	n.uChains = make(map[*upstream]string)
+	n.chains = []string{}
+
+	prerChain, err := n.chainName(iptPrerChainSuffix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errIptInit, err)
+	}
+	postrChain, err := n.chainName(iptPostrChainSuffix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errIptInit, err)
+	}
+	n.chains = append(n.chains, prerChain, postrChain)
+
+	var rules []string
+	rules = append(rules, iptMasqueradeRules(postrChain, l.upstreamIps)...)
+	rules = append(rules, ":"+prerChain+" - [0:0]")
+
+	for i, t := range l.targets {
+		tc, err := n.chainName(fmt.Sprintf("%s%d", iptTargetChainPrefix, i))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errIptInit, err)
+		}
+		n.tChains[t] = tc
+		n.chains = append(n.chains, tc)
+
+		for j, u := range t.upstreamGroup.upstreams {
+			uc, err := n.chainName(fmt.Sprintf("%s%d-%d", iptUpstreamChainPrefix, i, j))
+			if err != nil {
+				return fmt.Errorf("%w: %w", errIptInit, err)
+			}
+			n.uChains[u] = uc
+			n.chains = append(n.chains, uc)
+			rules = append(rules, iptUpstreamRules(uc, u)...)
+		}
+
+		rules = append(rules, iptTargetRules(tc, t, n.uChains)...)
+		rules = append(rules, iptPrerRules(prerChain, t, tc)...)
+	}
+
+	rules = append(rules,
+		fmt.Sprintf("-I %s 1 -j %s", iptBuiltinPrerChain, prerChain),
+		fmt.Sprintf("-I %s 1 -j %s", iptBuiltinPostrChain, postrChain),
+	)
+
+	if err := n.pushIpt(rules); err != nil {
+		return fmt.Errorf("%w: %w", errIptInit, err)
+	}
+	LogDf("IPT: added Load Balancer iptables chains with prefix '%s'", n.prefix)
+
+	return nil
+}
+
+// iptables load balancing is stopped by removing the jumps from the built-in chains
+// and then deleting all the chains created by the engine
+func (n *ipt) stop() error {
+	LogIf("IPT: a stop was requested. Initiating iptables cleanup")
+
+	prerChain, _ := n.chainName(iptPrerChainSuffix)
+	postrChain, _ := n.chainName(iptPostrChainSuffix)
+
+	rules := []string{
+		fmt.Sprintf("-D %s -j %s", iptBuiltinPrerChain, prerChain),
+		fmt.Sprintf("-D %s -j %s", iptBuiltinPostrChain, postrChain),
+	}
+	for _, cn := range n.chains {
+		rules = append(rules, "-F "+cn)
+	}
+	for _, cn := range n.chains {
+		rules = append(rules, "-X "+cn)
+	}
+
+	if err := n.pushIpt(rules); err != nil {
+		return fmt.Errorf("%w: %w", errIptStop, err)
+	}
+
+	return nil
+}
+
+// updateTarget rebuilds the target chain with the currently available upstreams
+func (n *ipt) updateTarget(t *target) error {
+	LogIf(
+		"IPT: Setting iptables for target '%s' (protocol %s on port %d)",
+		t.name,
+		t.protocol.String(),
+		t.port,
+	)
+
+	nActiveUpstreams := numActiveUpstreams(t)
+	if nActiveUpstreams == 0 {
+		LogIf("IPT: No upstreams available for target '%s'", t.name)
+	} else {
+		LogIf("IPT: %d/%d upstreams available for target '%s'", nActiveUpstreams, len(t.upstreamGroup.upstreams), t.name)
+	}
+
+	if err := n.pushIpt(iptTargetRules(n.tChains[t], t, n.uChains)); err != nil {
+		return fmt.Errorf("%w: %w", errIptUpdateTarget, err)
+	}
+
+	return nil
+}
+
+// updateUpstream refreshes the upstream chain with the new upstream address
+// The masquerade rules are refreshed in the same transaction
+func (n *ipt) updateUpstream(u *upstream, auip *[]net.IP) error {
+	LogDf("IPT: update for upstream '%s' requested", u.name)
+
+	postrChain, _ := n.chainName(iptPostrChainSuffix)
+
+	rules := iptUpstreamRules(n.uChains[u], u)
+	rules = append(rules, iptMasqueradeRules(postrChain, auip)...)
+
+	if err := n.pushIpt(rules); err != nil {
+		return fmt.Errorf("%w: %w", errIptUpdateUpstream, err)
+	}
+
+	return nil
+}
+
+// reconfig receives the new load balancer and deals with the iptables transition
+// from the previous configuration to the new one
+func (n *ipt) reconfig(nl *lb) error {
+	LogDVf("IPT: iptables reconfig was requested")
+	nn, ok := nl.e.(*ipt) // assert if it is an iptables lb engine
+	if !ok {
+		return fmt.Errorf("%w: %w", errIptReconfig, errIptAssert)
+	}
+
+	nn.restoreBin = n.restoreBin
+	nn.saveBin = n.saveBin
+
+	// request a reconfig for the new lb
+	if err := nn.startOrReconfig(nl, true); err != nil {
+		return fmt.Errorf("%w: %w", errIptReconfig, err)
+	}
+
+	// stop the old lb now that the new has been successfully configured
+	if err := n.stop(); err != nil {
+		return fmt.Errorf("%w: %w", errIptReconfig, err)
+	}
+
+	LogDVf("IPT: iptables reconfig was successfully completed")
+	return nil
+}
+
+// cleanup deletes the iptables chains left by any load balancer of the given instance identifier
+// The iptables binaries must have been looked up by checkDependencies
+func (n *ipt) cleanup(instance string) error {
+	if err := n.prepareIptables(iptInstanceChainRegex(instance)); err != nil {
+		return fmt.Errorf("%w: %w", errIptInit, err)
+	}
+
+	return nil
+}
+
+// getCapabilities provides the iptables supported lb capabilities
+func (n *ipt) getCapabilities() map[lbProto]map[distMode]bool {
+	return iptSuppCapabilities
+}
+
+// checkPermissions checks if the minimum required permissions have been granted
+// so the load balancer can run successfully. Otherwise, it returns a errCheckPerm error
+// CAP_NET_ADMIN and CAP_NET_RAW capabilities are required
+func (n *ipt) checkPermissions() error {
+	cs := cap.GetProc()
+
+	caps := []cap.Value{cap.NET_ADMIN, cap.NET_RAW}
+	flags := []cap.Flag{cap.Effective, cap.Permitted}
+
+	for _, c := range caps {
+		for _, f := range flags {
+			LogDVf("IPT: permission check: checking capability '%s' capability set '%s' ", c, f)
+			if err := checkCapabilities(cs, f, c); err != nil {
+				return fmt.Errorf("%w: %w: \n\n%w\n\n", errIptPerm, err, errIptPermCap)
+			}
+		}
+	}
+
+	LogDf("IPT: permissions check succeeded")
+	return nil
+}
+
+// checkDependencies checks if the iptables-restore and iptables-save binaries are available
+// The legacy binaries are preferred as this engine is meant for systems without nf_tables
+// IP forwarding is checked as for the nftables engine
+func (n *ipt) checkDependencies() error {
+	LogDf("Dependencies check: looking up iptables binaries")
+	for i, rb := range iptRestoreBins {
+		rp, err := exec.LookPath(rb)
+		if err != nil {
+			continue
+		}
+		sp, err := exec.LookPath(iptSaveBins[i])
+		if err != nil {
+			continue
+		}
+		LogDf("Dependencies check: using '%s' and '%s'", rp, sp)
+		n.restoreBin = rp
+		n.saveBin = sp
+
+		return checkIpFwdDependency()
+	}
+
+	return errIptDep
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIptChainName(t *testing.T) {
+	n := &ipt{prefix: "Lobby-150405000"}
+
+	cn, err := n.chainName("U1-2")
+	if err != nil {
+		t.Errorf("chainName errored unexpectedly: '%v'", err)
+	}
+	if cn != "Lobby-150405000-U1-2" {
+		t.Errorf("expected '%s', but got '%s'", "Lobby-150405000-U1-2", cn)
+	}
+
+	_, err = n.chainName(strings.Repeat("U", iptMaxChainNameLen))
+	if !errors.Is(err, errIptChainName) {
+		t.Errorf("expected '%v', but got '%v'", errIptChainName, err)
+	}
+}
+
+func TestIptMaxChainName(t *testing.T) {
+	lbc := &LbConfig{TargetsConfig: make([]TargetsConfig, 11)}
+	lbc.TargetsConfig[10].UpstreamGroup.Upstreams = make([]UpstreamsConfig, 12)
+
+	testCases := []struct {
+		name   string
+		prefix string
+		lbc    *LbConfig
+		result string
+	}{
+		{name: "no targets", prefix: "Lobby", lbc: &LbConfig{}, result: "Lobby-000000000-POSTR"},
+		{name: "targets", prefix: "Lobby", lbc: lbc, result: "Lobby-000000000-U10-11"},
+		{name: "instance", prefix: "Lobby-tenant1", lbc: lbc, result: "Lobby-tenant1-000000000-U10-11"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if cn := iptMaxChainName(tc.prefix, tc.lbc); cn != tc.result {
+				t.Errorf("expected '%s', but got '%s'", tc.result, cn)
+			}
+		})
+	}
+}
+
+func TestIptTargetRules(t *testing.T) {
+	u1 := &upstream{name: "u1", available: true}
+	u2 := &upstream{name: "u2", available: false}
+	u3 := &upstream{name: "u3", available: true}
+	u4 := &upstream{name: "u4", available: true}
+	tg := &target{
+		name: "t",
+		upstreamGroup: &upstreamGroup{
+			upstreams: []*upstream{u1, u2, u3, u4},
+		},
+	}
+	uChains := map[*upstream]string{u1: "U1", u2: "U2", u3: "U3", u4: "U4"}
+
+	expected := []string{
+		":T - [0:0]",
+		"-A T -m statistic --mode nth --every 3 --packet 0 -j U1",
+		"-A T -m statistic --mode nth --every 2 --packet 0 -j U3",
+		"-A T -j U4",
+	}
+	if r := iptTargetRules("T", tg, uChains); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+
+	// no upstreams available
+	u1.available, u3.available, u4.available = false, false, false
+	expected = []string{":T - [0:0]"}
+	if r := iptTargetRules("T", tg, uChains); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+}
+
+func TestIptPrerRules(t *testing.T) {
+	tg := &target{name: "t", protocol: lbProtoTcp, port: 443}
+
+	expected := []string{
+		`-A P -p tcp --dport 443 -m comment --comment "t" -j T`,
+	}
+	if r := iptPrerRules("P", tg, "T"); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+
+	// ingress interfaces
+	tg.interfaces = []string{"eth1", "eth2"}
+	expected = []string{
+		`-A P -i eth1 -p tcp --dport 443 -m comment --comment "t" -j T`,
+		`-A P -i eth2 -p tcp --dport 443 -m comment --comment "t" -j T`,
+	}
+	if r := iptPrerRules("P", tg, "T"); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+}
+
+func TestIptUpstreamRules(t *testing.T) {
+	u := &upstream{name: "u1", protocol: lbProtoTcp, port: 8080, address: net.ParseIP("1.1.1.1")}
+
+	expected := []string{
+		":U - [0:0]",
+		`-A U -p tcp -m comment --comment "u1" -j DNAT --to-destination 1.1.1.1:8080`,
+	}
+	if r := iptUpstreamRules("U", u); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+
+	// unresolved upstream
+	u.address = nil
+	expected = []string{":U - [0:0]"}
+	if r := iptUpstreamRules("U", u); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+}
+
+func TestIptMasqueradeRules(t *testing.T) {
+	lip := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("2606:4700::1111"), net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")}
+
+	expected := []string{
+		":P - [0:0]",
+		"-A P -d 1.1.1.1/32 -j MASQUERADE",
+		"-A P -d 2.2.2.2/32 -j MASQUERADE",
+	}
+	if r := iptMasqueradeRules("P", &lip); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+}
+
+func TestIptCleanupRules(t *testing.T) {
+	dump := `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:Lobby-150405000-PRER - [0:0]
+:Lobby-150405000-T0 - [0:0]
+:Other - [0:0]
+-A PREROUTING -j Lobby-150405000-PRER
+-A PREROUTING -j Other
+-A Lobby-150405000-PRER -p tcp -m tcp --dport 80 -j Lobby-150405000-T0
+COMMIT
+`
+	expected := []string{
+		"-D PREROUTING -j Lobby-150405000-PRER",
+		"-F Lobby-150405000-PRER",
+		"-F Lobby-150405000-T0",
+		"-X Lobby-150405000-PRER",
+		"-X Lobby-150405000-T0",
+	}
+
+	r := iptCleanupRules([]byte(dump), regexp.MustCompile(iptChainRegex(lobbySettings.appName)))
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected '%v', but got '%v'", expected, r)
+	}
+}
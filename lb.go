@@ -6,7 +6,9 @@ import (
 	"math/rand"
 	"net"
 	"os"
-	"strconv"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -18,7 +20,20 @@ import (
 var (
 	// Currently supported healtcheck protocol
 	supHcProto = map[hcProto]bool{
-		hcProtoTcp: true, // TCP
+		hcProtoTcp:           true, // TCP
+		hcProtoHttp:          true, // HTTP
+		hcProtoHttps:         true, // HTTPS
+		hcProtoGrpc:          true, // gRPC
+		hcProtoUdp:           true, // UDP
+		hcProtoTcpSendExpect: true, // TCP send/expect steps
+		hcProtoRedis:         true, // Redis
+		hcProtoMysql:         true, // MySQL
+		hcProtoPostgres:      true, // PostgreSQL
+		hcProtoSmtp:          true, // SMTP
+		hcProtoFtp:           true, // FTP
+		hcProtoIcmp:          true, // ICMP and ICMPv6 echo
+		hcProtoDns:           true, // DNS query
+		hcProtoExec:          true, // external command
 	}
 )
 
@@ -36,6 +51,7 @@ type lbEngine interface {
 	reconfig(*lb) error                             // reconfigures lb
 	updateTarget(*target) error                     // updates given target
 	updateUpstream(*upstream, *[]net.IP) error      // updates given upstream
+	cleanup(string) error                           // deletes the leftovers of all the instance load balancers
 }
 
 // Load balancer state
@@ -47,31 +63,53 @@ type lbState struct {
 
 // Load balancer
 type lb struct {
-	targets     []*target    // list of all load balancer targets
-	e           lbEngine     // load balancer engine
-	et          lbEngineType // load balancer engine type
-	upstreamIps *[]net.IP    // list of all upstream IP addresses
-	state       lbState      // load balancer state
+	name        string        // load balancer name. Optional, unless there are several load balancers with the same engine type
+	targets     []*target     // list of all load balancer targets
+	e           lbEngine      // load balancer engine
+	et          lbEngineType  // load balancer engine type
+	upstreamIps *[]net.IP     // list of all upstream IP addresses
+	state       lbState       // load balancer state
+	chCcStop    chan struct{} // channel to listen to connections count check stop requests
+	chOdStop    chan struct{} // channel to listen to outlier detection stop requests
+}
+
+// Load balancer identity
+// Load balancers are identified by their engine type and name
+type lbId struct {
+	et   lbEngineType // load balancer engine type
+	name string       // load balancer name
 }
 
 // iota constants
 type (
 	distMode     byte  // distribution mode
+	distHash     byte  // distribution hash input
 	lbEngineType uint8 // load balancer engine type
 	lbProto      uint8 // load balancer protocol
 )
 
 // distribution mode
 const (
-	distModeUnknown  distMode = iota // undefined
-	distModeRR                       // round robin
-	distModeWeighted                 // weighted
+	distModeUnknown   distMode = iota // undefined
+	distModeRR                        // round robin
+	distModeWeighted                  // weighted
+	distModeMaglev                    // maglev consistent hashing
+	distModeLeastConn                 // least connections
+)
+
+// distribution hash input. Used by the hash based distribution modes
+const (
+	distHashUnknown   distHash = iota // undefined
+	distHashSrcAddr                   // source address
+	distHashFiveTuple                 // source and destination address and port, for the target protocol
 )
 
 const (
 	lbEngineUnknown lbEngineType = iota // undefined
 	lbEngineTest                        // test engine
 	lbEngineNft                         // nftables
+	lbEngineIpt                         // iptables
+	lbEngineUsp                         // userspace
 )
 
 // Loadbalancer protocols
@@ -98,7 +136,40 @@ var (
 		"Error when unmarshaling yaml config file",
 	)
 	errConfRepEngine = errors.New(
-		"Error in configuration. Found repeated engine type. All config of a given engine type must be included in a single mapping",
+		"Error in configuration. Found repeated engine type and load balancer name. Load balancers with the same engine type must have unique names",
+	)
+	errConfLbName = errors.New(
+		"Error in configuration. Found invalid load balancer name. Only letters, digits and '_' are allowed",
+	)
+	errConfInstance = errors.New(
+		"Error in configuration. Found invalid instance identifier. Only letters, digits and '_' are allowed",
+	)
+	errConfFwmark = errors.New(
+		"Error in configuration. Firewall marks are only supported by the nftables engine",
+	)
+	errConfInterface = errors.New(
+		"Error in configuration. Found invalid target interface name",
+	)
+	errConfInterfaceUsp = errors.New(
+		"Error in configuration. Target interfaces are not supported by the userspace engine",
+	)
+	errConfPersistence = errors.New(
+		"Error in configuration. Client persistence is only supported by the nftables engine and requires a 'timeout'",
+	)
+	errConfPersistMode = errors.New(
+		"Error in configuration. Found invalid client persistence type",
+	)
+	errConfProxyProtocol = errors.New(
+		"Error in configuration. Found invalid target PROXY protocol. Chose one of 'none', 'v1', 'v2'. The PROXY protocol is only supported by the userspace engine for tcp targets",
+	)
+	errConfRoutes = errors.New(
+		"Error in configuration. Target routes are only supported by the userspace engine",
+	)
+	errConfRouteSni = errors.New(
+		"Error in configuration. Found invalid route SNI. tcp target routes require a list of domain names, optionally prefixed with '*.'",
+	)
+	errConfRouteHttp = errors.New(
+		"Error in configuration. Found invalid HTTP route. http target routes require a list of hosts, optionally prefixed with '*.', and/or a path prefix starting with '/'",
 	)
 	errConfRepTargetName = errors.New(
 		"Error in configuration. Found repeated target name. Every target name must be unique",
@@ -127,6 +198,9 @@ var (
 	errConfHcProtocol = errors.New(
 		"Error in configuration. Found unsupported upstream healthcheck protocol",
 	)
+	errConfHcSettings = errors.New(
+		"Error in configuration. Found invalid upstream health check settings",
+	)
 	errConfProbePort = errors.New(
 		"Error in configuration. Found problematic health check probe port",
 	)
@@ -139,9 +213,30 @@ var (
 	errConfProbeTimeout = errors.New(
 		"Error in configuration. Found problematic health check timeout value",
 	)
+	errConfProbeBackoff = errors.New(
+		"Error in configuration. Found problematic health check backoff definition",
+	)
+	errConfDampening = errors.New(
+		"Error in configuration. Found problematic upstream flap dampening definition",
+	)
+	errConfMinHealthy = errors.New(
+		"Error in configuration. Found problematic upstream group 'min_healthy_percent'. It must be a percentage between 0 and 100",
+	)
+	errConfOutlier = errors.New(
+		"Error in configuration. Found problematic outlier detection definition. Outlier detection is only supported for tcp and http targets",
+	)
+	errConfDistHash = errors.New(
+		"Error in configuration. Found unsupported distribution hash",
+	)
+	errConfIpv6 = errors.New(
+		"Error in configuration. Found IPv6 target or upstream address. IPv6 is not supported by the iptables engine",
+	)
 	errDistMode = errors.New(
 		"distribution mode not found",
 	)
+	errDistHash = errors.New(
+		"distribution hash not found",
+	)
 	errLbEngineType = errors.New(
 		"Error requesting unknown engine type",
 	)
@@ -184,6 +279,10 @@ func getDistMode(dm string) (distMode, error) {
 		return distModeRR, nil
 	case "weighted":
 		return distModeWeighted, nil
+	case "maglev":
+		return distModeMaglev, nil
+	case "least-connections":
+		return distModeLeastConn, nil
 	}
 	return distModeUnknown, fmt.Errorf("'%s' '%w'", dm, errDistMode)
 }
@@ -195,6 +294,33 @@ func (dm distMode) String() string {
 		return "round-robin"
 	case distModeWeighted:
 		return "weighted"
+	case distModeMaglev:
+		return "maglev"
+	case distModeLeastConn:
+		return "least-connections"
+	}
+	return "unknown"
+}
+
+// getDistHash returns the distHash (distribution hash input) from a string
+// The source address is used when not defined
+func getDistHash(dh string) (distHash, error) {
+	switch dh {
+	case "", "source-address":
+		return distHashSrcAddr, nil
+	case "5-tuple":
+		return distHashFiveTuple, nil
+	}
+	return distHashUnknown, fmt.Errorf("'%s' '%w'", dh, errDistHash)
+}
+
+// returns the string value of the distHash (distribution hash input)
+func (dh distHash) String() string {
+	switch dh {
+	case distHashSrcAddr:
+		return "source-address"
+	case distHashFiveTuple:
+		return "5-tuple"
 	}
 	return "unknown"
 }
@@ -206,6 +332,10 @@ func getLbEngineType(lbet string) (lbEngineType, error) {
 		return lbEngineTest, nil
 	case "nftables":
 		return lbEngineNft, nil
+	case "iptables":
+		return lbEngineIpt, nil
+	case "userspace":
+		return lbEngineUsp, nil
 	}
 	return lbEngineUnknown, errLbEngineType
 }
@@ -217,6 +347,10 @@ func newLbEngine(lbet lbEngineType) (lbEngine, error) {
 		return &testLb{}, nil
 	case lbEngineNft: // nftables
 		return &nft{}, nil
+	case lbEngineIpt: // iptables
+		return &ipt{}, nil
+	case lbEngineUsp: // userspace
+		return &usp{}, nil
 	}
 	return nil, errLbEngineType
 }
@@ -228,6 +362,10 @@ func (lbet lbEngineType) String() string {
 		return "testEngine"
 	case lbEngineNft:
 		return "nftables"
+	case lbEngineIpt:
+		return "iptables"
+	case lbEngineUsp:
+		return "userspace"
 	}
 
 	return "unknown"
@@ -258,10 +396,61 @@ func (lbp lbProto) String() string {
 		return "udp"
 	case lbProtoSctp:
 		return "sctp"
+	case lbProtoHttp:
+		return "http"
 	}
 	return "unknown"
 }
 
+// id returns the load balancer identity
+func (l *lb) id() lbId {
+	return lbId{et: l.et, name: l.name}
+}
+
+// returns the string value of the load balancer identity
+// It is the engine type, followed by the load balancer name when set
+func (id lbId) String() string {
+	if id.name == "" {
+		return id.et.String()
+	}
+
+	return id.et.String() + "/" + id.name
+}
+
+// returns the string value of the load balancer
+func (l *lb) String() string {
+	return l.id().String()
+}
+
+// resourcePrefix returns the prefix to be used by the load balancer engines when naming
+// the kernel resources (tables, chains) they create
+// It is made of the app name, followed by the instance identifier prefixed with '-' and the load balancer name prefixed with '.' when set
+// As neither may contain '-' or '.', the prefixes of different instances and load balancers never match each other
+// This allows several load balancers and several lobby instances to coexist on the same host
+// without interfering with each others resources
+func (l *lb) resourcePrefix() string {
+	return resourcePrefix(lobbySettings.instance, l.name)
+}
+
+// resourcePrefix returns the resource name prefix for a given instance identifier and load balancer name
+func resourcePrefix(instance, name string) string {
+	p := lobbySettings.appName
+	if instance != "" {
+		p += "-" + instance
+	}
+	if name != "" {
+		p += "." + name
+	}
+
+	return p
+}
+
+// instancePrefixRegex returns the regex string to match the resource name prefixes
+// of all the load balancers of a given instance identifier, whatever their name
+func instancePrefixRegex(instance string) string {
+	return regexp.QuoteMeta(resourcePrefix(instance, "")) + `(\.\w+)?`
+}
+
 // addUpstreamIps adds the provided IP address to the lb.upstreamIps slice
 // holding all load blancer upstream IP addresses
 func (l *lb) addUpstreamIps(nip net.IP) {
@@ -299,9 +488,11 @@ func (l *lb) replaceUpstreamIps(oip *net.IP, nip *net.IP) error {
 
 // checkConfig checks the configuration file
 // It verifies that:
+//   - the instance identifier and load balancer names are valid
 //   - only supported engine types are configured
-//   - all engine types, target, upstream group and upstream names are unique
-//   - targets do not have conflicting port/protocol configuration
+//   - all engine type and load balancer name pairs are unique
+//   - all target, upstream group and upstream names are unique
+//   - targets do not have conflicting port/protocol configuration across all load balancers
 //   - target protocols are supported by the engine
 //   - the configured distribution mode is supported as defined in global var supDM
 //   - the host format is valid
@@ -312,42 +503,68 @@ func (l *lb) replaceUpstreamIps(oip *net.IP, nip *net.IP) error {
 func checkConfig(configYaml *ConfigYaml) error {
 	LogDVf("LB: configuration check")
 	var (
-		eNames  []string
+		lbIds   []lbId
 		tNames  []string
 		uNames  []string
 		ugNames []string
 	)
 
-	for i, lbc := range configYaml.LbConfig {
+	// Check instance identifier
+	if configYaml.Instance != "" && !isResourceName(configYaml.Instance) {
+		return fmt.Errorf("%w: %w: problematic instance in config: %s", errLbCheckConf, errConfInstance, configYaml.Instance)
+	}
+
+	// The instance identifier is set once, so the running one is used if already set
+	instance := configYaml.Instance
+	if lobbySettings.instanceSet {
+		instance = lobbySettings.instance
+	}
+
+	// Create a map with the port number as the key and slice of strings for the protocol value
+	// It is shared by all load balancers as their targets can't overlap
+	portMap := make(map[uint16][]string)
+
+	for _, lbc := range configYaml.LbConfig {
 		// Check load balancer engine
 		lbE, err := getLbEngineType(lbc.Engine)
 		if err != nil {
 			return fmt.Errorf("%w: %w", errLbCheckConf, err)
 		}
-		lben := lbE.String()
 
-		LogDVf("LB: checking '%s' load balancer engine uniqueness", lben)
-		if i == 0 {
-			// Initialize temporary var
-			eNames = append(eNames, lben)
-		} else {
-			for _, en := range eNames {
-				if en == lben {
-					LogDf("LB: found a repeated engine type: %s", lbc.Engine)
-					return fmt.Errorf("%w: %w: problematic engine in config: %s", errLbCheckConf, errConfRepEngine, lbc.Engine)
-				}
+		// Check load balancer name
+		if lbc.Name != "" && !isResourceName(lbc.Name) {
+			return fmt.Errorf("%w: %w: problematic load balancer name in config: %s", errLbCheckConf, errConfLbName, lbc.Name)
+		}
+
+		id := lbId{et: lbE, name: lbc.Name}
+		LogDVf("LB: checking '%s' load balancer uniqueness", id.String())
+		for _, lid := range lbIds {
+			if lid == id {
+				LogDf("LB: found a repeated engine type and load balancer name: %s", id.String())
+				return fmt.Errorf("%w: %w: problematic engine in config: %s", errLbCheckConf, errConfRepEngine, id.String())
+			}
+		}
+		lbIds = append(lbIds, id)
+
+		// Check iptables chain names length
+		if lbE == lbEngineIpt {
+			if cn := iptMaxChainName(resourcePrefix(instance, lbc.Name), &lbc); len(cn) > iptMaxChainNameLen {
+				return fmt.Errorf(
+					"%w: %w: '%s' for load balancer '%s'. Use a shorter instance identifier or load balancer name",
+					errLbCheckConf,
+					errIptChainName,
+					cn,
+					id.String(),
+				)
 			}
 		}
 
 		e, _ := newLbEngine(lbE)
 		ec := e.getCapabilities()
 
-		// Create a map with the port number as the key and slice of strings for the protocol value
-		portMap := make(map[uint16][]string)
-
 		for i, t := range lbc.TargetsConfig {
 			LogDVf("LB: target '%s' check", t.Name)
-			if i == 0 {
+			if i == 0 && len(tNames) == 0 {
 				// Initialize temporary vars
 				tNames = append(tNames, t.Name)
 				portMap[t.Port] = append(portMap[t.Port], t.Protocol)
@@ -371,9 +588,8 @@ func checkConfig(configYaml *ConfigYaml) error {
 							return fmt.Errorf("%w: %w: Problematic port/protocol: %d/%s", errLbCheckConf, errConfRepPortProto, t.Port, t.Protocol)
 						}
 					}
-				} else {
-					portMap[t.Port] = append(portMap[t.Port], t.Protocol)
 				}
+				portMap[t.Port] = append(portMap[t.Port], t.Protocol)
 
 				// Check if upstreamGroup names are unique
 				for _, ugn := range ugNames {
@@ -386,6 +602,21 @@ func checkConfig(configYaml *ConfigYaml) error {
 
 			}
 
+			// Check target interfaces
+			for _, i := range t.Interfaces {
+				if !isInterfaceName(i) {
+					return fmt.Errorf("%w: %w: problematic interface '%s' for target '%s'", errLbCheckConf, errConfInterface, i, t.Name)
+				}
+			}
+			if len(t.Interfaces) != 0 && lbE == lbEngineUsp {
+				return fmt.Errorf("%w: %w: problematic interfaces for target '%s' with engine '%s'", errLbCheckConf, errConfInterfaceUsp, t.Name, lbE.String())
+			}
+
+			// Check target IP address family
+			if ip := net.ParseIP(t.Ip); ip != nil && ip.To4() == nil && lbE == lbEngineIpt {
+				return fmt.Errorf("%w: %w: problematic ip '%s' for target '%s' with engine '%s'", errLbCheckConf, errConfIpv6, t.Ip, t.Name, lbE.String())
+			}
+
 			// Check target protocol
 			tP, err := getLbProtocol(t.Protocol)
 			if err != nil {
@@ -406,123 +637,293 @@ func checkConfig(configYaml *ConfigYaml) error {
 				)
 			}
 
-			// Check if upstreamGroup distribution mode is supported
-			dMode, _ := getDistMode(t.UpstreamGroup.Distribution)
-			if _, ok := ec[tP][dMode]; !ok {
-				var supDms []string
-				for dm := range ec[tP] {
-					supDms = append(supDms, fmt.Sprintf("'%s'", dm.String()))
-				}
-				return fmt.Errorf(
-					"%w: %w: unsupported distribution mode: %s. Chose one of the supported modes: %s",
-					errLbCheckConf,
-					errConfDistMode,
-					t.UpstreamGroup.Distribution,
-					strings.Join(supDms, ", "),
-				)
+			// Check target PROXY protocol
+			if pp, err := getProxyProto(t.ProxyProtocol); err != nil || (pp != proxyProtoNone && (lbE != lbEngineUsp || tP != lbProtoTcp)) {
+				return fmt.Errorf("%w: %w: problematic proxy_protocol '%s' for target '%s' with engine '%s'", errLbCheckConf, errConfProxyProtocol, t.ProxyProtocol, t.Name, lbE.String())
+			}
+
+			// Check upstreamGroup
+			if err := checkUpstreamGroupConfig(&t.UpstreamGroup, lbE, ec, tP, &uNames); err != nil {
+				return err
 			}
 
-			// Check upstreams
-			for _, u := range t.UpstreamGroup.Upstreams {
-				LogDVf("LB: upstream '%s' check", u.Name)
+			// Check target routes
+			if len(t.Routes) != 0 && lbE != lbEngineUsp {
+				return fmt.Errorf("%w: %w: problematic routes for target '%s' with engine '%s'", errLbCheckConf, errConfRoutes, t.Name, lbE.String())
+			}
+			for _, r := range t.Routes {
+				if err := checkRouteConfig(&r, tP); err != nil {
+					return fmt.Errorf("%w: %w: problematic route for target '%s'", errLbCheckConf, err, t.Name)
+				}
 
-				// Check if upstream names are unique
-				if len(uNames) == 0 {
-					uNames = append(uNames, u.Name)
-				} else {
-					for _, un := range uNames {
-						if un == u.Name {
-							LogDf("Found a repeated upstream name: %s", un)
-							return fmt.Errorf("%w: %w: Problematic upstream name: %s", errLbCheckConf, errConfRepUName, un)
-						}
+				// Check if upstreamGroup names are unique
+				for _, ugn := range ugNames {
+					if ugn == r.UpstreamGroup.Name {
+						LogDf("LB: found a repeated upstream group name in config: %s", ugn)
+						return fmt.Errorf("%w: %w: Problematic upstream group name: %s", errLbCheckConf, errConfRepUGName, ugn)
 					}
-					uNames = append(uNames, u.Name)
 				}
+				ugNames = append(ugNames, r.UpstreamGroup.Name)
 
-				// Check upstream host
-				uh, _ := getHostType(u.Host)
-				if uh == hostTypeUnknown {
-					return fmt.Errorf(
-						"%w: %w: host '%s' for upstream '%s' is invalid. Set a valid host in the FQDN, IPv4 or IPv6 format",
-						errLbCheckConf,
-						errConfUHost,
-						u.Host,
-						u.Name,
-					)
+				if err := checkUpstreamGroupConfig(&r.UpstreamGroup, lbE, ec, tP, &uNames); err != nil {
+					return err
 				}
+			}
+		}
+	}
 
-				// Check upstream healthcheck:
-				// - protocol
-				// - port
-				// - check_interval
-				// - success_count
-				// - timeout
-				if u.HealthCheck != (HealthCheckConfig{}) {
-					hcP, _ := getHcProto(u.HealthCheck.Protocol)
-					if _, ok := supHcProto[hcP]; !ok {
-						var supHcP []string
-						for p := range supHcProto {
-							supHcP = append(supHcP, fmt.Sprintf("'%s'", p.String()))
-						}
-						return fmt.Errorf(
-							"%w: %w: unsupported upstream healthcheck protocol '%s' for upstream '%s'. Chose one of the supported protocols: %s",
-							errLbCheckConf,
-							errConfHcProtocol,
-							u.HealthCheck.Protocol,
-							u.Name,
-							strings.Join(supHcP, ", "),
-						)
-					}
+	return nil
+}
 
-					if u.HealthCheck.Port == 0 {
-						return fmt.Errorf("%w: %w: health check probe 'port' for upstream '%s' must be correctly defined",
-							errLbCheckConf,
-							errConfProbePort,
-							u.Name)
-					}
+// checkRouteConfig checks the route criteria for a target protocol
+// tcp targets route by TLS server name and http targets route by host and path prefix
+func checkRouteConfig(rc *RouteConfig, tP lbProto) error {
+	switch tP {
+	case lbProtoTcp:
+		if len(rc.Sni) == 0 || len(rc.Host) != 0 || rc.PathPrefix != "" {
+			return errConfRouteSni
+		}
+		for _, sn := range rc.Sni {
+			if !isSniPattern(sn) {
+				return fmt.Errorf("%w: '%s'", errConfRouteSni, sn)
+			}
+		}
+	case lbProtoHttp:
+		if len(rc.Sni) != 0 || (len(rc.Host) == 0 && rc.PathPrefix == "") {
+			return errConfRouteHttp
+		}
+		for _, h := range rc.Host {
+			if !isSniPattern(h) {
+				return fmt.Errorf("%w: '%s'", errConfRouteHttp, h)
+			}
+		}
+		if rc.PathPrefix != "" && !isPathPrefix(rc.PathPrefix) {
+			return fmt.Errorf("%w: '%s'", errConfRouteHttp, rc.PathPrefix)
+		}
+	default:
+		return errConfRoutes
+	}
 
-					if u.HealthCheck.Probe.CheckInterval == 0 {
-						return fmt.Errorf("%w: %w: health check probe 'check_interval' for upstream '%s' must be defined",
-							errLbCheckConf,
-							errConfProbeCI,
-							u.Name)
-					}
+	return nil
+}
 
-					if u.HealthCheck.Probe.Count == 0 {
-						return fmt.Errorf("%w: %w: health check probe 'success_count' for upstream '%s' must be defined",
-							errLbCheckConf,
-							errConfProbeSC,
-							u.Name)
-					}
+// checkUpstreamGroupConfig checks the configuration of an upstream group and its upstreams
+// The upstream names are checked for uniqueness against and added to uNames
+// It returns a errLbCheckConf error if check fails
+func checkUpstreamGroupConfig(
+	ugc *UpstreamGroupConfig,
+	lbE lbEngineType,
+	ec map[lbProto]map[distMode]bool,
+	tP lbProto,
+	uNames *[]string,
+) error {
+	// Check if upstreamGroup distribution mode is supported
+	dMode, _ := getDistMode(ugc.Distribution)
+	if _, ok := ec[tP][dMode]; !ok {
+		var supDms []string
+		for dm := range ec[tP] {
+			supDms = append(supDms, fmt.Sprintf("'%s'", dm.String()))
+		}
+		return fmt.Errorf(
+			"%w: %w: unsupported distribution mode: %s. Chose one of the supported modes: %s",
+			errLbCheckConf,
+			errConfDistMode,
+			ugc.Distribution,
+			strings.Join(supDms, ", "),
+		)
+	}
 
-					if u.HealthCheck.Probe.Timeout == 0 {
-						return fmt.Errorf("%w: %w: health check probe 'timeout' for upstream '%s' must be defined",
-							errLbCheckConf,
-							errConfProbeTimeout,
-							u.Name)
-					}
+	// Check upstreamGroup distribution hash
+	if _, err := getDistHash(ugc.Hash); err != nil {
+		return fmt.Errorf(
+			"%w: %w: unsupported distribution hash '%s' for upstream group '%s'. Chose one of: 'source-address', '5-tuple'",
+			errLbCheckConf,
+			errConfDistHash,
+			ugc.Hash,
+			ugc.Name,
+		)
+	}
+
+	// Check upstreamGroup client persistence
+	pMode, err := getPersistMode(ugc.Persistence.Type)
+	if err != nil {
+		return fmt.Errorf(
+			"%w: %w: unsupported persistence type '%s' for upstream group '%s'. Chose one of: 'none', 'source-address'",
+			errLbCheckConf,
+			errConfPersistMode,
+			ugc.Persistence.Type,
+			ugc.Name,
+		)
+	}
+	if pMode != persistModeNone && (lbE != lbEngineNft || ugc.Persistence.Timeout == 0) {
+		return fmt.Errorf("%w: %w: problematic persistence for upstream group '%s' with engine '%s'", errLbCheckConf, errConfPersistence, ugc.Name, lbE.String())
+	}
+
+	// Check upstreamGroup min healthy percentage
+	if ugc.MinHealthyPct > 100 {
+		return fmt.Errorf("%w: %w: %d for upstream group '%s'", errLbCheckConf, errConfMinHealthy, ugc.MinHealthyPct, ugc.Name)
+	}
+
+	// Check upstreamGroup outlier detection
+	if ugc.OutlierDetection != nil {
+		if tP != lbProtoTcp && tP != lbProtoHttp {
+			return fmt.Errorf("%w: %w: unsupported outlier detection for upstream group '%s' with protocol '%s'", errLbCheckConf, errConfOutlier, ugc.Name, tP.String())
+		}
+		if _, err := getOutlierDetection(ugc.OutlierDetection); err != nil {
+			return fmt.Errorf("%w: %w: problematic outlier detection for upstream group '%s': %w", errLbCheckConf, errConfOutlier, ugc.Name, err)
+		}
+	}
+
+	// Check upstreams
+	for _, u := range ugc.Upstreams {
+		LogDVf("LB: upstream '%s' check", u.Name)
+
+		// Check upstream firewall mark
+		if upstreamFwmark(ugc, &u) != 0 && lbE != lbEngineNft {
+			return fmt.Errorf("%w: %w: problematic 'fwmark' for upstream '%s' with engine '%s'", errLbCheckConf, errConfFwmark, u.Name, lbE.String())
+		}
+
+		// Check if upstream names are unique
+		if len(*uNames) == 0 {
+			*uNames = append(*uNames, u.Name)
+		} else {
+			for _, un := range *uNames {
+				if un == u.Name {
+					LogDf("Found a repeated upstream name: %s", un)
+					return fmt.Errorf("%w: %w: Problematic upstream name: %s", errLbCheckConf, errConfRepUName, un)
 				}
+			}
+			*uNames = append(*uNames, u.Name)
+		}
 
-				// Check DNS addresses
-				for _, a := range u.Dns.Servers {
-					if net.ParseIP(a) == nil {
-						LogDf("Invalid DNS address: %s", a)
-						return fmt.Errorf(
-							"%w: %w: Problematic DNS address: %s",
-							errLbCheckConf,
-							errConfDnsAddr,
-							a,
-						)
-					}
+		// Check upstream host
+		uh, _ := getHostType(u.Host)
+		if uh == hostTypeUnknown {
+			return fmt.Errorf(
+				"%w: %w: host '%s' for upstream '%s' is invalid. Set a valid host in the FQDN, IPv4 or IPv6 format",
+				errLbCheckConf,
+				errConfUHost,
+				u.Host,
+				u.Name,
+			)
+		}
+		if uh == hostTypeIPv6 && lbE == lbEngineIpt {
+			return fmt.Errorf("%w: %w: problematic host '%s' for upstream '%s' with engine '%s'", errLbCheckConf, errConfIpv6, u.Host, u.Name, lbE.String())
+		}
+
+		// Check upstream healthcheck:
+		// - protocol
+		// - port
+		// - check_interval
+		// - success_count
+		// - timeout
+		if u.HealthCheck != (HealthCheckConfig{}) {
+			hcP, _ := getHcProto(u.HealthCheck.Protocol)
+			if _, ok := supHcProto[hcP]; !ok {
+				var supHcP []string
+				for p := range supHcProto {
+					supHcP = append(supHcP, fmt.Sprintf("'%s'", p.String()))
+				}
+				return fmt.Errorf(
+					"%w: %w: unsupported upstream healthcheck protocol '%s' for upstream '%s'. Chose one of the supported protocols: %s",
+					errLbCheckConf,
+					errConfHcProtocol,
+					u.HealthCheck.Protocol,
+					u.Name,
+					strings.Join(supHcP, ", "),
+				)
+			}
+
+			// Check upstream healthcheck protocol settings
+			hc := healthCheck{protocol: hcP, timeout: u.HealthCheck.Probe.Timeout}
+			if err := hc.setProbe(&u.HealthCheck, u.Host); err != nil {
+				return fmt.Errorf("%w: %w: %w: problematic health check for upstream '%s'", errLbCheckConf, errConfHcSettings, err, u.Name)
+			}
+
+			if u.HealthCheck.Port == 0 && hcP != hcProtoIcmp {
+				return fmt.Errorf("%w: %w: health check probe 'port' for upstream '%s' must be correctly defined",
+					errLbCheckConf,
+					errConfProbePort,
+					u.Name)
+			}
+
+			if u.HealthCheck.Probe.CheckInterval == 0 {
+				return fmt.Errorf("%w: %w: health check probe 'check_interval' for upstream '%s' must be defined",
+					errLbCheckConf,
+					errConfProbeCI,
+					u.Name)
+			}
+
+			if u.HealthCheck.Probe.Count == 0 {
+				return fmt.Errorf("%w: %w: health check probe 'success_count' for upstream '%s' must be defined",
+					errLbCheckConf,
+					errConfProbeSC,
+					u.Name)
+			}
+
+			if u.HealthCheck.Probe.Timeout == 0 {
+				return fmt.Errorf("%w: %w: health check probe 'timeout' for upstream '%s' must be defined",
+					errLbCheckConf,
+					errConfProbeTimeout,
+					u.Name)
+			}
+
+			if b := u.HealthCheck.Probe.Backoff; b != (ProbeBackoffConfig{}) {
+				ui := u.HealthCheck.Probe.UnhealthyInterval
+				if ui == 0 {
+					ui = u.HealthCheck.Probe.CheckInterval
+				}
+				if b.MaxInterval < ui {
+					return fmt.Errorf("%w: %w: health check probe backoff 'max_interval' for upstream '%s' must be at least the unhealthy interval of %ds",
+						errLbCheckConf,
+						errConfProbeBackoff,
+						u.Name,
+						ui)
 				}
+				if b.Jitter > 100 {
+					return fmt.Errorf("%w: %w: health check probe backoff 'jitter' for upstream '%s' must be a percentage between 0 and 100",
+						errLbCheckConf,
+						errConfProbeBackoff,
+						u.Name)
+				}
+			}
+		}
+
+		// Check flap dampening
+		if u.Dampening != nil {
+			if _, err := getFlapDampening(u.Dampening, true); err != nil {
+				return fmt.Errorf("%w: %w: problematic flap dampening for upstream '%s': %w", errLbCheckConf, errConfDampening, u.Name, err)
 			}
+		}
 
+		// Check DNS addresses
+		for _, a := range u.Dns.Servers {
+			if net.ParseIP(a) == nil {
+				LogDf("Invalid DNS address: %s", a)
+				return fmt.Errorf(
+					"%w: %w: Problematic DNS address: %s",
+					errLbCheckConf,
+					errConfDnsAddr,
+					a,
+				)
+			}
 		}
 	}
 
 	return nil
 }
 
+// upstreamFwmark returns the firewall mark of an upstream
+// The upstream fwmark takes precedence over the upstream group fwmark
+func upstreamFwmark(ugc *UpstreamGroupConfig, uc *UpstreamsConfig) uint32 {
+	fwmark := ugc.Fwmark
+	if uc.Fwmark != 0 {
+		fwmark = uc.Fwmark
+	}
+
+	return fwmark
+}
+
 // getConfig parses the load balancer engine configuration
 // It assumes that the config has been already checked for errors or mistakes
 // Returns an error in case of failure
@@ -532,146 +933,245 @@ func (l *lb) getConfig(lbc *LbConfig) error {
 	} else {
 		l.et = et
 	}
+	l.name = lbc.Name
 
 	// For each target
 	for _, t := range lbc.TargetsConfig {
-		// Distribution mode config
-		dMode, err := getDistMode(t.UpstreamGroup.Distribution)
+		// Target protocol config
+		lbp, _ := getLbProtocol(t.Protocol)
+
+		// Upstream group config
+		ug, err := l.getUpstreamGroupConfig(&t.UpstreamGroup, lbp)
+		if err != nil {
+			return err
+		}
+
+		// Target routes config
+		var routes []*route
+		for _, r := range t.Routes {
+			rug, err := l.getUpstreamGroupConfig(&r.UpstreamGroup, lbp)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, &route{
+				sni:           r.Sni,
+				host:          r.Host,
+				pathPrefix:    r.PathPrefix,
+				upstreamGroup: rug,
+			})
+		}
+
+		// Target PROXY protocol config
+		pp, err := getProxyProto(t.ProxyProtocol)
 		if err != nil {
 			return fmt.Errorf("%w: %w", errLbConf, err)
 		}
 
-		// Initalize Upstream Group
-		ug := upstreamGroup{
-			name:         t.UpstreamGroup.Name,
-			distMode:     dMode,
-			failoverMode: ugFoModeInactive,
+		// Target initialization
+		newTarget := target{
+			name:          t.Name,
+			protocol:      lbp,
+			ip:            t.Ip,
+			port:          t.Port,
+			interfaces:    t.Interfaces,
+			proxyProtocol: pp,
+			upstreamGroup: ug,
+			routes:        routes,
 		}
 
-		// Target protocol config
-		lbp, _ := getLbProtocol(t.Protocol)
+		l.targets = append(l.targets, &newTarget)
+	}
 
-		// For each upstream
-		for _, u := range t.UpstreamGroup.Upstreams {
-			var (
-				hcActive        bool
-				hcProto         hcProto
-				uStartAvailable bool
-			)
+	return nil
+}
 
-			// Upstream health check
-			if u.HealthCheck != (HealthCheckConfig{}) {
-				hcActive = true
-				uStartAvailable = u.HealthCheck.StartAvailable
-				hcProto, _ = getHcProto(u.HealthCheck.Protocol)
-			} else {
-				// Health check inactive for this upstream
-				hcActive = false
-				uStartAvailable = true
-			}
+// getUpstreamGroupConfig parses an upstream group configuration and returns the upstream group
+// The upstream IP addresses are added to the load balancer list of upstream IP addresses
+func (l *lb) getUpstreamGroupConfig(ugc *UpstreamGroupConfig, lbp lbProto) (*upstreamGroup, error) {
+	// Distribution mode config
+	dMode, err := getDistMode(ugc.Distribution)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errLbConf, err)
+	}
 
-			// Upstream IP Address
-			var ipa net.IP
-			var lttl uint32
-			ht, _ := getHostType(u.Host)
-			switch ht {
-			case hostTypeFqdn:
-				var err error
-
-				// If host is a name, set it as a FQDN with trailing dot
-				if !strings.HasSuffix(u.Host, ".") {
-					u.Host = u.Host + "."
-				}
+	// Distribution hash config
+	dHash, err := getDistHash(ugc.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errLbConf, err)
+	}
 
-				// Get A Record IP address for FQDN
-				// If it fails to resolve, set IP Address to nil and do not start available
-				// In case of failure, a new DNS query will be performed in the configured
-				// ttl or in the default ttl
-				ipa, lttl, err = resolveFqdn(u.Host, u.Dns.Servers, nil)
-				if err != nil {
-					LogWf(
-						"LB: failed to resolve IP for host '%s' for upstream '%s'",
-						u.Host,
-						u.Name,
-					)
-					if u.Dns.Ttl != 0 {
-						lttl = u.Dns.Ttl
-					} else {
-						lttl = lobbySettings.defaultDnsTtl
-					}
-					LogWf(
-						"LB: setting upstream '%s' as unavailable. New DNS query query will be performed in '%d' seconds",
-						u.Name,
-						lttl,
-					)
-					ipa = nil
-					uStartAvailable = false
+	// Client persistence config
+	pMode, err := getPersistMode(ugc.Persistence.Type)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errLbConf, err)
+	}
+	var pTimeout uint32
+	if pMode != persistModeNone {
+		pTimeout = ugc.Persistence.Timeout
+	}
+
+	// Initalize Upstream Group
+	ug := upstreamGroup{
+		name:           ugc.Name,
+		distMode:       dMode,
+		distHash:       dHash,
+		persistMode:    pMode,
+		persistTimeout: pTimeout,
+		minHealthy:     ugc.MinHealthyPct,
+		failoverMode:   ugFoModeInactive,
+	}
+
+	// Outlier detection config
+	if ugc.OutlierDetection != nil {
+		if ug.outlier, err = getOutlierDetection(ugc.OutlierDetection); err != nil {
+			return nil, fmt.Errorf("%w: %w", errLbConf, err)
+		}
+	}
+
+	// For each upstream
+	for _, u := range ugc.Upstreams {
+		var (
+			hcActive        bool
+			hcProto         hcProto
+			uStartAvailable bool
+		)
+
+		// Upstream health check
+		if u.HealthCheck != (HealthCheckConfig{}) {
+			hcActive = true
+			uStartAvailable = u.HealthCheck.StartAvailable
+			hcProto, _ = getHcProto(u.HealthCheck.Protocol)
+		} else {
+			// Health check inactive for this upstream
+			hcActive = false
+			uStartAvailable = true
+		}
+
+		// Upstream IP Address
+		var ipa net.IP
+		var lttl uint32
+		ht, _ := getHostType(u.Host)
+		switch ht {
+		case hostTypeFqdn:
+			var err error
+
+			// If host is a name, set it as a FQDN with trailing dot
+			if !strings.HasSuffix(u.Host, ".") {
+				u.Host = u.Host + "."
+			}
+
+			// Get A Record IP address for FQDN
+			// If it fails to resolve, set IP Address to nil and do not start available
+			// In case of failure, a new DNS query will be performed in the configured
+			// ttl or in the default ttl
+			ipa, lttl, err = resolveFqdn(u.Host, u.Dns.Servers, nil)
+			if err != nil {
+				LogWf(
+					"LB: failed to resolve IP for host '%s' for upstream '%s'",
+					u.Host,
+					u.Name,
+				)
+				if u.Dns.Ttl != 0 {
+					lttl = u.Dns.Ttl
+				} else {
+					lttl = lobbySettings.defaultDnsTtl
 				}
-				LogDVf("LB: Initial FQDN upstream address '%s' and DNS TTL %ds", ipa.String(), lttl)
-			case hostTypeIPv4, hostTypeIPv6:
-				ipa = net.ParseIP(u.Host)
-			default:
-				LogWf("LB: failed to process host '%s' for upstream '%s'", u.Host, u.Name)
-				LogWf("LB: setting upstream '%s' as unavailable", u.Name)
+				LogWf(
+					"LB: setting upstream '%s' as unavailable. New DNS query query will be performed in '%d' seconds",
+					u.Name,
+					lttl,
+				)
 				ipa = nil
 				uStartAvailable = false
 			}
-			LogDf("LB: upstream '%s' address: '%s'", u.Name, ipa)
-
-			// Add upstream IP Address to load balancer list of IP addresses
-			l.addUpstreamIps(ipa)
-
-			// Upstream initialization
-			newUpstream := upstream{
-				name:     u.Name,
-				protocol: lbp,
-				host:     u.Host,
-				port:     u.Port,
-				dns: upstreamDns{
-					addresses: u.Dns.Servers,
-					confTtl:   u.Dns.Ttl,
-					ttl:       lttl,
-					chDcStop:  make(chan struct{}),
-				},
-				address:   ipa,
-				available: uStartAvailable,
-				healthCheck: healthCheck{
-					active:        hcActive,
-					protocol:      hcProto,
-					port:          u.HealthCheck.Port,
-					checkInterval: u.HealthCheck.Probe.CheckInterval,
-					timeout:       u.HealthCheck.Probe.Timeout,
-					countConfig:   u.HealthCheck.Probe.Count,
-					count:         0,
-					chHcStop:      make(chan struct{}),
-				},
-			}
+			LogDVf("LB: Initial FQDN upstream address '%s' and DNS TTL %ds", ipa.String(), lttl)
+		case hostTypeIPv4, hostTypeIPv6:
+			ipa = net.ParseIP(u.Host)
+		default:
+			LogWf("LB: failed to process host '%s' for upstream '%s'", u.Host, u.Name)
+			LogWf("LB: setting upstream '%s' as unavailable", u.Name)
+			ipa = nil
+			uStartAvailable = false
+		}
+		LogDf("LB: upstream '%s' address: '%s'", u.Name, ipa)
+
+		// Add upstream IP Address to load balancer list of IP addresses
+		l.addUpstreamIps(ipa)
+
+		// Upstream firewall mark
+		fwmark := upstreamFwmark(ugc, &u)
 
-			// Add upstream to upstream group
-			ug.upstreams = append(ug.upstreams, &newUpstream)
+		// Consecutive failed health checks required to become unavailable. Defaults to 1
+		hcFailConfig := u.HealthCheck.Probe.FailureCount
+		if hcFailConfig == 0 {
+			hcFailConfig = 1
 		}
 
-		// Target initialization
-		newTarget := target{
-			name:          t.Name,
-			protocol:      lbp,
-			ip:            t.Ip,
-			port:          t.Port,
-			upstreamGroup: &ug,
+		// Health check interval while the upstream is unavailable. Defaults to the check interval
+		hcUnhealthyInterval := u.HealthCheck.Probe.UnhealthyInterval
+		if hcUnhealthyInterval == 0 {
+			hcUnhealthyInterval = u.HealthCheck.Probe.CheckInterval
 		}
 
-		l.targets = append(l.targets, &newTarget)
+		// Upstream initialization
+		newUpstream := upstream{
+			name:     u.Name,
+			protocol: lbp,
+			host:     u.Host,
+			port:     u.Port,
+			dns: upstreamDns{
+				addresses: u.Dns.Servers,
+				confTtl:   u.Dns.Ttl,
+				ttl:       lttl,
+				chDcStop:  make(chan struct{}),
+			},
+			address:        ipa,
+			available:      uStartAvailable,
+			fwmark:         fwmark,
+			persistTimeout: pTimeout,
+			healthCheck: healthCheck{
+				active:            hcActive,
+				protocol:          hcProto,
+				port:              u.HealthCheck.Port,
+				checkInterval:     u.HealthCheck.Probe.CheckInterval,
+				timeout:           u.HealthCheck.Probe.Timeout,
+				countConfig:       u.HealthCheck.Probe.Count,
+				count:             0,
+				healthy:           uStartAvailable,
+				failConfig:        hcFailConfig,
+				unhealthyInterval: hcUnhealthyInterval,
+				backoffMax:        u.HealthCheck.Probe.Backoff.MaxInterval,
+				jitter:            u.HealthCheck.Probe.Backoff.Jitter,
+				chHcStop:          make(chan struct{}),
+				config:            u.HealthCheck,
+			},
+		}
+		if hcActive {
+			if err := newUpstream.healthCheck.setProbe(&u.HealthCheck, u.Host); err != nil {
+				return nil, err
+			}
+		}
+		if u.Dampening != nil {
+			if newUpstream.damp, err = getFlapDampening(u.Dampening, uStartAvailable); err != nil {
+				return nil, fmt.Errorf("%w: %w", errLbConf, err)
+			}
+		}
+
+		// Add upstream to upstream group
+		ug.upstreams = append(ug.upstreams, &newUpstream)
 	}
 
-	return nil
+	return &ug, nil
 }
 
 // stopHcs stops the load balancer engine healthchecks
 // The stop is triggered when the healthcheck channel is closed
 func (l *lb) stopHcs() {
 	for _, t := range l.targets {
-		for _, u := range t.upstreamGroup.upstreams {
-			close(u.healthCheck.chHcStop)
+		for _, ug := range t.upstreamGroups() {
+			for _, u := range ug.upstreams {
+				close(u.healthCheck.chHcStop)
+			}
 		}
 	}
 }
@@ -680,43 +1180,113 @@ func (l *lb) stopHcs() {
 // The stop is triggered when the DNS check channel is closed
 func (l *lb) stopDcs() {
 	for _, t := range l.targets {
-		for _, u := range t.upstreamGroup.upstreams {
-			close(u.dns.chDcStop)
+		for _, ug := range t.upstreamGroups() {
+			for _, u := range ug.upstreams {
+				close(u.dns.chDcStop)
+			}
 		}
 	}
 }
 
-// stopChecks requests the healthcheck and DNS checks to stop
+// stopCcs stops the load balancer connections count checks
+// The stop is triggered when the connections count check channel is closed
+func (l *lb) stopCcs() {
+	if l.chCcStop != nil {
+		close(l.chCcStop)
+	}
+}
+
+// stopOds stops the load balancer outlier detection
+// The stop is triggered when the outlier detection channel is closed
+func (l *lb) stopOds() {
+	if l.chOdStop != nil {
+		close(l.chOdStop)
+	}
+}
+
+// stopChecks requests the healthcheck, DNS, connections count and outlier detection checks to stop
 // It uses waitgroups to wait until all are stopped and only then it returns
 func (l *lb) stopChecks() {
-	LogIf("LB: stopping health checks for '%s'", l.et.String())
+	LogIf("LB: stopping health checks for '%s'", l.String())
 	l.stopHcs()
 	LogIf("LB: stopping dns checks")
 	l.stopDcs()
+	l.stopCcs()
+	l.stopOds()
 	l.state.wg.Wait()
 	LogDf("LB: health checks and dns checks stopped")
 }
 
 // startChecks initializes the DNS checks and health checks for all upstreams
 func (l *lb) startChecks() {
-	LogIf("LB: starting checks for '%s'", l.et.String())
+	LogIf("LB: starting checks for '%s'", l.String())
 
 	// For each target
 	for _, t := range l.targets {
 		// For each upstream: initalize dns and health checks
-		for _, u := range t.upstreamGroup.upstreams {
-			LogDVf("LB: initializing DNS checks for target '%s'", t.name)
-			ht, _ := getHostType(u.host)
-			if ht == hostTypeFqdn {
-				u.dns.chDcStop = make(chan struct{})
-				l.initDnsCheck(u)
-			}
-			LogDVf("LB: initializing health checks for target '%s'", t.name)
-			if u.healthCheck.active {
-				l.initHealthCheck(u, t)
+		for _, ug := range t.upstreamGroups() {
+			for _, u := range ug.upstreams {
+				LogDVf("LB: initializing DNS checks for target '%s'", t.name)
+				ht, _ := getHostType(u.host)
+				if ht == hostTypeFqdn {
+					u.dns.chDcStop = make(chan struct{})
+					l.initDnsCheck(u)
+				}
+				LogDVf("LB: initializing health checks for target '%s'", t.name)
+				if u.healthCheck.active {
+					l.initHealthCheck(u, t)
+				}
 			}
 		}
 	}
+
+	// The connections count check is only needed by the least-connections distribution mode
+	for _, t := range l.targets {
+		if t.upstreamGroup.distMode == distModeLeastConn {
+			LogDVf("LB: initializing connections count checks")
+			l.chCcStop = make(chan struct{})
+			l.initConnCheck()
+			break
+		}
+	}
+
+	// The outlier detection is only needed by upstream groups with passive health checking
+	for _, t := range l.targets {
+		if slices.ContainsFunc(t.upstreamGroups(), func(ug *upstreamGroup) bool { return ug.outlier != nil }) {
+			LogDVf("LB: initializing outlier detection")
+			l.chOdStop = make(chan struct{})
+			l.initOutlierCheck()
+			break
+		}
+	}
+}
+
+// lbsCleanup deletes the leftovers of all the load balancers of the lobby instance
+// The leftovers can happen for instance upon some kind of crash or uncontrolled failure
+// It is run once on start-up, before any load balancer starts, for each engine type in use
+// so the leftovers of load balancers which were removed or renamed in the meantime are deleted as well
+// Upon start, each load balancer engine only cleans up its own leftovers, as the other instance load balancers may be running
+func lbsCleanup(lbs []*lb) error {
+	done := make(map[lbEngineType]bool)
+	for _, l := range lbs {
+		if done[l.et] {
+			continue
+		}
+		done[l.et] = true
+
+		LogDf("LB: cleaning up the instance leftovers of engine '%s'", l.et.String())
+		if err := l.e.checkPermissions(); err != nil {
+			return fmt.Errorf("%w: %w: %w", errLbEngineStart, errCheckPerm, err)
+		}
+		if err := l.e.checkDependencies(); err != nil {
+			return fmt.Errorf("%w: %w: %w", errLbEngineStart, errCheckDep, err)
+		}
+		if err := l.e.cleanup(lobbySettings.instance); err != nil {
+			return fmt.Errorf("%w: %w", errLbEngineStart, err)
+		}
+	}
+
+	return nil
 }
 
 // stop is used to stop the load balancer engine
@@ -740,7 +1310,7 @@ func (l *lb) start() error {
 	LogIf("LB: start Load Balancer requested")
 
 	// initialize load balancer engine
-	LogDf("LB: initializing load balancer engine '%s'", l.et.String())
+	LogDf("LB: initializing load balancer engine '%s'", l.String())
 	if err := l.e.checkPermissions(); err != nil {
 		return fmt.Errorf("%w: %w: %w", errLbEngineStart, errCheckPerm, err)
 	}
@@ -763,7 +1333,7 @@ func (l *lb) start() error {
 // initHealthCheck initiates the healthcheck routines for the upstream
 func (l *lb) initHealthCheck(u *upstream, t *target) {
 	e := l.e
-	ln := l.et.String()
+	ln := l.String()
 
 	// Initialize the random number generator with a seed based on the current time
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -802,73 +1372,20 @@ func (l *lb) initHealthCheck(u *upstream, t *target) {
 				LogDVf("LB: '%s' load balancer engine changes are unlocked", ln)
 				l.state.m.Unlock()
 
-				var addr string
-				if u.address != nil {
-					addr = u.address.String() + ":" + strconv.Itoa(int(u.healthCheck.port))
-				} else {
-					LogDVf("LB HC (%s): Host '%s' with unresolved address. Health check paused while host address is not available", u.name, u.host)
-				}
-
-				LogDVf(
-					"LB HC (%s): healthchecking upstream IP: '%s'; Port: '%d'; Protocol: '%s'; Timeout: '%d' seconds",
-					u.name,
-					u.address.String(),
-					u.healthCheck.port,
-					u.healthCheck.protocol.String(),
-					u.healthCheck.timeout,
-				)
-				c, err := net.DialTimeout(
-					u.healthCheck.protocol.String(),
-					addr,
-					time.Duration(u.healthCheck.timeout)*time.Second,
-				)
-				if err != nil {
-					LogIf(
-						"LB HC (%s): healthcheck for upstream failed. Retrying in %ds. Error: %v",
-						u.name,
-						u.healthCheck.checkInterval,
-						err,
-					)
-
-					// Reset health_check count to 0
-					u.healthCheck.count = 0
-
-					if u.available {
-						// If upstream was marked as available
-						u.available = false
-						LogIf(
-							"LB HC (%s): upstream became unavailable due to health_check failure",
-							u.name,
-						)
-						// update nftables
-						e.updateTarget(t)
-					}
-				} else {
-					// If health_check succeeds, close net.Conn
-					c.Close()
-
-					if !u.available {
-						// If upstream in not available state
-						// Increment health_check count
-						u.healthCheck.count++
-						LogIf("LB HC (%s): upstream is unavailable at '%s', but health_check succeeded. %d/%d tests succeeded", u.name, addr, u.healthCheck.count, u.healthCheck.countConfig)
-						if u.healthCheck.count >= u.healthCheck.countConfig {
-							u.available = true
-							LogIf("LB HC (%s): upstream became available at '%s'", u.name, addr)
-							// update nftables
-							e.updateTarget(t)
-						}
-					} else {
-						LogDVf("LB HC (%s): upstream continues available at %s", u.name, addr)
+				changed, next := u.hcRun()
+				if changed {
+					// update nftables
+					if err := e.updateTarget(t); err != nil {
+						LogWf("LB HC (%s): target '%s' update failed: %v", u.name, t.name, err)
 					}
 				}
 				// Reset healthcheck timer
 				LogDVf(
-					"LB HC (%s): healthcheck recheck in %ds",
+					"LB HC (%s): healthcheck recheck in %v",
 					u.name,
-					u.healthCheck.checkInterval,
+					next,
 				)
-				u.healthCheck.ticker.Reset(time.Duration(u.healthCheck.checkInterval) * time.Second)
+				u.healthCheck.ticker.Reset(next)
 			}
 		}
 	}()
@@ -876,20 +1393,27 @@ func (l *lb) initHealthCheck(u *upstream, t *target) {
 
 // initDnsCheck initiates the DNS check routines for the upstream
 func (l *lb) initDnsCheck(u *upstream) {
-	ln := l.et.String()
+	ln := l.String()
 
 	if u.dns.confTtl != 0 {
 		LogDVf("LB DNS (%s): using upstream config DNS ttl %ds", u.name, u.dns.confTtl)
 		u.dns.ttl = u.dns.confTtl
-		u.dns.ticker = time.NewTicker(time.Duration(u.dns.ttl) * time.Second)
 	} else {
 		if u.dns.ttl == 0 {
 			u.dns.ttl = lobbySettings.defaultDnsTtl
 		}
 		LogDVf("LB DNS (%s): using DNS ttl %ds", u.name, u.dns.ttl)
-		u.dns.ticker = time.NewTicker(time.Duration(u.dns.ttl) * time.Second)
 	}
 
+	// A pending DNS check carried over from the previous configuration is kept
+	next := time.Duration(u.dns.ttl) * time.Second
+	if until := time.Until(u.dns.next); until > 0 && until < next {
+		LogDVf("LB DNS (%s): next DNS check carried over from the previous configuration in %v", u.name, until.Truncate(time.Second))
+		next = until
+	}
+	u.dns.ticker = time.NewTicker(next)
+	u.dns.next = time.Now().Add(next)
+
 	l.state.wg.Add(1)
 	go func() {
 		defer l.state.wg.Done()
@@ -928,6 +1452,7 @@ func (l *lb) initDnsCheck(u *upstream) {
 					}
 					LogWf("LB DNS (%s): new DNS query in '%d's", u.name, u.dns.ttl)
 					u.dns.ticker.Reset(time.Duration(u.dns.ttl) * time.Second)
+					u.dns.next = time.Now().Add(time.Duration(u.dns.ttl) * time.Second)
 					continue
 				}
 				if !ua.Equal(rua) {
@@ -942,9 +1467,11 @@ func (l *lb) initDnsCheck(u *upstream) {
 					// set the upstream as available. Upstreams without health checks
 					// are always considered to be available unless there were DNS
 					// issues during setup or reconfiguration
+					u.healthCheck.m.Lock()
 					if !u.healthCheck.active {
-						u.available = true
+						u.refreshAvailability(time.Now())
 					}
+					u.healthCheck.m.Unlock()
 
 					// update load balancer upstream
 					if err = l.updateUpstream(u, &rua); err != nil {
@@ -970,14 +1497,161 @@ func (l *lb) initDnsCheck(u *upstream) {
 						)
 						u.dns.ttl = lobbySettings.defaultDnsTtl
 					}
-					u.dns.ticker.Reset(time.Duration(u.dns.ttl) * time.Second)
-					LogDf("LB DNS (%s): next DNS check to be performed in %d seconds", u.name, u.dns.ttl)
 				}
+				u.dns.ticker.Reset(time.Duration(u.dns.ttl) * time.Second)
+				u.dns.next = time.Now().Add(time.Duration(u.dns.ttl) * time.Second)
+				LogDf("LB DNS (%s): next DNS check to be performed in %d seconds", u.name, u.dns.ttl)
 			}
 		}
 	}()
 }
 
+// initConnCheck initiates the connections count check routine used by the least-connections distribution mode
+// It periodically reads the established flows per upstream from conntrack and
+// requests the load balancer engine to update the targets whose distribution changed
+func (l *lb) initConnCheck() {
+	e := l.e
+	ln := l.String()
+	ticker := time.NewTicker(time.Duration(lobbySettings.connCheckInterval) * time.Second)
+
+	l.state.wg.Add(1)
+	go func() {
+		defer l.state.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.chCcStop:
+				LogIf("LB CC (%s): connections count check stop requested", ln)
+				return
+			case <-ticker.C:
+				// This has been included to be able to pause the check for instance in case of reconfiguration
+				l.state.m.Lock()
+				// Check if the load balancer is in 'terminate' state
+				// if it is skip the check
+				if l.state.t {
+					l.state.m.Unlock()
+					continue
+				}
+				l.state.m.Unlock()
+
+				count, err := ctEstablishedCount()
+				if err != nil {
+					LogWf("LB CC (%s): failed to read connections count from conntrack: %v", ln, err)
+					continue
+				}
+
+				// The upstreams and the load balancer engine are updated with the load balancer changes locked,
+				// so that they don't race with a reconfiguration
+				l.state.m.Lock()
+				if l.state.t {
+					l.state.m.Unlock()
+					continue
+				}
+				for _, t := range l.targets {
+					if t.upstreamGroup.distMode != distModeLeastConn {
+						continue
+					}
+
+					changed := false
+					for _, u := range t.upstreamGroup.upstreams {
+						var c uint32
+						if u.address != nil {
+							c = count[ctFlowKey(u.address, u.port)]
+						}
+						if c != u.activeConns {
+							LogDVf("LB CC (%s): upstream has %d established connections", u.name, c)
+							u.activeConns = c
+							changed = true
+						}
+					}
+
+					if changed && !slices.Equal(t.leastConnShares, upstreamsLeastConnShares(t)) {
+						LogDf("LB CC (%s): connections count changed. Re-weighting target '%s'", ln, t.name)
+						if err := e.updateTarget(t); err != nil {
+							LogWf("LB CC (%s): target '%s' update failed: %v", ln, t.name, err)
+						}
+					}
+				}
+				l.state.m.Unlock()
+			}
+		}
+	}()
+}
+
+// initOutlierCheck initiates the outlier detection routine used for passive health checking
+// It periodically reads the TCP flows per upstream from conntrack, ejects the upstreams with a high
+// failed flows ratio, restores the ones whose ejection time is over and requests the load balancer engine
+// to update the targets whose upstreams availability changed
+func (l *lb) initOutlierCheck() {
+	e := l.e
+	ln := l.String()
+	ticker := time.NewTicker(time.Duration(lobbySettings.outlierCheckInterval) * time.Second)
+
+	l.state.wg.Add(1)
+	go func() {
+		defer l.state.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.chOdStop:
+				LogIf("LB OD (%s): outlier detection stop requested", ln)
+				return
+			case <-ticker.C:
+				// This has been included to be able to pause the check for instance in case of reconfiguration
+				l.state.m.Lock()
+				// Check if the load balancer is in 'terminate' state
+				// if it is skip the check
+				if l.state.t {
+					l.state.m.Unlock()
+					continue
+				}
+				l.state.m.Unlock()
+
+				flows, err := ctDump()
+				if err != nil {
+					LogWf("LB OD (%s): failed to read flows from conntrack: %v", ln, err)
+					continue
+				}
+				stats := ctTcpStats(flows)
+
+				// The upstreams and the load balancer engine are updated with the load balancer changes locked,
+				// so that they don't race with a reconfiguration
+				l.state.m.Lock()
+				if l.state.t {
+					l.state.m.Unlock()
+					continue
+				}
+				for _, t := range l.targets {
+					changed := false
+					for _, ug := range t.upstreamGroups() {
+						if ug.outlier != nil && ug.detectOutliers(stats, time.Now()) {
+							changed = true
+						}
+					}
+					if changed {
+						if err := e.updateTarget(t); err != nil {
+							LogWf("LB OD (%s): target '%s' update failed: %v", ln, t.name, err)
+						}
+					}
+				}
+				l.state.m.Unlock()
+			}
+		}
+	}()
+}
+
+// upstreamsLeastConnShares returns the least-connections vmap slot shares of the serving upstreams of a target
+func upstreamsLeastConnShares(t *target) []int {
+	var conns []uint32
+	for _, u := range t.upstreamGroup.servingUpstreams() {
+		conns = append(conns, u.activeConns)
+	}
+
+	return leastConnShares(conns)
+}
+
 // reconfig implements the load balancer reconfiguration procedure
 // After locking any other load balancer changes,
 // it initiates a new load balancer engine and
@@ -989,7 +1663,7 @@ func (l *lb) initDnsCheck(u *upstream) {
 // the reconfiguration returns an error, then the reconfig method doesn't proceeds and
 // it unlocks the previous load balancer changes and returns the errLbEngineReconfig error
 func (l *lb) reconfig(nl *lb) error {
-	ln := l.et.String()
+	ln := l.String()
 	LogIf("LB: '%s' load balancer engine reconfiguration", ln)
 
 	l.state.m.Lock()
@@ -1003,6 +1677,10 @@ func (l *lb) reconfig(nl *lb) error {
 		return fmt.Errorf("%w: %w", errLbEngineReconfig, err)
 	}
 
+	// Keep the upstreams health and DNS state, so that the new configuration
+	// doesn't reset the availability of the upstreams that didn't change
+	nl.carryState(l)
+
 	if err = l.e.reconfig(nl); err != nil {
 		l.state.m.Unlock()
 		LogDVf("LB: '%s' load balancer engine changes are unlocked", ln)
@@ -1019,6 +1697,101 @@ func (l *lb) reconfig(nl *lb) error {
 	return nil
 }
 
+// carryState carries the runtime upstream health and DNS state from ol, the load balancer of the previous configuration
+// Upstreams are matched by target, upstream group and upstream name, host and port.
+// Their state is only carried if their health check configuration didn't change
+func (l *lb) carryState(ol *lb) {
+	now := time.Now()
+	for _, t := range l.targets {
+		i := slices.IndexFunc(ol.targets, func(ot *target) bool {
+			return ot.name == t.name && ot.protocol == t.protocol && ot.ip == t.ip && ot.port == t.port
+		})
+		if i < 0 {
+			continue
+		}
+		ougs := ol.targets[i].upstreamGroups()
+
+		for _, ug := range t.upstreamGroups() {
+			j := slices.IndexFunc(ougs, func(oug *upstreamGroup) bool { return oug.name == ug.name })
+			if j < 0 {
+				continue
+			}
+
+			for _, u := range ug.upstreams {
+				k := slices.IndexFunc(ougs[j].upstreams, func(ou *upstream) bool {
+					return ou.name == u.name && ou.host == u.host && ou.port == u.port
+				})
+				if k < 0 {
+					continue
+				}
+				ou := ougs[j].upstreams[k]
+				if !reflect.DeepEqual(ou.healthCheck.config, u.healthCheck.config) {
+					LogIf("LB: upstream '%s' health check configuration changed. Upstream state reset", u.name)
+					continue
+				}
+				l.carryUpstreamState(u, ou, ug.outlier != nil, now)
+			}
+		}
+	}
+}
+
+// carryUpstreamState carries the runtime health and DNS state of ou, the same upstream on the previous configuration, to u
+//   - the last known address and the pending DNS check, unless the DNS servers changed
+//   - the health check verdict, counters and interval
+//   - the outlier ejection, if the upstream group still has outlier detection
+//   - the flap dampening state, if the flap dampening settings didn't change
+//
+// The upstream availability is then refreshed from the carried state
+func (l *lb) carryUpstreamState(u, ou *upstream, outlier bool, now time.Time) {
+	ohc := &ou.healthCheck
+	ohc.m.Lock()
+	defer ohc.m.Unlock()
+	hc := &u.healthCheck
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	if ou.address != nil && slices.Equal(ou.dns.addresses, u.dns.addresses) {
+		if !ou.address.Equal(u.address) {
+			LogDf("LB: upstream '%s' keeps the last known address '%s'", u.name, ou.address)
+			if u.address == nil || l.replaceUpstreamIps(&u.address, &ou.address) != nil {
+				l.addUpstreamIps(ou.address)
+			}
+			u.address = ou.address
+		}
+		u.dns.ttl = ou.dns.ttl
+		u.dns.next = ou.dns.next
+	}
+
+	hc.healthy = ohc.healthy
+	hc.count = ohc.count
+	hc.failCount = ohc.failCount
+	hc.interval = ohc.interval
+	hc.probes = ohc.probes
+	hc.failures = ohc.failures
+	hc.lastProbe = ohc.lastProbe
+	hc.lastErr = ohc.lastErr
+
+	u.ejections = ou.ejections
+	if outlier {
+		u.ejectedUntil = ou.ejectedUntil
+	}
+
+	switch {
+	case u.damp != nil && ou.damp != nil && u.damp.sameSettings(ou.damp):
+		*u.damp = *ou.damp
+	case u.damp != nil:
+		// Enabling or changing flap dampening isn't a flap
+		u.damp.up = (!hc.active || hc.healthy) && !u.ejected()
+	}
+
+	// Upstreams without health checks and without address stay unavailable
+	if hc.active || u.address != nil {
+		u.refreshAvailability(now)
+	}
+
+	LogIf("LB: upstream '%s' state carried over from the previous configuration. Available: '%t'", u.name, u.available)
+}
+
 // updateUpstream performs the necessary tasks to refresh an upstream
 // given a new upstream IP address
 //   - replaces the upstream address with the new IP address
@@ -1027,7 +1800,7 @@ func (l *lb) reconfig(nl *lb) error {
 func (l *lb) updateUpstream(u *upstream, nua *net.IP) error {
 	LogIf("LB: update upstream for '%s'", u.name)
 
-	ln := l.et.String()
+	ln := l.String()
 
 	// Lock load balancer mutex
 	l.state.m.Lock()
@@ -1094,6 +1867,20 @@ func lbInit() ([]*lb, error) {
 		return ls, fmt.Errorf("%w: %w", errLbInit, err)
 	}
 
+	// The instance identifier is set once. It can't be changed on reconfiguration,
+	// as it scopes the kernel resources of the running load balancers
+	// The command line flag takes precedence over the config file
+	if !lobbySettings.instanceSet {
+		lobbySettings.instance = configYaml.Instance
+		lobbySettings.instanceSet = true
+	} else if configYaml.Instance != "" && configYaml.Instance != lobbySettings.instance {
+		LogWf(
+			"LB: config instance identifier '%s' ignored. The running instance identifier '%s' can't be changed without a restart",
+			configYaml.Instance,
+			lobbySettings.instance,
+		)
+	}
+
 	for _, lbc := range configYaml.LbConfig {
 		l := &lb{}
 		l.upstreamIps = &[]net.IP{}
@@ -1114,43 +1901,43 @@ func lbInit() ([]*lb, error) {
 	return ls, nil
 }
 
-// lbsCompare compares two slices of load balancers based on their lbEngineType and returns:
+// lbsCompare compares two slices of load balancers based on their identity (lbId) and returns:
 //   - a map with the load balancers that are on both slices (kept)
 //   - a slice with the load balancers that are on nlbs, but not on olbs (added)
 //   - a slice with the load balancers that are on olbs, but not on nlbs (removed)
 //
-// The map has the lbEngineType as key where the value is a slice of two load balancers [0] olbs and [1] nlbs
-func lbsCompare(olbs, nlbs []*lb) (*map[lbEngineType][]*lb, []*lb, []*lb) {
-	var added []*lb   // holds the lb with the respective lbEngineType found on nlbs, but not on olbs
-	var removed []*lb // holds the lb with the respective lbEngineType found on olbs, but not on nlbs
+// The map has the lbId as key where the value is a slice of two load balancers [0] olbs and [1] nlbs
+func lbsCompare(olbs, nlbs []*lb) (*map[lbId][]*lb, []*lb, []*lb) {
+	var added []*lb   // holds the lb with the respective lbId found on nlbs, but not on olbs
+	var removed []*lb // holds the lb with the respective lbId found on olbs, but not on nlbs
 
-	// map holding the lb with engine type found on nlbs and olbs
-	// the key is the lbEngineType and the value is a slice of lb
+	// map holding the lb with lbId found on nlbs and olbs
+	// the key is the lbId and the value is a slice of lb
 	// [0] holds the respective olbs lb
 	// [1] holds the respective nlbs lb
-	kept := make(map[lbEngineType][]*lb)
+	kept := make(map[lbId][]*lb)
 
 olbsLoop:
 	for _, o := range olbs { // loop through all olbs elements
 		for _, n := range nlbs { // for each olbs element, loop through all nlbs elements
-			if o.et == n.et { // if olbs element and nlbs element have the same lbEngineType
+			if o.id() == n.id() { // if olbs element and nlbs element have the same lbId
 				var k []*lb         // create a slice of load balancers to hold each lb
 				k = append(k, o, n) // add the olbs element and then add the nlbs element
-				kept[o.et] = k      // register the new lb slice to the 'kept' map
-				LogDVf("LB: load balancer '%s' added to the 'kept' map", o.et.String())
+				kept[o.id()] = k    // register the new lb slice to the 'kept' map
+				LogDVf("LB: load balancer '%s' added to the 'kept' map", o.String())
 				continue olbsLoop // as a match was found, continue to the next olbs and interrupt nlbs loop
 			}
 		}
-		// as this olbs element lbEngineType wasn't found on any nlbs element:
+		// as this olbs element lbId wasn't found on any nlbs element:
 		removed = append(removed, o)
-		LogDVf("LB: load balancer '%s' added to the 'removed' slice", o.et.String())
+		LogDVf("LB: load balancer '%s' added to the 'removed' slice", o.String())
 	}
 
 	// now that we have completed the kept and removed ones, we need to check the ones that are on nlbs and not on olbs (added)
 	for _, n := range nlbs { // loop through all nlbs elements
-		if _, ok := kept[n.et]; !ok { // if the nlbs element lbEngineType is not present in kept, it means it is not found in olbs
+		if _, ok := kept[n.id()]; !ok { // if the nlbs element lbId is not present in kept, it means it is not found in olbs
 			added = append(added, n)
-			LogDVf("LB: load balancer '%s' added to the 'added' slice", n.et.String())
+			LogDVf("LB: load balancer '%s' added to the 'added' slice", n.String())
 		}
 	}
 
@@ -1177,7 +1964,7 @@ func lbReconfig(lbs *[]*lb) error {
 	toKeep, toAdd, toRem := lbsCompare(*lbs, nlbs)
 
 	for _, l := range *toKeep { // for each lb engine that is on both old and new config
-		LogIf("LB: load balancer '%s' configuration will be refreshed", l[0].et.String())
+		LogIf("LB: load balancer '%s' configuration will be refreshed", l[0].String())
 		if err := l[0].reconfig(l[1]); err != nil {
 			return fmt.Errorf("%w: %w", errLbReconfig, err)
 		}
@@ -1185,7 +1972,7 @@ func lbReconfig(lbs *[]*lb) error {
 
 	if len(toAdd) > 0 {
 		for _, l := range toAdd { // for each lb engine that is on the new config, but not on the old
-			LogIf("LB: load balancer '%s' has been added to configuration and will be started", l.et.String())
+			LogIf("LB: load balancer '%s' has been added to configuration and will be started", l.String())
 			if err := l.start(); err != nil {
 				return fmt.Errorf("%w: %w", errLbReconfig, err)
 			}
@@ -1194,7 +1981,7 @@ func lbReconfig(lbs *[]*lb) error {
 
 	if len(toRem) > 0 {
 		for _, l := range toRem { // for each lb engine that is on the old config, but not on the new
-			LogIf("LB: load balancer '%s' no longer configured will be stopped", l.et.String())
+			LogIf("LB: load balancer '%s' no longer configured will be stopped", l.String())
 			if err := l.stop(); err != nil {
 				return fmt.Errorf("%w: %w", errLbReconfig, err)
 			}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
@@ -127,6 +128,8 @@ func TestGetDistMode(t *testing.T) {
 	}{
 		{input: "round-robin", err: nil, result: distModeRR},
 		{input: "weighted", err: nil, result: distModeWeighted},
+		{input: "maglev", err: nil, result: distModeMaglev},
+		{input: "least-connections", err: nil, result: distModeLeastConn},
 		{input: "blah", err: errDistMode, result: distModeUnknown},
 	}
 
@@ -150,6 +153,8 @@ func TestDistModeString(t *testing.T) {
 	}{
 		{input: distModeRR, result: "round-robin"},
 		{input: distModeWeighted, result: "weighted"},
+		{input: distModeMaglev, result: "maglev"},
+		{input: distModeLeastConn, result: "least-connections"},
 		{input: distModeUnknown, result: "unknown"},
 		{input: 9, result: "unknown"},
 	}
@@ -164,6 +169,34 @@ func TestDistModeString(t *testing.T) {
 	}
 }
 
+func TestGetDistHash(t *testing.T) {
+	testCases := []struct {
+		input  string
+		err    error
+		result distHash
+	}{
+		{input: "", err: nil, result: distHashSrcAddr},
+		{input: "source-address", err: nil, result: distHashSrcAddr},
+		{input: "5-tuple", err: nil, result: distHashFiveTuple},
+		{input: "blah", err: errDistHash, result: distHashUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			dh, err := getDistHash(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected '%v', but got '%v'", tc.input, tc.err, err)
+			}
+			if dh != tc.result {
+				t.Errorf("%s: expected '%v', but got '%v'", tc.input, tc.result, dh)
+			}
+			if tc.err == nil && dh.String() == "unknown" {
+				t.Errorf("%s: unexpected string value '%v'", tc.input, dh.String())
+			}
+		})
+	}
+}
+
 func TestGetLbEngineType(t *testing.T) {
 	testCases := []struct {
 		input  string
@@ -172,6 +205,8 @@ func TestGetLbEngineType(t *testing.T) {
 	}{
 		{input: "testEngine", err: nil, result: lbEngineTest},
 		{input: "nftables", err: nil, result: lbEngineNft},
+		{input: "iptables", err: nil, result: lbEngineIpt},
+		{input: "userspace", err: nil, result: lbEngineUsp},
 		{input: "blah", err: errLbEngineType, result: lbEngineUnknown},
 	}
 
@@ -195,6 +230,8 @@ func TestNewLbEngine(t *testing.T) {
 		result lbEngine
 	}{
 		{input: lbEngineNft, err: nil, result: &nft{}},
+		{input: lbEngineIpt, err: nil, result: &ipt{}},
+		{input: lbEngineUsp, err: nil, result: &usp{}},
 		{input: lbEngineUnknown, err: errLbEngineType, result: nil},
 	}
 
@@ -222,6 +259,8 @@ func TestLbEngineTypeString(t *testing.T) {
 		result string
 	}{
 		{input: lbEngineNft, result: "nftables"},
+		{input: lbEngineIpt, result: "iptables"},
+		{input: lbEngineUsp, result: "userspace"},
 		{input: lbEngineUnknown, result: "unknown"},
 		{input: 9, result: "unknown"},
 	}
@@ -270,6 +309,7 @@ func TestLbProtoString(t *testing.T) {
 		{input: lbProtoTcp, result: "tcp"},
 		{input: lbProtoUdp, result: "udp"},
 		{input: lbProtoSctp, result: "sctp"},
+		{input: lbProtoHttp, result: "http"},
 		{input: 9, result: "unknown"},
 	}
 
@@ -283,6 +323,107 @@ func TestLbProtoString(t *testing.T) {
 	}
 }
 
+func TestResourcePrefix(t *testing.T) {
+	bkpInstance := lobbySettings.instance
+	defer func() { lobbySettings.instance = bkpInstance }()
+
+	testCases := []struct {
+		instance string
+		name     string
+		result   string
+	}{
+		{instance: "", name: "", result: "Lobby"},
+		{instance: "tenant1", name: "", result: "Lobby-tenant1"},
+		{instance: "", name: "web", result: "Lobby.web"},
+		{instance: "tenant1", name: "web", result: "Lobby-tenant1.web"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.result, func(t *testing.T) {
+			lobbySettings.instance = tc.instance
+			l := &lb{et: lbEngineNft, name: tc.name}
+			if r := l.resourcePrefix(); r != tc.result {
+				t.Errorf("%s: expected '%v', but got '%v'", tc.result, tc.result, r)
+			}
+		})
+	}
+}
+
+func TestResourcePrefixCollision(t *testing.T) {
+	// instance 't1' with an unnamed load balancer and the default instance with a load balancer named 't1'
+	// must not clean up each other's tables and chains on start-up
+	pi := resourcePrefix("t1", "")
+	pn := resourcePrefix("", "t1")
+	if pi == pn {
+		t.Fatalf("expected different prefixes, but got '%s'", pi)
+	}
+
+	ts := strings.ReplaceAll(time.Now().Format(iptChainTimeFormat), ".", "")
+	for _, p := range [][2]string{{pi, pn}, {pn, pi}} {
+		if regexp.MustCompile(nftTableNameRegex(p[0])).MatchString(p[1] + "-" + time.Now().Format(antnSuffixTimeFormat)) {
+			t.Errorf("nft table name pattern of '%s' matches the tables of '%s'", p[0], p[1])
+		}
+		if regexp.MustCompile(iptChainRegex(p[0])).MatchString(p[1] + "-" + ts + "-PRER") {
+			t.Errorf("iptables chain name pattern of '%s' matches the chains of '%s'", p[0], p[1])
+		}
+	}
+}
+
+func TestInstancePrefixRegex(t *testing.T) {
+	// the start-up cleanup matches the resources of all the instance load balancers, and only those
+	testCases := []struct {
+		instance string
+		prefix   string
+		match    bool
+	}{
+		{instance: "tenant1", prefix: "Lobby-tenant1", match: true},
+		{instance: "tenant1", prefix: "Lobby-tenant1.web", match: true},
+		{instance: "tenant1", prefix: "Lobby-tenant1.removed_lb", match: true},
+		{instance: "tenant1", prefix: "Lobby-tenant2.web", match: false},
+		{instance: "tenant1", prefix: "Lobby-tenant10", match: false},
+		{instance: "tenant1", prefix: "Lobby", match: false},
+		{instance: "tenant1", prefix: "Lobby.tenant1", match: false},
+		{instance: "", prefix: "Lobby", match: true},
+		{instance: "", prefix: "Lobby.web", match: true},
+		{instance: "", prefix: "Lobby-tenant1", match: false},
+		{instance: "", prefix: "Lobby-tenant1.web", match: false},
+	}
+
+	ts := strings.ReplaceAll(time.Now().Format(iptChainTimeFormat), ".", "")
+	for _, tc := range testCases {
+		t.Run(tc.instance+"/"+tc.prefix, func(t *testing.T) {
+			if m := regexp.MustCompile(nftInstanceTableNameRegex(tc.instance)).MatchString(tc.prefix + "-" + time.Now().Format(antnSuffixTimeFormat)); m != tc.match {
+				t.Errorf("expected nft table name match '%t', but got '%t'", tc.match, m)
+			}
+			if m := regexp.MustCompile(iptInstanceChainRegex(tc.instance)).MatchString(tc.prefix + "-" + ts + "-PRER"); m != tc.match {
+				t.Errorf("expected iptables chain name match '%t', but got '%t'", tc.match, m)
+			}
+		})
+	}
+}
+
+func TestUpstreamFwmark(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ugc    UpstreamGroupConfig
+		uc     UpstreamsConfig
+		fwmark uint32
+	}{
+		{name: "none", ugc: UpstreamGroupConfig{}, uc: UpstreamsConfig{}, fwmark: 0},
+		{name: "group", ugc: UpstreamGroupConfig{Fwmark: 1}, uc: UpstreamsConfig{}, fwmark: 1},
+		{name: "upstream", ugc: UpstreamGroupConfig{Fwmark: 1}, uc: UpstreamsConfig{Fwmark: 2}, fwmark: 2},
+		{name: "upstream only", ugc: UpstreamGroupConfig{}, uc: UpstreamsConfig{Fwmark: 2}, fwmark: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if fwmark := upstreamFwmark(&tc.ugc, &tc.uc); fwmark != tc.fwmark {
+				t.Errorf("%s: expected '%d', but got '%d'", tc.name, tc.fwmark, fwmark)
+			}
+		})
+	}
+}
+
 func TestAddAndReplaceUpstreamIps(t *testing.T) {
 	ips := []string{"1.1.1.1", "2.2.2.2"}
 	netIps := &[]net.IP{}
@@ -363,6 +504,42 @@ func TestCheckConfig(t *testing.T) {
 		)
 	}
 
+	// confirm checkConfig succeeds on repeated engine configuration with different load balancer names
+	// and fails as the targets are then repeated across load balancers
+	namedConfig := strings.Replace(config, "  - engine: nftables", "  - name: lb1\n    engine: nftables", 1) +
+		strings.Replace(strings.Join(wrongConfigSlice[1:], "\n"), "  - engine: nftables", "  - name: lb2\n    engine: nftables", 1)
+	expectedErr = errConfRepTargetName
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(namedConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
+	// confirm checkConfig fails on invalid load balancer name
+	wrongConfig = strings.Replace(config, "  - engine: nftables", "  - name: lb-1\n    engine: nftables", 1)
+	expectedErr = errConfLbName
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
 	// confirm checkConfig fails on repeated target name
 	wrongConfig = config
 	wrongConfig = strings.ReplaceAll(wrongConfig, "target2", "target1")
@@ -568,6 +745,543 @@ func TestCheckConfig(t *testing.T) {
 			err,
 		)
 	}
+
+	// confirm checkConfig succeeds on upstream group firewall mark
+	markConfig := strings.Replace(config, "          upstreams:\n", "          fwmark: 2\n          upstreams:\n", 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(markConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+
+	// confirm checkConfig fails on firewall mark for engines other than nftables
+	wrongConfig = strings.Replace(markConfig, "  - engine: nftables", "  - engine: iptables", 1)
+	expectedErr = errConfFwmark
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
+	// confirm checkConfig fails on invalid target interface
+	wrongConfig = strings.Replace(config, "        port: 8080                              # target port\n", "        port: 8080                              # target port\n        interfaces: [eth0, eth/1]\n", 1)
+	expectedErr = errConfInterface
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
+	// confirm checkConfig fails on target interfaces with the userspace engine
+	wrongConfig = strings.Replace(config, "        port: 8080                              # target port\n", "        port: 8080                              # target port\n        interfaces: [eth0]\n", 1)
+	wrongConfig = strings.Replace(wrongConfig, "  - engine: nftables", "  - engine: userspace", 1)
+	expectedErr = errConfInterfaceUsp
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
+	// confirm checkConfig succeeds on source-address client persistence
+	persistConfig := strings.Replace(config, "          upstreams:\n", "          persistence:\n            type: source-address\n            timeout: 300\n          upstreams:\n", 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(persistConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+
+	// confirm checkConfig fails on invalid client persistence type and on missing persistence timeout
+	persistTestCases := []struct {
+		config string
+		err    error
+	}{
+		{config: strings.Replace(persistConfig, "type: source-address", "type: cookie", 1), err: errConfPersistMode},
+		{config: strings.Replace(persistConfig, "timeout: 300", "timeout: 0", 1), err: errConfPersistence},
+		{config: strings.Replace(persistConfig, "  - engine: nftables", "  - engine: iptables", 1), err: errConfPersistence},
+	}
+	for _, tc := range persistTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(tc.config), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, tc.err)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				tc.err,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on PROXY protocol for the userspace engine
+	// and fails for other engines or on an invalid PROXY protocol version
+	proxyConfig := strings.Replace(config, "        port: 8080                              # target port\n", "        port: 8080                              # target port\n        proxy_protocol: v2\n", 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(strings.Replace(proxyConfig, "  - engine: nftables", "  - engine: userspace", 1)), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	for _, wrongConfig := range []string{
+		proxyConfig,
+		strings.Replace(strings.Replace(proxyConfig, "  - engine: nftables", "  - engine: userspace", 1), "proxy_protocol: v2", "proxy_protocol: v3", 1),
+	} {
+		expectedErr = errConfProxyProtocol
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, expectedErr)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				expectedErr,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on SNI routes for the userspace engine
+	// and fails for other engines, invalid SNI patterns or repeated upstream group names
+	routeConfig := strings.Replace(config, "  - engine: nftables", "  - engine: userspace", 1) + `        routes:
+          - sni: [www.example.com, "*.example.org"]
+            upstream_group:
+              name: ugroute
+              distribution: round-robin
+              upstreams:
+                - name: uroute
+                  host: 10.0.0.1
+                  port: 443
+`
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(routeConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	routeTestCases := []struct {
+		config string
+		err    error
+	}{
+		{config: strings.Replace(routeConfig, "  - engine: userspace", "  - engine: nftables", 1), err: errConfRoutes},
+		{config: strings.Replace(routeConfig, `"*.example.org"`, `"www.*.org"`, 1), err: errConfRouteSni},
+		{config: strings.Replace(routeConfig, `[www.example.com, "*.example.org"]`, "[]", 1), err: errConfRouteSni},
+		{config: strings.Replace(routeConfig, "name: ugroute", "name: ug2", 1), err: errConfRepUGName},
+		{config: strings.Replace(routeConfig, "name: uroute", "name: t3ug2u2", 1), err: errConfRepUName},
+	}
+	for _, tc := range routeTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(tc.config), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, tc.err)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				tc.err,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on http targets with host and path prefix routes for the userspace engine
+	// and fails on invalid routes or PROXY protocol
+	httpConfig := strings.ReplaceAll(strings.Replace(routeConfig, `sni: [www.example.com, "*.example.org"]`, `host: [www.example.com, "*.example.org"]
+            path_prefix: /api`, 1), "protocol: tcp                           # transport protocol", "protocol: http                          # transport protocol")
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(httpConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	httpTestCases := []struct {
+		config string
+		err    error
+	}{
+		{config: strings.Replace(httpConfig, "  - engine: userspace", "  - engine: nftables", 1), err: errConfTargetProto},
+		{config: strings.Replace(httpConfig, "path_prefix: /api", "path_prefix: api", 1), err: errConfRouteHttp},
+		{config: strings.Replace(httpConfig, `"*.example.org"`, `"www.*.org"`, 1), err: errConfRouteHttp},
+		{config: strings.Replace(httpConfig, "host: [", "sni: [", 1), err: errConfRouteHttp},
+		{config: strings.Replace(routeConfig, "          - sni: [", "          - path_prefix: /api\n            sni: [", 1), err: errConfRouteSni},
+		{config: strings.Replace(httpConfig, "        port: 8080                              # target port\n", "        port: 8080                              # target port\n        proxy_protocol: v1\n", 1), err: errConfProxyProtocol},
+	}
+	for _, tc := range httpTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(tc.config), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, tc.err)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				tc.err,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on http health checks
+	// and fails on invalid health check protocol settings
+	hcHttpConfig := strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", `                protocol: https
+                http:
+                  method: GET
+                  path: /healthz
+                  status: [200, "300-399"]
+                  body_regex: "^ok"
+                  tls:
+                    insecure_skip_verify: true
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(hcHttpConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	hcHttpTestCases := []struct {
+		config string
+		err    error
+	}{
+		{config: strings.Replace(hcHttpConfig, `status: [200, "300-399"]`, `status: [2xx]`, 1), err: errConfHcSettings},
+		{config: strings.Replace(hcHttpConfig, "path: /healthz", "path: healthz", 1), err: errConfHcSettings},
+		{config: strings.Replace(hcHttpConfig, "protocol: https", "protocol: http", 1), err: errConfHcSettings},
+		{config: strings.Replace(hcHttpConfig, "protocol: https", "protocol: tcp", 1), err: errConfHcSettings},
+		{config: strings.Replace(hcHttpConfig, "protocol: https", "protocol: grpc", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: tcp\n                grpc:\n                  service: db\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: grpc\n                grpc:\n                  tls:\n                    ca_file: /nonexistent/ca.pem\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: udp\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: udp\n                udp:\n                  send_hex: 0x00\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: tcp-send-expect\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: tcp-send-expect\n                tcp:\n                  steps:\n                    - expect: \"(\"\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: tcp\n                redis:\n                  role: master\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: redis\n                redis:\n                  role: primary\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: postgres\n                postgres:\n                  database: app\n", 1), err: errConfHcSettings},
+	}
+	for _, tc := range hcHttpTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(tc.config), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, tc.err)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				tc.err,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on icmp health checks without port
+	hcIcmpConfig := strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n                port: 6443                      # health_check port\n", `                protocol: icmp
+                icmp:
+                  count: 3
+                  max_loss: 34
+                  max_rtt: 200
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(hcIcmpConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	hcIcmpTestCases := []struct {
+		config string
+		err    error
+	}{
+		{config: strings.Replace(hcIcmpConfig, "max_loss: 34", "max_loss: 101", 1), err: errConfHcSettings},
+		{config: strings.Replace(hcIcmpConfig, "count: 3", "count: 30", 1), err: errConfHcSettings},
+		{config: strings.Replace(hcIcmpConfig, "protocol: icmp", "protocol: tcp", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: dns\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: dns\n                dns:\n                  name: example.com\n                  type: AAA\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: exec\n", 1), err: errConfHcSettings},
+		{config: strings.Replace(config, "                protocol: tcp                   # health-heck protocol. only tcp supported for now\n", "                protocol: exec\n                exec:\n                  command: [/nonexistent/check-lag]\n", 1), err: errConfHcSettings},
+	}
+	for _, tc := range hcIcmpTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(tc.config), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, tc.err)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				tc.err,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on health check unhealthy interval and backoff
+	// and fails on invalid backoff settings
+	hcBackoffConfig := strings.Replace(config, "                  success_count: 3              # amount of successful health checks to become active\n", `                  success_count: 3
+                  failure_count: 2
+                  unhealthy_interval: 30
+                  backoff:
+                    max_interval: 300
+                    jitter: 20
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(hcBackoffConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	hcBackoffTestCases := []string{
+		// max interval below the unhealthy interval
+		strings.Replace(hcBackoffConfig, "max_interval: 300", "max_interval: 20", 1),
+		// max interval below the check interval, used when no unhealthy interval is set
+		strings.Replace(strings.Replace(hcBackoffConfig, "unhealthy_interval: 30", "unhealthy_interval: 0", 1), "max_interval: 300", "max_interval: 5", 1),
+		strings.Replace(hcBackoffConfig, "jitter: 20", "jitter: 101", 1),
+	}
+	for _, c := range hcBackoffTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(c), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, errConfProbeBackoff)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				errConfProbeBackoff,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on health check host override and source binding
+	// and fails on invalid host, source address or interface
+	hcSourceConfig := strings.Replace(config, "                port: 6443                      # health_check port\n", `                port: 6443
+                host: 192.0.2.10
+                source: 127.0.0.1
+                interface: lo
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(hcSourceConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	hcSourceTestCases := []string{
+		strings.Replace(hcSourceConfig, "host: 192.0.2.10", "host: -invalid-", 1),
+		strings.Replace(hcSourceConfig, "source: 127.0.0.1", "source: lo", 1),
+		strings.Replace(hcSourceConfig, "interface: lo", "interface: lo/0", 1),
+	}
+	for _, c := range hcSourceTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(c), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, errConfHcSettings)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				errConfHcSettings,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on upstream group outlier detection
+	// and fails on invalid outlier detection settings
+	odConfig := strings.Replace(config, "          distribution: round-robin             # ug traffic distribution mode. only round-robin supported for now\n", `          distribution: round-robin
+          outlier_detection:
+            max_failure_ratio: 50
+            min_flows: 5
+            ejection_time: 30
+            max_ejected: 50
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(odConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	odTestCases := []string{
+		strings.Replace(odConfig, "max_failure_ratio: 50", "max_failure_ratio: 0", 1),
+		strings.Replace(odConfig, "max_failure_ratio: 50", "max_failure_ratio: 101", 1),
+		strings.Replace(odConfig, "max_ejected: 50", "max_ejected: 101", 1),
+	}
+	for _, c := range odTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(c), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, errConfOutlier)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				errConfOutlier,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig succeeds on upstream group min healthy percentage and fails above 100
+	minHealthyConfig := strings.Replace(config, "          distribution: round-robin             # ug traffic distribution mode. only round-robin supported for now\n", "          distribution: round-robin\n          min_healthy_percent: 50\n", 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(minHealthyConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(strings.Replace(minHealthyConfig, "min_healthy_percent: 50", "min_healthy_percent: 101", 1)), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, errConfMinHealthy)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			errConfMinHealthy,
+			err,
+		)
+	}
+
+	// confirm checkConfig succeeds on upstream flap dampening and fails on invalid dampening settings
+	dampConfig := strings.Replace(config, "              port: 6443                        # upstream port\n", `              port: 6443
+              dampening:
+                half_life: 60
+                suppress_limit: 3000
+                reuse_limit: 1000
+                max_suppress_time: 600
+`, 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(dampConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	dampTestCases := []string{
+		strings.Replace(dampConfig, "reuse_limit: 1000", "reuse_limit: 3000", 1),
+		strings.Replace(dampConfig, "max_suppress_time: 600", "max_suppress_time: 30", 1),
+	}
+	for _, c := range dampTestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(c), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, errConfDampening)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				errConfDampening,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig fails on iptables chain names exceeding the max length
+	wrongConfig = strings.Replace(config, "  - engine: nftables", "  - engine: iptables\n    name: frontend123", 1)
+	expectedErr = errIptChainName
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
+
+	// confirm checkConfig fails on IPv6 targets and upstreams with the iptables engine
+	iptConfig := strings.Replace(config, "  - engine: nftables", "  - engine: iptables", 1)
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(iptConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); err != nil {
+		t.Error("checkConfig errored unexpectedly", err)
+	}
+	ipv6TestCases := []string{
+		strings.Replace(iptConfig, "        port: 8080                              # target port\n", "        ip: 2001:db8::1\n        port: 8080\n", 1),
+		strings.Replace(iptConfig, "host: 8.8.8.8 ", "host: 2001:db8::2", 1),
+	}
+	for _, c := range ipv6TestCases {
+		configYaml = ConfigYaml{}
+		if err := yaml.Unmarshal([]byte(c), &configYaml); err != nil {
+			t.Error("errored on config yaml parsing", err)
+		}
+		if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+			errors.Is(err, errConfIpv6)) {
+			t.Errorf(
+				"checkConfig should have errored with '%v: %v', but errored with '%v'",
+				errLbCheckConf,
+				errConfIpv6,
+				err,
+			)
+		}
+	}
+
+	// confirm checkConfig fails on invalid instance identifier
+	wrongConfig = "instance: tenant-1\n" + config
+	expectedErr = errConfInstance
+	configYaml = ConfigYaml{}
+	if err := yaml.Unmarshal([]byte(wrongConfig), &configYaml); err != nil {
+		t.Error("errored on config yaml parsing", err)
+	}
+	if err := checkConfig(&configYaml); !(errors.Is(err, errLbCheckConf) &&
+		errors.Is(err, expectedErr)) {
+		t.Errorf(
+			"checkConfig should have errored with '%v: %v', but errored with '%v'",
+			errLbCheckConf,
+			expectedErr,
+			err,
+		)
+	}
 }
 
 func TestGetConfig(t *testing.T) {
@@ -658,33 +1372,50 @@ func TestLbSCompare(t *testing.T) {
 	nlb := &lb{
 		et: lbEngineUnknown,
 	}
+	nnlb := &lb{
+		et:   lbEngineNft,
+		name: "web",
+	}
 	olbs := []*lb{
 		olb,
 	}
 	nlbs := []*lb{
 		olb,
 		nlb,
+		nnlb,
 	}
 
 	expected := struct {
-		kept  *map[lbEngineType]*lb
+		kept  *map[lbId]*lb
 		niuew []*lb
 		old   []*lb
 	}{}
 
-	kept := make(map[lbEngineType]*lb)
-	kept[lbEngineNft] = olb
+	kept := make(map[lbId]*lb)
+	kept[olb.id()] = olb
 	expected.kept = &kept
 
 	k, a, _ := lbsCompare(olbs, nlbs)
 
 	// check kept
-	kr := (*k)[lbEngineNft]
-	if kr[0].et != (*expected.kept)[lbEngineNft].et {
+	kr := (*k)[olb.id()]
+	if kr[0].et != (*expected.kept)[olb.id()].et {
 		t.Errorf(
 			"outcome didn't match for the kept lbs. expected: '%v'\nbut got '%v'",
 			kr[0],
-			(*expected.kept)[lbEngineNft],
+			(*expected.kept)[olb.id()],
+		)
+	}
+	if len(*k) != 1 {
+		t.Errorf("expected 1 kept lb, but got %d", len(*k))
+	}
+
+	// check added load balancer with same engine type, but different name
+	if len(a) != 2 || a[1].id() != nnlb.id() {
+		t.Errorf(
+			"outcome didn't match for the added lbs. expected: '%v'\nbut got '%v'",
+			nnlb,
+			a,
 		)
 	}
 
@@ -709,6 +1440,120 @@ func TestLbSCompare(t *testing.T) {
 	}
 }
 
+func TestCarryState(t *testing.T) {
+	// the health check configuration is parsed on each load balancer, as it is on a reload
+	hcYaml := `
+protocol: http
+port: 80
+start_available: true
+http:
+  path: /health
+  status: ["200-299"]
+`
+	dc := &DampeningConfig{SuppressLimit: 1500}
+	next := time.Now().Add(time.Minute)
+
+	// newLb returns a load balancer as initialized from the configuration
+	newLb := func(fresh bool) *lb {
+		l := &lb{upstreamIps: &[]net.IP{}}
+		ug := &upstreamGroup{name: "ug1"}
+		for _, name := range []string{"u1", "u2", "u3", "u4"} {
+			var hcc HealthCheckConfig
+			if err := yaml.Unmarshal([]byte(hcYaml), &hcc); err != nil {
+				t.Fatal("errored on health check config yaml parsing", err)
+			}
+			u := &upstream{
+				name:      name,
+				host:      "192.0.2.1",
+				port:      80,
+				address:   net.ParseIP("192.0.2.1"),
+				available: true,
+				healthCheck: healthCheck{
+					active:  true,
+					healthy: true,
+					config:  hcc,
+				},
+			}
+			ug.upstreams = append(ug.upstreams, u)
+		}
+		// u3 has no health check and a FQDN host which failed to resolve on the new configuration
+		u3 := ug.upstreams[2]
+		u3.host = "u3.example.com."
+		u3.healthCheck = healthCheck{}
+		if fresh {
+			u3.address = nil
+			u3.available = false
+		}
+		ug.upstreams[3].damp, _ = getFlapDampening(dc, true)
+		for _, u := range ug.upstreams {
+			l.addUpstreamIps(u.address)
+		}
+		l.targets = []*target{{name: "t1", protocol: lbProtoTcp, port: 80, upstreamGroup: ug}}
+
+		return l
+	}
+
+	ol := newLb(false)
+	// u1 became unhealthy
+	ou1 := ol.targets[0].upstreamGroup.upstreams[0]
+	ou1.healthCheck.healthy = false
+	ou1.healthCheck.failCount = 2
+	ou1.healthCheck.probes = 5
+	ou1.available = false
+	// u2 became unhealthy, but its health check configuration changes
+	ou2 := ol.targets[0].upstreamGroup.upstreams[1]
+	ou2.healthCheck.healthy = false
+	ou2.available = false
+	// u3 has a resolved address and a pending DNS check
+	ol.targets[0].upstreamGroup.upstreams[2].dns.next = next
+	// u4 is flapping
+	ou4 := ol.targets[0].upstreamGroup.upstreams[3]
+	now := time.Now()
+	ou4.damp.update(ou4.name, false, now)
+	ou4.damp.update(ou4.name, true, now)
+	ou4.available = false
+
+	nl := newLb(true)
+	nl.targets[0].upstreamGroup.upstreams[1].healthCheck.config.Port = 8080
+	nl.carryState(ol)
+
+	testCases := []struct {
+		name      string
+		available bool
+		probes    uint64
+		address   net.IP
+	}{
+		{name: "u1", available: false, probes: 5, address: net.ParseIP("192.0.2.1")},
+		{name: "u2", available: true, probes: 0, address: net.ParseIP("192.0.2.1")},
+		{name: "u3", available: true, probes: 0, address: net.ParseIP("192.0.2.1")},
+		{name: "u4", available: false, probes: 0, address: net.ParseIP("192.0.2.1")},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := nl.targets[0].upstreamGroup.upstreams[i]
+			if u.available != tc.available {
+				t.Errorf("expected available '%t', but got '%t'", tc.available, u.available)
+			}
+			if u.healthCheck.probes != tc.probes {
+				t.Errorf("expected %d probes, but got %d", tc.probes, u.healthCheck.probes)
+			}
+			if !u.address.Equal(tc.address) {
+				t.Errorf("expected address '%s', but got '%s'", tc.address, u.address)
+			}
+		})
+	}
+
+	if u3 := nl.targets[0].upstreamGroup.upstreams[2]; !u3.dns.next.Equal(next) {
+		t.Errorf("expected next DNS check at '%v', but got '%v'", next, u3.dns.next)
+	}
+	if u4 := nl.targets[0].upstreamGroup.upstreams[3]; !u4.damp.suppressed {
+		t.Errorf("expected a suppressed upstream")
+	}
+	if len(*nl.upstreamIps) != 4 {
+		t.Errorf("expected 4 upstream IPs, but got %d", len(*nl.upstreamIps))
+	}
+}
+
 func TestChecks(t *testing.T) {
 	config := testConfigYaml
 	configYaml := ConfigYaml{}
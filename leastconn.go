@@ -0,0 +1,59 @@
+package main
+
+// Hardcoded settings
+const (
+	// Amount of vmap slots shared across the upstreams for the least-connections distribution mode
+	// The bigger the amount of slots, the more accurate the re-weighting
+	leastConnSlots = 100
+)
+
+// leastConnShares returns the amount of vmap slots for each upstream given its established connections count
+// The shares are inversely proportional to the connections count plus one, so upstreams with fewer
+// connections receive a larger share of new connections
+// Every upstream gets at least one slot, so it keeps receiving new connections
+func leastConnShares(conns []uint32) []int {
+	shares := make([]int, len(conns))
+	if len(conns) == 0 {
+		return shares
+	}
+
+	var sum float64
+	for _, c := range conns {
+		sum += 1 / float64(c+1)
+	}
+
+	for i, c := range conns {
+		shares[i] = int(float64(leastConnSlots)*(1/float64(c+1))/sum + 0.5)
+		if shares[i] < 1 {
+			shares[i] = 1
+		}
+	}
+
+	return shares
+}
+
+// leastConnSequence returns the sequence of upstream indexes to fill the vmap slots for the given shares
+// The smooth weighted round-robin algorithm is used so that the upstreams are interleaved
+// and new connections are not sent in bursts to the same upstream
+func leastConnSequence(shares []int) []int {
+	total := 0
+	for _, s := range shares {
+		total += s
+	}
+
+	seq := make([]int, 0, total)
+	current := make([]int, len(shares))
+	for len(seq) < total {
+		best := 0
+		for i, s := range shares {
+			current[i] += s
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		seq = append(seq, best)
+	}
+
+	return seq
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLeastConnShares(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  []uint32
+		result []int
+	}{
+		{name: "none", input: []uint32{}, result: []int{}},
+		{name: "single", input: []uint32{7}, result: []int{100}},
+		{name: "even", input: []uint32{0, 0}, result: []int{50, 50}},
+		{name: "uneven", input: []uint32{0, 1}, result: []int{67, 33}},
+		{name: "busy", input: []uint32{999, 0}, result: []int{1, 100}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := leastConnShares(tc.input)
+			if !slices.Equal(r, tc.result) {
+				t.Errorf("%s: expected '%v', but got '%v'", tc.name, tc.result, r)
+			}
+		})
+	}
+}
+
+func TestLeastConnSequence(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  []int
+		result []int
+	}{
+		{name: "none", input: []int{}, result: []int{}},
+		{name: "even", input: []int{1, 1, 1}, result: []int{0, 1, 2}},
+		{name: "interleaved", input: []int{2, 1}, result: []int{0, 1, 0}},
+		{name: "weighted", input: []int{5, 1, 1}, result: []int{0, 0, 1, 0, 2, 0, 0}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := leastConnSequence(tc.input)
+			if !slices.Equal(r, tc.result) {
+				t.Errorf("%s: expected '%v', but got '%v'", tc.name, tc.result, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+// Hardcoded settings
+const (
+	// Maglev lookup table size. Must be a prime number
+	// It is much bigger than the expected amount of upstreams in a group,
+	// so the distribution across upstreams is nearly even
+	maglevTableSize = 65537
+	// Seed for the upstream 'offset' hash
+	maglevOffsetSeed = "offset"
+	// Seed for the upstream 'skip' hash
+	maglevSkipSeed = "skip"
+)
+
+// maglevHash hashes a backend name with the given seed
+func maglevHash(name, seed string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte(name))
+
+	return h.Sum64()
+}
+
+// maglevTable computes a Maglev consistent hashing lookup table of size m for the given backend names
+// Each table entry holds the index of a backend in the names slice
+// The backend preference lists (permutations) only depend on each backend name, so when a backend
+// is added or removed, only a small share of the table entries change owner
+// m must be a prime number for the permutations to be complete
+// An empty table is returned if there are no backends
+//
+// See "Maglev: A Fast and Reliable Software Network Load Balancer" (Eisenbud et al., NSDI 2016)
+func maglevTable(names []string, m uint64) []int {
+	n := len(names)
+	if n == 0 || m == 0 {
+		return []int{}
+	}
+
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	for i, name := range names {
+		offsets[i] = maglevHash(name, maglevOffsetSeed) % m
+		if m > 1 {
+			skips[i] = maglevHash(name, maglevSkipSeed)%(m-1) + 1
+		}
+	}
+
+	entry := make([]int, m)
+	for i := range entry {
+		entry[i] = -1
+	}
+	next := make([]uint64, n)
+
+	var filled uint64
+	for {
+		for i := 0; i < n; i++ {
+			// find the next preferred table entry of backend i which is still empty
+			c := (offsets[i] + next[i]*skips[i]) % m
+			for entry[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % m
+			}
+			entry[c] = i
+			next[i]++
+			filled++
+			if filled == m {
+				return entry
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestMaglevTable(t *testing.T) {
+	// empty table without backends
+	if r := maglevTable([]string{}, 13); len(r) != 0 {
+		t.Errorf("expected an empty table, but got '%v'", r)
+	}
+
+	// single backend owns all entries
+	for i, e := range maglevTable([]string{"u1"}, 13) {
+		if e != 0 {
+			t.Errorf("entry %d: expected '0', but got '%d'", i, e)
+		}
+	}
+
+	var names []string
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("u%d", i))
+	}
+	m := uint64(maglevTableSize)
+	table := maglevTable(names, m)
+
+	// all entries are filled and the backends get a nearly even share
+	if uint64(len(table)) != m {
+		t.Errorf("expected table size '%d', but got '%d'", m, len(table))
+	}
+	count := make(map[int]int)
+	for _, e := range table {
+		count[e]++
+	}
+	for i := range names {
+		share := float64(count[i]) / float64(m)
+		if share < 0.09 || share > 0.11 {
+			t.Errorf("backend '%s': expected a share close to 0.1, but got '%f'", names[i], share)
+		}
+	}
+
+	// removing a backend only moves the entries it owned, plus a small disruption
+	reduced := append([]string{}, names[:3]...)
+	reduced = append(reduced, names[4:]...)
+	rtable := maglevTable(reduced, m)
+	moved := 0
+	for i := range table {
+		if table[i] == 3 {
+			continue
+		}
+		if names[table[i]] != reduced[rtable[i]] {
+			moved++
+		}
+	}
+	if float64(moved)/float64(m) > 0.02 {
+		t.Errorf("expected less than 2%% of the entries to move, but %d/%d moved", moved, m)
+	}
+}
+
+func TestGetVmapIndexExprs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		hash    distHash
+		family  byte
+		offsets []uint32
+		hashLen uint32
+	}{
+		{name: "ipv4 source address", hash: distHashSrcAddr, family: unix.NFPROTO_IPV4, offsets: []uint32{12}, hashLen: 4},
+		{name: "ipv4 5-tuple", hash: distHashFiveTuple, family: unix.NFPROTO_IPV4, offsets: []uint32{12, 16, 0}, hashLen: 12},
+		{name: "ipv6 source address", hash: distHashSrcAddr, family: unix.NFPROTO_IPV6, offsets: []uint32{8}, hashLen: 16},
+		{name: "ipv6 5-tuple", hash: distHashFiveTuple, family: unix.NFPROTO_IPV6, offsets: []uint32{8, 24, 0}, hashLen: 36},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exprs := getVmapIndexExprs(&upstreamGroup{distMode: distModeMaglev, distHash: tc.hash}, 13, tc.family)
+
+			// the family is matched before any header field is loaded
+			if c, ok := exprs[1].(*expr.Cmp); !ok || c.Data[0] != tc.family {
+				t.Fatalf("expected a match on family '%d', but got '%v'", tc.family, exprs[1])
+			}
+			var offsets []uint32
+			for _, e := range exprs {
+				if p, ok := e.(*expr.Payload); ok {
+					offsets = append(offsets, p.Offset)
+				}
+			}
+			if !slices.Equal(offsets, tc.offsets) {
+				t.Errorf("expected offsets '%v', but got '%v'", tc.offsets, offsets)
+			}
+			if h := exprs[len(exprs)-1].(*expr.Hash); h.Length != tc.hashLen {
+				t.Errorf("expected hash length %d, but got %d", tc.hashLen, h.Length)
+			}
+		})
+	}
+
+	// round-robin doesn't depend on the family
+	exprs := getVmapIndexExprs(&upstreamGroup{distMode: distModeRR}, 13, unix.NFPROTO_IPV6)
+	if _, ok := exprs[0].(*expr.Numgen); !ok || len(exprs) != 1 {
+		t.Errorf("expected a single numgen expression, but got '%v'", exprs)
+	}
+}
@@ -24,6 +24,10 @@ var lobbySettings = app{
 	maxHcTimerInit: 500,
 	// Seconds to wait for DNS recheck
 	defaultDnsTtl: 25,
+	// Seconds between conntrack reads for the least-connections distribution mode
+	connCheckInterval: 2,
+	// Seconds between conntrack reads for the upstream groups outlier detection
+	outlierCheckInterval: 5,
 	// Number of signal interrupts after which the app just exits without waiting for the graceful shutdown to complete
 	sigIntCounterExit: 3,
 	// Default log level. Set to one of: Critical / Warning / Info / Debug / VerboseDebug
@@ -38,15 +42,19 @@ var lobbySettings = app{
 
 type app struct {
 	appName              string
+	instance             string
 	configFilePath       string
 	systemConfigFilePath string
 	maxHcTimerInit       int
 	defaultDnsTtl        uint32
+	connCheckInterval    uint16
+	outlierCheckInterval uint16
 	sigIntCounterExit    uint8
 	logLevel             LogLevel
 	supportMsg           string
 	supportChannel       string
 	outro                string
+	instanceSet          bool
 }
 
 // Global var initializations
@@ -107,6 +115,10 @@ func signalHandler(s os.Signal, sCh chan struct{}, lbs *[]*lb) {
 	case syscall.SIGTERM:
 		LogCf("Graceful shutdown initiated")
 		sCh <- struct{}{}
+	case syscall.SIGUSR1:
+		for _, l := range *lbs {
+			l.dumpState()
+		}
 	}
 }
 
@@ -114,7 +126,7 @@ func signalHandler(s os.Signal, sCh chan struct{}, lbs *[]*lb) {
 func shutdown(lbs []*lb) {
 	for _, l := range lbs {
 		// Stop load balancer
-		LogCf("Stopping load balancer engine '%s'", l.et.String())
+		LogCf("Stopping load balancer engine '%s'", l.String())
 		l.stop()
 	}
 
@@ -124,6 +136,14 @@ func shutdown(lbs []*lb) {
 func init() {
 	flag.StringVar(&lobbySettings.configFilePath, "c", lobbySettings.configFilePath, "define the config file path with: '-c /path/to/config/file.yaml'\n")
 	flag.StringVar(&dl, "l", lobbySettings.logLevel.String(), "define the verbosity level with: '-l critical/warning/info/debug/verboseDebug'\n")
+	flag.Func("i", "define the instance identifier with: '-i tenant1'. Required to run several instances on the same host\n", func(s string) error {
+		if !isResourceName(s) {
+			return errConfInstance
+		}
+		lobbySettings.instance = s
+		lobbySettings.instanceSet = true
+		return nil
+	})
 	flag.BoolVar(&versionCheck, "v", false, "prints version and exits\n")
 }
 
@@ -150,7 +170,14 @@ func main() {
 		os.Exit(1)
 	}
 
-	LogDf("Initialization succeeded. Starting load balancer engines")
+	LogDf("Initialization succeeded. Cleaning up previous instance leftovers")
+	if err = lbsCleanup(lbs); err != nil {
+		errUserPrint(err)
+		LogCf("Load Balancer start-up failed. Exiting")
+		os.Exit(1)
+	}
+
+	LogDf("Starting load balancer engines")
 	for _, l := range lbs {
 		if err = l.start(); err != nil {
 			errUserPrint(err)
@@ -161,9 +188,9 @@ func main() {
 
 	LogIf("Traffic being load balanced")
 
-	// Create a channel which waits for a SIGHUP, SIGINT or SIGTERM system signals
+	// Create a channel which waits for a SIGHUP, SIGINT, SIGTERM or SIGUSR1 system signals
 	osSigCh := make(chan os.Signal, 1)
-	signal.Notify(osSigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(osSigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	// The system signal channel is dealt through a go routine
 	go func() {
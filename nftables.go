@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"slices"
 	"sync"
 	"time"
 
@@ -21,36 +22,36 @@ const (
 	lobbyNftTableNamePattern = `^%s-\d{%d}$`            // nft table name pattern
 	nftFamily                = nftables.TableFamilyINet // nft table family. INet means both IPv4 and IPv6
 	ugFoModeNftNameSuffix    = "-"                      // Suffix to be used on nftables for upstream groups chain name
+	nftSetElementsChunk      = 512                      // Max amount of set elements per netlink message. Large sets are split to fit the netlink attribute size limit
+	nftMaglevHashSeed        = 0x4c6f6262               // Seed of the jhash used to index the maglev lookup table
+	nftIifSetSuffix          = "-iif"                   // Suffix of the target ingress interfaces set name
+	nftPersistSetSuffix      = "-persist"               // Suffix of the upstream client persistence set name
 )
 
 var (
-	// nft table name to be used by nftables for the application
-	appNftTableName = lobbySettings.appName
 	// default 'postrouting' nftables chain priority
 	defaultPostrChainPrio = *nftables.ChainPriorityFilter
 	// default 'prerouting' nftables chain priority
 	defaultPrerChainPrio = *nftables.ChainPriorityNATDest
-	// regex string to match nft table name
-	lobbyNftTableNameRegex = fmt.Sprintf(
-		lobbyNftTableNamePattern,
-		regexp.QuoteMeta(lobbySettings.appName),
-		len(antnSuffixTimeFormat),
-	)
 	// supported lb engine protocols and distribution modes
 	nftSuppCapabilities = map[lbProto]map[distMode]bool{
 		lbProtoTcp: {
-			distModeRR: true,
+			distModeRR:        true,
+			distModeMaglev:    true,
+			distModeLeastConn: true,
 		},
 	}
 )
 
 // nftables struct
 type nft struct {
+	tablePrefix    string                 // nftables table name prefix. Set from the load balancer resource prefix
 	table          *nftables.Table        // nftables table
 	postrChain     *nftables.Chain        // nftables 'postrouting' chain
 	postrChainPrio nftables.ChainPriority // nftables 'postrouting' chain priority
 	prerChain      *nftables.Chain        // nftables 'prerouting' chain
 	prerChainPrio  nftables.ChainPriority // nftables 'prerouting' chain priority
+	markChain      *nftables.Chain        // nftables 'mark' chain. Only set if upstreams set a firewall mark
 	m              sync.Mutex             // nftables changes mutex
 }
 
@@ -138,14 +139,35 @@ func (n *nft) pushNft(fns ...nftFunc) error {
 	return nil
 }
 
+// nftTableNameRegex returns the regex string to match the nft table names of a given table name prefix
+func nftTableNameRegex(prefix string) string {
+	return fmt.Sprintf(
+		lobbyNftTableNamePattern,
+		regexp.QuoteMeta(prefix),
+		len(antnSuffixTimeFormat),
+	)
+}
+
+// nftInstanceTableNameRegex returns the regex string to match the nft table names
+// of all the load balancers of a given instance identifier
+func nftInstanceTableNameRegex(instance string) string {
+	return fmt.Sprintf(
+		lobbyNftTableNamePattern,
+		instancePrefixRegex(instance),
+		len(antnSuffixTimeFormat),
+	)
+}
+
 // prepareNftables prepares the nftables for the load balancer
-// It checks if there are nft tables which match the application nft tables name pattern
+// It checks if there are nft tables which match the load balancer nft tables name pattern
 // If it finds a match it means this could be some leftover from a previous instance
 // The leftovers can happen for instance upon some kind of crash or uncontrolled failure
-// The function clears any nft tables which match the application nft talbes name pattern
+// The function clears any nft tables which match the given nft tables name regex
+// The regex is scoped to the instance identifier, and to the load balancer name except on start-up cleanup,
+// so the tables of other lobby instances or other load balancers are not touched
 // An errNftPrep error is returned in case of issues when connecting to the netlink,
 // listing nft tables or flushing the nft changes
-func (n *nft) prepareNftables() error {
+func (n *nft) prepareNftables(tnRegex string) error {
 	// Get all nftables tables
 	prepNftFunc := func(c *nftables.Conn) error {
 		tables, err := c.ListTables()
@@ -153,14 +175,14 @@ func (n *nft) prepareNftables() error {
 			return fmt.Errorf("%w: %w: %w", errNftPrep, errNftListTables, err)
 		}
 
-		regex := regexp.MustCompile(lobbyNftTableNameRegex)
+		regex := regexp.MustCompile(tnRegex)
 
 		for _, t := range tables {
 			if regex.MatchString(t.Name) && t.Family == nftFamily {
 				LogDf(
 					"NFT: Found nft table '%s' with the table name matching the pattern (%s) lobby uses as nft table name. Deleting the existing table to not interfere",
 					t.Name,
-					lobbyNftTableNameRegex,
+					tnRegex,
 				)
 				c.DelTable(t)
 			}
@@ -180,7 +202,7 @@ func (n *nft) addLbTable() error {
 	addLbTableFunc := func(c *nftables.Conn) error {
 		n.table = c.AddTable(&nftables.Table{
 			Family: nftFamily,
-			Name:   appNftTableName + "-" + time.Now().Format(antnSuffixTimeFormat),
+			Name:   n.tablePrefix + "-" + time.Now().Format(antnSuffixTimeFormat),
 		})
 
 		return nil
@@ -201,9 +223,11 @@ func (n *nft) start(l *lb) error {
 
 // startOrReconfig is used to start or reconfig the nftables based on the load balancer current definition
 func (n *nft) startOrReconfig(l *lb, refresh bool) error {
+	n.tablePrefix = l.resourcePrefix()
+
 	if !refresh {
 		LogDf("NFT: nft initialization requested")
-		err := n.prepareNftables()
+		err := n.prepareNftables(nftTableNameRegex(n.tablePrefix))
 		if err != nil {
 			return fmt.Errorf("%w: %w", errNftInit, err)
 		}
@@ -332,7 +356,50 @@ func (n *nft) startOrReconfig(l *lb, refresh bool) error {
 		})
 		return nil
 	}
-	if err = n.pushNft(setMasqueradeFunc, addPrerChainFunc); err != nil {
+	// Mangle prerouting chain restores the packet mark from the conntrack mark
+	// NAT chains only see the first packet of a flow, so the upstream chains can't mark
+	// the following packets of the flow in either direction
+	addMarkChainFunc := func(c *nftables.Conn) error {
+		marks := ctMarks(l)
+		if len(marks) == 0 {
+			return nil
+		}
+
+		n.markChain = c.AddChain(&nftables.Chain{
+			Name:     "mark",
+			Table:    n.table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityMangle,
+		})
+		for _, m := range marks {
+			c.AddRule(&nftables.Rule{
+				Table: n.table,
+				Chain: n.markChain,
+				Exprs: []expr.Any{
+					// [ ct load mark => reg 1 ]
+					&expr.Ct{
+						Key:      expr.CtKeyMARK,
+						Register: 1,
+					},
+					// [ cmp eq reg 1 mark ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     binaryutil.NativeEndian.PutUint32(m),
+					},
+					// [ meta set mark with reg 1 ]
+					&expr.Meta{
+						Key:            expr.MetaKeyMARK,
+						SourceRegister: true,
+						Register:       1,
+					},
+				},
+			})
+		}
+		return nil
+	}
+	if err = n.pushNft(setMasqueradeFunc, addPrerChainFunc, addMarkChainFunc); err != nil {
 		if err != nil {
 			return fmt.Errorf("%w: %w", errNftInit, err)
 		}
@@ -386,38 +453,278 @@ func (n *nft) stop() error {
 
 // getVmapElements returns a list of nftables.SetElement for a given target
 // a nftables.SetElement in this context is a nftables veredict to jump to a upstream chain
+// For the maglev distribution mode, the elements are the maglev lookup table entries
+// For the least-connections distribution mode, the elements are the upstreams weighted slots
+// Otherwise, there is one element per serving upstream, which are the available upstreams unless the
+// upstream group is in panic mode
 func getVmapElements(t *target) *[]nftables.SetElement {
-	var vmapElements []nftables.SetElement
-	activeCount := 0
+	switch t.upstreamGroup.distMode {
+	case distModeMaglev:
+		return getMaglevVmapElements(t)
+	case distModeLeastConn:
+		return getLeastConnVmapElements(t)
+	}
 
-	for _, u := range t.upstreamGroup.upstreams {
-		if u.available {
-			vmape := nftables.SetElement{
-				Key: binaryutil.NativeEndian.PutUint16(uint16(activeCount)),
-				VerdictData: &expr.Verdict{
-					Kind:  unix.NFT_JUMP,
-					Chain: u.name,
-				},
-			}
+	var vmapElements []nftables.SetElement
 
-			vmapElements = append(vmapElements, vmape)
-			activeCount++
+	for i, u := range t.upstreamGroup.servingUpstreams() {
+		vmape := nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint16(uint16(i)),
+			VerdictData: &expr.Verdict{
+				Kind:  unix.NFT_JUMP,
+				Chain: u.name,
+			},
 		}
+
+		vmapElements = append(vmapElements, vmape)
 	}
 
 	return &vmapElements
 }
 
-// numActiveUpstreams returns the number of active upstreams
-func numActiveUpstreams(t *target) uint16 {
-	nActiveUpstreams := uint16(0)
-	for _, u := range t.upstreamGroup.upstreams {
-		if u.available {
-			nActiveUpstreams++
+// getMaglevVmapElements returns the maglev lookup table for a given target as a list of nftables.SetElement
+// The table is computed from the available upstreams names, so that a change on one upstream
+// availability only remaps the clients of that upstream
+func getMaglevVmapElements(t *target) *[]nftables.SetElement {
+	au := t.upstreamGroup.servingUpstreams()
+	var names []string
+	for _, u := range au {
+		names = append(names, u.name)
+	}
+
+	table := maglevTable(names, maglevTableSize)
+	vmapElements := make([]nftables.SetElement, 0, len(table))
+	for i, e := range table {
+		vmapElements = append(vmapElements, nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint32(uint32(i)),
+			VerdictData: &expr.Verdict{
+				Kind:  unix.NFT_JUMP,
+				Chain: au[e].name,
+			},
+		})
+	}
+
+	return &vmapElements
+}
+
+// getLeastConnVmapElements returns the least-connections weighted slots for a given target as a list of nftables.SetElement
+// Upstreams with fewer established connections get more slots and so a larger share of new connections
+// The applied shares are recorded in the target, so the connections count check can tell when a re-weight is needed
+func getLeastConnVmapElements(t *target) *[]nftables.SetElement {
+	au := t.upstreamGroup.servingUpstreams()
+
+	t.leastConnShares = upstreamsLeastConnShares(t)
+	seq := leastConnSequence(t.leastConnShares)
+	vmapElements := make([]nftables.SetElement, 0, len(seq))
+	for i, e := range seq {
+		vmapElements = append(vmapElements, nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint16(uint16(i)),
+			VerdictData: &expr.Verdict{
+				Kind:  unix.NFT_JUMP,
+				Chain: au[e].name,
+			},
+		})
+	}
+
+	return &vmapElements
+}
+
+// getVmapKeyType returns the vmap key type for a given distribution mode
+// The maglev lookup table doesn't fit the 16 bit inet_service type
+func getVmapKeyType(dm distMode) nftables.SetDatatype {
+	if dm == distModeMaglev {
+		return nftables.TypeInteger
+	}
+
+	return nftables.TypeInetService
+}
+
+// getVmapIndexExprs returns the nftables expressions which load the vmap index into register 1
+// For the maglev distribution mode, the index is a hash of the configured distribution hash input
+// As the header field offsets depend on the network protocol family, the expressions first match the
+// given family (NFPROTO_IPV4 or NFPROTO_IPV6), so a rule is needed per family
+// Otherwise, an incremental number generator is used for round-robin and the family is not matched
+func getVmapIndexExprs(ug *upstreamGroup, numElements uint32, family byte) []expr.Any {
+	if ug.distMode != distModeMaglev {
+		return []expr.Any{
+			&expr.Numgen{
+				Register: 1,
+				Type:     unix.NFT_NG_INCREMENTAL,
+				Modulus:  numElements,
+				Offset:   0,
+			},
 		}
 	}
 
-	return nActiveUpstreams
+	// saddr and daddr offsets and length
+	saddr, daddr, addrLen := uint32(12), uint32(16), uint32(4)
+	if family == unix.NFPROTO_IPV6 {
+		saddr, daddr, addrLen = 8, 24, 16
+	}
+
+	exprs := []expr.Any{
+		// [ meta load nfproto => reg 1 ]
+		&expr.Meta{
+			Key:      expr.MetaKeyNFPROTO,
+			Register: 1,
+		},
+		// [ cmp eq reg 1 family ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{family},
+		},
+		// [ payload load addrLen @ network header + saddr => reg 1 ] (saddr)
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       saddr,
+			Len:          addrLen,
+		},
+	}
+	hashLen := addrLen
+
+	if ug.distHash == distHashFiveTuple {
+		// [ payload load addrLen @ network header + daddr => reg ] (daddr)
+		// [ payload load 4b @ transport header + 0 => reg ] (sport . dport)
+		// The fields are loaded on the 32 bit registers following the ones holding the previous field,
+		// so the hash is performed on the concatenation of the loaded fields
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: unix.NFT_REG32_00 + addrLen/4,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       daddr,
+				Len:          addrLen,
+			},
+			&expr.Payload{
+				DestRegister: unix.NFT_REG32_00 + 2*addrLen/4,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       0,
+				Len:          4,
+			},
+		)
+		hashLen = 2*addrLen + 4
+	}
+
+	// [ hash reg 1 = jhash(reg 1, hashLen, seed) % mod ]
+	exprs = append(exprs, &expr.Hash{
+		SourceRegister: 1,
+		DestRegister:   1,
+		Length:         hashLen,
+		Modulus:        numElements,
+		Seed:           nftMaglevHashSeed,
+		Type:           expr.HashTypeJenkins,
+	})
+
+	return exprs
+}
+
+// addVmap adds the vmap set with the given elements
+// The elements are added in chunks as a single netlink message can't hold large sets
+func addVmap(c *nftables.Conn, s *nftables.Set, vmapElements []nftables.SetElement) error {
+	if err := c.AddSet(s, nil); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(vmapElements); i += nftSetElementsChunk {
+		end := i + nftSetElementsChunk
+		if end > len(vmapElements) {
+			end = len(vmapElements)
+		}
+		if err := c.SetAddElements(s, vmapElements[i:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// numActiveUpstreams returns the number of serving upstreams
+func numActiveUpstreams(t *target) uint16 {
+	return uint16(len(t.upstreamGroup.servingUpstreams()))
+}
+
+// ifnameKey returns the nftables set key for an interface name
+// Interface names are null padded to the kernel interface name size
+func ifnameKey(name string) []byte {
+	key := make([]byte, unix.IFNAMSIZ)
+	copy(key, name)
+
+	return key
+}
+
+// prerRuleExprs returns the nftables expressions of the target 'prerouting' chain rule
+// The rule matches the target protocol and port, and the ingress interfaces if set,
+// and then jumps to the given upstream group failover chain
+// The jump verdict is always the last expression
+func prerRuleExprs(t *target, chain string) []expr.Any {
+	var exprs []expr.Any
+
+	if t.nftIifSet != nil {
+		exprs = append(exprs,
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{
+				Key:      expr.MetaKeyIIFNAME,
+				Register: 1,
+			},
+			// [ lookup reg 1 set target-iif ]
+			&expr.Lookup{
+				SourceRegister: 1,
+				SetName:        t.nftIifSet.Name,
+				SetID:          t.nftIifSet.ID,
+			},
+		)
+	}
+
+	return append(exprs,
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{
+			Key:      expr.MetaKeyL4PROTO,
+			Register: 1,
+		},
+		// [ cmp eq reg 1 0x00000006 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.IPPROTO_TCP},
+		},
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		// [ cmp eq reg 1 0x0000901f ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(t.port),
+		},
+		// [ objref type 1 name counterName ]
+		&expr.Objref{
+			Type: 1,
+			Name: t.upstreamGroup.nftCounter.Name,
+		},
+		// [ immediate reg 0 jump -> chain ]
+		&expr.Verdict{
+			Kind:  expr.VerdictKind(unix.NFT_JUMP),
+			Chain: chain,
+		},
+	)
+}
+
+// prerRuleChain returns the chain a 'prerouting' chain rule jumps to
+// An empty string is returned if the rule doesn't end with a jump verdict
+func prerRuleChain(r *nftables.Rule) string {
+	if len(r.Exprs) == 0 {
+		return ""
+	}
+	if v, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict); ok {
+		return v.Chain
+	}
+
+	return ""
 }
 
 // updateTarget updates the nftables for a given lb target
@@ -441,7 +748,8 @@ func (n *nft) updateTarget(t *target) error {
 	defer c.CloseLasting()
 
 	// Get number of active upstreams
-	nActiveUpstreams := numActiveUpstreams(t)
+	serving := t.upstreamGroup.servingUpstreams()
+	nActiveUpstreams := uint16(len(serving))
 	// Number of configured upstreams
 	numUpstreams := uint16(len(t.upstreamGroup.upstreams))
 	if nActiveUpstreams == 0 {
@@ -494,45 +802,63 @@ func (n *nft) updateTarget(t *target) error {
 			LogDf("NFT: Setting up chain for upstream %s in table %s", u.name, n.table.Name)
 			LogDf("NFT: Upstream address is %s:%d", u.address.String(), u.port)
 			if u.address != nil {
+				if err := n.addPersistSet(c, u); err != nil {
+					return fmt.Errorf("%w: %w", errNftUpdateTarget, err)
+				}
 				c.AddRule(&nftables.Rule{
 					Table: n.table,
 					Chain: c.AddChain(&nftables.Chain{
 						Name:  u.name,
 						Table: n.table,
 					}),
-					Exprs: []expr.Any{
-						&expr.Immediate{
-							Register: 1,
-							Data:     u.address.To4(),
-						},
-						&expr.Immediate{
-							Register: 2,
-							Data:     binaryutil.BigEndian.PutUint16(u.port),
-						},
-						&expr.NAT{
-							Type:        expr.NATTypeDestNAT,
-							Family:      unix.NFPROTO_IPV4,
-							RegAddrMin:  1,
-							RegAddrMax:  0,
-							RegProtoMin: 2,
-							RegProtoMax: 0,
-						},
-					},
+					Exprs: upstreamChainExprs(u),
 				})
 			}
 		}
+
+		// Persisted clients of upstreams not serving are forgotten
+		// so they are not sent back to the upstream once it becomes available again
+		if u.nftPersistSet != nil && !slices.Contains(serving, u) {
+			c.FlushSet(u.nftPersistSet)
+		}
 	}
 
 	// New set with active upstreams
 	t.upstreamGroup.nftUgSet[ugFM] = &nftables.Set{
 		Name:     ugName,
 		Table:    n.table,
-		KeyType:  nftables.TypeInetService,
+		KeyType:  getVmapKeyType(t.upstreamGroup.distMode),
 		DataType: nftables.TypeVerdict,
 		IsMap:    true,
 	}
 	vmapElements := getVmapElements(t)
-	c.AddSet(t.upstreamGroup.nftUgSet[ugFM], *vmapElements)
+	if err := addVmap(c, t.upstreamGroup.nftUgSet[ugFM], *vmapElements); err != nil {
+		return fmt.Errorf("%w: %w", errNftUpdateTarget, err)
+	}
+
+	// Client persistence rules
+	// Clients recorded in the persistence set of a serving upstream keep being sent to it
+	for _, u := range serving {
+		if u.nftPersistSet != nil {
+			c.AddRule(&nftables.Rule{
+				Table: n.table,
+				Chain: t.upstreamGroup.nftUgChain[ugFM],
+				Exprs: append(persistSaddrExprs(),
+					// [ lookup reg 1 set upstream-persist ]
+					&expr.Lookup{
+						SourceRegister: 1,
+						SetName:        u.nftPersistSet.Name,
+						SetID:          u.nftPersistSet.ID,
+					},
+					// [ immediate reg 0 jump -> upstream chain ]
+					&expr.Verdict{
+						Kind:  expr.VerdictKind(unix.NFT_JUMP),
+						Chain: u.name,
+					},
+				),
+			})
+		}
+	}
 
 	// New failover chain rule
 	if nActiveUpstreams == 0 {
@@ -544,25 +870,27 @@ func (n *nft) updateTarget(t *target) error {
 			},
 		})
 	} else {
-		t.upstreamGroup.nftUgChainRule[ugFM] = c.AddRule(&nftables.Rule{
-			Table: n.table,
-			Chain: t.upstreamGroup.nftUgChain[ugFM],
-			Exprs: []expr.Any{
-				&expr.Numgen{
-					Register: 1,
-					Type:     unix.NFT_NG_INCREMENTAL,
-					Modulus:  uint32(len(*vmapElements)),
-					Offset:   0,
-				},
-				&expr.Lookup{
-					SourceRegister: 1,
-					DestRegister:   0,
-					SetName:        t.upstreamGroup.nftUgSet[ugFM].Name,
-					SetID:          t.upstreamGroup.nftUgSet[ugFM].ID,
-					IsDestRegSet:   true,
-				},
-			},
-		})
+		families := []byte{unix.NFPROTO_IPV4}
+		if t.upstreamGroup.distMode == distModeMaglev {
+			// The maglev hash input depends on the network protocol family
+			families = append(families, unix.NFPROTO_IPV6)
+		}
+		for _, f := range families {
+			t.upstreamGroup.nftUgChainRule[ugFM] = c.AddRule(&nftables.Rule{
+				Table: n.table,
+				Chain: t.upstreamGroup.nftUgChain[ugFM],
+				Exprs: append(
+					getVmapIndexExprs(t.upstreamGroup, uint32(len(*vmapElements)), f),
+					&expr.Lookup{
+						SourceRegister: 1,
+						DestRegister:   0,
+						SetName:        t.upstreamGroup.nftUgSet[ugFM].Name,
+						SetID:          t.upstreamGroup.nftUgSet[ugFM].ID,
+						IsDestRegSet:   true,
+					},
+				),
+			})
+		}
 	}
 
 	// Check if counter objects already exist
@@ -579,39 +907,27 @@ func (n *nft) updateTarget(t *target) error {
 			t.name,
 			ugName,
 		)
+
+		// Ingress interfaces set
+		if len(t.interfaces) != 0 {
+			t.nftIifSet = &nftables.Set{
+				Name:    t.name + nftIifSetSuffix,
+				Table:   n.table,
+				KeyType: nftables.TypeIFName,
+			}
+			var iifElements []nftables.SetElement
+			for _, i := range t.interfaces {
+				iifElements = append(iifElements, nftables.SetElement{Key: ifnameKey(i)})
+			}
+			if err := c.AddSet(t.nftIifSet, iifElements); err != nil {
+				return fmt.Errorf("%w: %w", errNftUpdateTarget, err)
+			}
+		}
+
 		t.nftPrerRule[ugFM] = c.AddRule(&nftables.Rule{
 			Table: n.table,
 			Chain: n.prerChain,
-			Exprs: []expr.Any{
-				&expr.Meta{
-					Key:      expr.MetaKeyL4PROTO,
-					Register: 1,
-				},
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{unix.IPPROTO_TCP},
-				},
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseTransportHeader,
-					Offset:       2,
-					Len:          2,
-				},
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     binaryutil.BigEndian.PutUint16(t.port),
-				},
-				&expr.Objref{
-					Type: 1,
-					Name: t.upstreamGroup.nftCounter.Name,
-				},
-				&expr.Verdict{
-					Kind:  expr.VerdictKind(unix.NFT_JUMP),
-					Chain: ugName,
-				},
-			},
+			Exprs: prerRuleExprs(t, ugName),
 		})
 
 		t.nftRuleInit = true
@@ -620,47 +936,12 @@ func (n *nft) updateTarget(t *target) error {
 		rules, _ := c.GetRules(n.table, n.prerChain)
 
 		for _, r := range rules {
-			if t.nftPrerRule[t.upstreamGroup.previousFailoverMode].Exprs[5].(*expr.Verdict).Chain == r.Exprs[5].(*expr.Verdict).Chain {
+			if prerRuleChain(t.nftPrerRule[t.upstreamGroup.previousFailoverMode]) == prerRuleChain(r) {
 				t.nftPrerRule[ugFM] = c.ReplaceRule(&nftables.Rule{
 					Table:  n.table,
 					Chain:  n.prerChain,
 					Handle: r.Handle,
-					Exprs: []expr.Any{
-						// [ meta load l4proto => reg 1 ]
-						&expr.Meta{
-							Key:      expr.MetaKeyL4PROTO,
-							Register: 1,
-						},
-						// [ cmp eq reg 1 0x00000006 ]
-						&expr.Cmp{
-							Op:       expr.CmpOpEq,
-							Register: 1,
-							Data:     []byte{unix.IPPROTO_TCP},
-						},
-						// [ payload load 2b @ transport header + 2 => reg 1 ]
-						&expr.Payload{
-							DestRegister: 1,
-							Base:         expr.PayloadBaseTransportHeader,
-							Offset:       2,
-							Len:          2,
-						},
-						// [ cmp eq reg 1 0x0000901f ]
-						&expr.Cmp{
-							Op:       expr.CmpOpEq,
-							Register: 1,
-							Data:     binaryutil.BigEndian.PutUint16(t.port),
-						},
-						// [ objref type 1 name counterName ]
-						&expr.Objref{
-							Type: 1,
-							Name: t.upstreamGroup.nftCounter.Name,
-						},
-						// [ immediate reg 0 jump -> chain ]
-						&expr.Verdict{
-							Kind:  expr.VerdictKind(unix.NFT_JUMP),
-							Chain: t.upstreamGroup.nftUgChain[ugFM].Name,
-						},
-					},
+					Exprs:  prerRuleExprs(t, t.upstreamGroup.nftUgChain[ugFM].Name),
 				})
 			}
 		}
@@ -814,6 +1095,133 @@ func (n *nft) cleanMasquerade(lip *[]net.IP) error {
 	return nil
 }
 
+// upstreamChainExprs returns the nftables expressions of the upstream chain rule
+// If the upstream has a firewall mark, the packet mark is set before the DNAT,
+// and also the conntrack mark if requested, so the whole flow can be policy routed
+func upstreamChainExprs(u *upstream) []expr.Any {
+	var exprs []expr.Any
+
+	if u.nftPersistSet != nil {
+		exprs = append(persistSaddrExprs(),
+			// [ dynset update reg_key 1 timeout persistence timeout set upstream-persist ]
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   u.nftPersistSet.Name,
+				SetID:     u.nftPersistSet.ID,
+				Operation: unix.NFT_DYNSET_OP_UPDATE,
+				Timeout:   time.Duration(u.persistTimeout) * time.Second,
+			},
+		)
+	}
+
+	if u.fwmark != 0 {
+		exprs = append(exprs,
+			// [ immediate reg 1 mark ]
+			&expr.Immediate{
+				Register: 1,
+				Data:     binaryutil.NativeEndian.PutUint32(u.fwmark),
+			},
+			// [ meta set mark with reg 1 ]
+			&expr.Meta{
+				Key:            expr.MetaKeyMARK,
+				SourceRegister: true,
+				Register:       1,
+			},
+			// [ ct set mark with reg 1 ]
+			// The nat chains only see the first packet of the connection, so the conntrack mark is set
+			// for the mark chain to restore the packet mark on the following packets
+			&expr.Ct{
+				Key:            expr.CtKeyMARK,
+				SourceRegister: true,
+				Register:       1,
+			},
+		)
+	}
+
+	return append(exprs,
+		// [ immediate reg 1 upstream address ]
+		&expr.Immediate{
+			Register: 1,
+			Data:     u.address.To4(),
+		},
+		// [ immediate reg 2 upstream port ]
+		&expr.Immediate{
+			Register: 2,
+			Data:     binaryutil.BigEndian.PutUint16(u.port),
+		},
+		// [ nat dnat ip addr_min reg 1 proto_min reg 2 ]
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegAddrMax:  0,
+			RegProtoMin: 2,
+			RegProtoMax: 0,
+		},
+	)
+}
+
+// persistSaddrExprs returns the nftables expressions which load the client address into register 1
+// to record it in or to look it up on a client persistence set
+// As upstreams are only reached through IPv4 DNAT, client persistence only applies to IPv4 clients,
+// so the expressions first match the IPv4 family and the rest of the rule is skipped for other families
+func persistSaddrExprs() []expr.Any {
+	return []expr.Any{
+		// [ meta load nfproto => reg 1 ]
+		&expr.Meta{
+			Key:      expr.MetaKeyNFPROTO,
+			Register: 1,
+		},
+		// [ cmp eq reg 1 0x00000002 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.NFPROTO_IPV4},
+		},
+		// [ payload load 4b @ network header + 12 => reg 1 ] (ip saddr)
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       12,
+			Len:          4,
+		},
+	}
+}
+
+// addPersistSet adds the client persistence set of an upstream, if its upstream group has client persistence
+// The set records the client addresses sent to the upstream. Its elements expire after the persistence
+// timeout, which is refreshed on every new connection from the client
+func (n *nft) addPersistSet(c *nftables.Conn, u *upstream) error {
+	if u.persistTimeout == 0 {
+		return nil
+	}
+
+	u.nftPersistSet = &nftables.Set{
+		Name:       u.name + nftPersistSetSuffix,
+		Table:      n.table,
+		KeyType:    nftables.TypeIPAddr,
+		HasTimeout: true,
+		Timeout:    time.Duration(u.persistTimeout) * time.Second,
+		Dynamic:    true,
+	}
+
+	return c.AddSet(u.nftPersistSet, nil)
+}
+
+// ctMarks returns the unique firewall marks, also set as conntrack marks, of the load balancer upstreams
+func ctMarks(l *lb) []uint32 {
+	var marks []uint32
+	for _, t := range l.targets {
+		for _, u := range t.upstreamGroup.upstreams {
+			if u.fwmark != 0 && !slices.Contains(marks, u.fwmark) {
+				marks = append(marks, u.fwmark)
+			}
+		}
+	}
+
+	return marks
+}
+
 // updateUpstreamChain updates the nftables upstream chain
 // It checks if the upstream chain rule already exists and adds if not
 // Otherwise, it replaces the existing rule
@@ -842,51 +1250,20 @@ func (n *nft) updateUpstreamChain(u *upstream) error {
 				Table:  n.table,
 				Chain:  ucr[0].Chain,
 				Handle: ucr[0].Handle,
-				Exprs: []expr.Any{
-					&expr.Immediate{
-						Register: 1,
-						Data:     u.address.To4(),
-					},
-					&expr.Immediate{
-						Register: 2,
-						Data:     binaryutil.BigEndian.PutUint16(u.port),
-					},
-					&expr.NAT{
-						Type:        expr.NATTypeDestNAT,
-						Family:      unix.NFPROTO_IPV4,
-						RegAddrMin:  1,
-						RegAddrMax:  0,
-						RegProtoMin: 2,
-						RegProtoMax: 0,
-					},
-				},
+				Exprs:  upstreamChainExprs(u),
 			})
 		} else {
 			LogDVf("NFT: upstream chain rule does not exists yet. Adding chain")
+			if err := n.addPersistSet(c, u); err != nil {
+				return err
+			}
 			c.AddRule(&nftables.Rule{
 				Table: n.table,
 				Chain: c.AddChain(&nftables.Chain{
 					Name:  u.name,
 					Table: n.table,
 				}),
-				Exprs: []expr.Any{
-					&expr.Immediate{
-						Register: 1,
-						Data:     u.address.To4(),
-					},
-					&expr.Immediate{
-						Register: 2,
-						Data:     binaryutil.BigEndian.PutUint16(u.port),
-					},
-					&expr.NAT{
-						Type:        expr.NATTypeDestNAT,
-						Family:      unix.NFPROTO_IPV4,
-						RegAddrMin:  1,
-						RegAddrMax:  0,
-						RegProtoMin: 2,
-						RegProtoMax: 0,
-					},
-				},
+				Exprs: upstreamChainExprs(u),
 			})
 		}
 		return nil
@@ -959,6 +1336,15 @@ func (n *nft) reconfig(nl *lb) error {
 	return nil
 }
 
+// cleanup deletes the nft tables left by any load balancer of the given instance identifier
+func (n *nft) cleanup(instance string) error {
+	if err := n.prepareNftables(nftInstanceTableNameRegex(instance)); err != nil {
+		return fmt.Errorf("%w: %w", errNftInit, err)
+	}
+
+	return nil
+}
+
 // getCapabilities provides the nftables supported lb capabilities
 func (n *nft) getCapabilities() map[lbProto]map[distMode]bool {
 	return nftSuppCapabilities
@@ -1001,49 +1387,7 @@ func (n *nft) checkPermissions() error {
 // This function checks if all the dependencies are satisfied for the nft load balancer to be able to operate successfully
 // A check is performed on the IPv4 and IPv6 IP forwarding as this is required for the nftables to be able to process
 // traffic to other IP addresses that do not belong to the server which is hosting the Load Balancer
-// However, in case it is not confirmed that IPv4 and IPv6 are enabled the Load Balancer an error will not be returned
-// It will just log a warning message, because there are scenarios in which the Load Balancer can be used without
-// requiring IP packets to be forward to another server
+// See checkIpFwdDependency for details
 func (n *nft) checkDependencies() error {
-	LogDf("Dependencies check: checking if IP forwarding is system enabled")
-	ipF, err := checkIpFwd()
-	if err != nil {
-		return err
-	}
-
-	switch ipF {
-	case ipFwdUnknown:
-		LogWf("Dependencies check: skipped IP forwarding settings check")
-	case ipFwdNone:
-		LogWf(
-			"Dependencies check: IPv4 Forwarding Check Result: FAILED. IPv4 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv4 traffic use cases. Make sure the IPv4 forwarding is correctly configured to prevent any issues",
-		)
-		LogWf(
-			"Dependencies check: IPv6 Forwarding Check Result: FAILED. IPv6 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv6 traffic use cases. Make sure the IPv6 forwarding is correctly configured to prevent any issues",
-		)
-	case ipFwdAll:
-		LogDf(
-			"Dependencies check: IPv4 Forwarding Check Result: SUCCEEDED. IPv4 forwarding seems to be generally enabled",
-		)
-		LogDf(
-			"Dependencies check: IPv6 Forwarding Check Result: SUCCEEDED. IPv6 forwarding seems to be generally enabled",
-		)
-	case ipFwdV4Only:
-		LogDf(
-			"Dependencies check: IPv4 Forwarding Check Result: SUCCEEDED. IPv4 forwarding seems to be generally enabled",
-		)
-		LogWf(
-			"Dependencies check: IPv6 Forwarding Check Result: FAILED. IPv6 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv6 traffic use cases. Make sure the IPv6 forwarding is correctly configured to prevent any issues",
-		)
-	case ipFwdV6Only:
-		LogWf(
-			"Dependencies check: IPv4 Forwarding Check Result: FAILED. IPv4 forwarding seems to be generally disabled at system level. This is not a critical error, but the Load Balancer may not function as expected for IPv4 traffic use cases. Make sure the IPv4 forwarding is correctly configured to prevent any issues",
-		)
-		LogDf(
-			"Dependencies check: IPv6 Forwarding Check Result: SUCCEEDED. IPv6 forwarding seems to be generally enabled",
-		)
-	}
-
-	LogDf("Dependencies check completed")
-	return nil
+	return checkIpFwdDependency()
 }
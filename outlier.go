@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Outlier detection settings
+const (
+	odMinFlows     = 10 // default min tracked flows of an upstream for it to be evaluated
+	odEjectionTime = 30 // default ejection time in seconds
+	odMaxEjected   = 50 // default max ejected upstreams percentage of an upstream group
+)
+
+// Outlier detection errors
+var (
+	errOdMaxFailureRatio = errors.New(
+		"outlier detection 'max_failure_ratio' must be a percentage between 1 and 100",
+	)
+	errOdMaxEjected = errors.New(
+		"outlier detection 'max_ejected' must be a percentage between 0 and 100",
+	)
+)
+
+// outlierDetection holds the upstream group passive health checking settings
+// Upstreams are ejected when the ratio of their failed flows observed in conntrack is above the threshold
+type outlierDetection struct {
+	maxFailureRatio uint8         // failed flows percentage above which an upstream is ejected
+	minFlows        uint32        // min tracked flows of an upstream for it to be evaluated
+	ejectionTime    time.Duration // time an ejected upstream stays unavailable
+	maxEjected      uint8         // max ejected upstreams percentage. At least one upstream can always be ejected
+}
+
+// getOutlierDetection returns the outlier detection settings
+func getOutlierDetection(c *OutlierDetectionConfig) (*outlierDetection, error) {
+	if c.MaxFailureRatio == 0 || c.MaxFailureRatio > 100 {
+		return nil, fmt.Errorf("%w: %d", errOdMaxFailureRatio, c.MaxFailureRatio)
+	}
+	if c.MaxEjected > 100 {
+		return nil, fmt.Errorf("%w: %d", errOdMaxEjected, c.MaxEjected)
+	}
+
+	od := &outlierDetection{
+		maxFailureRatio: c.MaxFailureRatio,
+		minFlows:        odMinFlows,
+		ejectionTime:    odEjectionTime * time.Second,
+		maxEjected:      odMaxEjected,
+	}
+	if c.MinFlows != 0 {
+		od.minFlows = c.MinFlows
+	}
+	if c.EjectionTime != 0 {
+		od.ejectionTime = time.Duration(c.EjectionTime) * time.Second
+	}
+	if c.MaxEjected != 0 {
+		od.maxEjected = c.MaxEjected
+	}
+
+	return od, nil
+}
+
+// outlier checks if the upstream flows counters are above the failed flows threshold
+func (od *outlierDetection) outlier(s ctStats) bool {
+	return s.flows >= od.minFlows && uint64(s.failed)*100 > uint64(s.flows)*uint64(od.maxFailureRatio)
+}
+
+// ejected checks if the upstream is ejected
+// It must be called with the healthcheck mutex locked
+func (u *upstream) ejected() bool {
+	return !u.ejectedUntil.IsZero()
+}
+
+// detectOutliers restores the upstreams whose ejection time is over and
+// ejects the available upstreams whose failed flows ratio is above the threshold
+// stats holds the TCP flows counters per upstream, as returned by ctTcpStats
+// It returns true if the availability of any upstream changed
+func (ug *upstreamGroup) detectOutliers(stats map[string]ctStats, now time.Time) bool {
+	od := ug.outlier
+	changed := false
+
+	// Restore the upstreams whose ejection time is over
+	// An upstream with an active health check is only restored if it's healthy
+	// The availability of the held upstreams is refreshed, which also lifts expired flap dampening suppressions
+	ejected := 0
+	for _, u := range ug.upstreams {
+		hc := &u.healthCheck
+		hc.m.Lock()
+		wasAvailable := u.available
+		held := u.ejected() || (u.damp != nil && u.damp.suppressed)
+		if u.ejected() && !now.Before(u.ejectedUntil) {
+			u.ejectedUntil = time.Time{}
+			LogIf("LB OD (%s): upstream ejection time is over", u.name)
+		}
+		if u.ejected() {
+			ejected++
+		}
+		if held {
+			u.refreshAvailability(now)
+		}
+		if u.available != wasAvailable {
+			changed = true
+			if u.available {
+				LogIf("LB OD (%s): upstream became available", u.name)
+			}
+		}
+		hc.m.Unlock()
+	}
+
+	maxEjected := len(ug.upstreams) * int(od.maxEjected) / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+
+	for _, u := range ug.upstreams {
+		if u.address == nil {
+			continue
+		}
+		s := stats[ctFlowKey(u.address, u.port)]
+		if !od.outlier(s) {
+			continue
+		}
+
+		hc := &u.healthCheck
+		hc.m.Lock()
+		switch {
+		case !u.available:
+		case ejected >= maxEjected:
+			LogWf(
+				"LB OD (%s): upstream has %d/%d failed flows, but %d/%d upstreams of group '%s' are already ejected",
+				u.name,
+				s.failed,
+				s.flows,
+				ejected,
+				len(ug.upstreams),
+				ug.name,
+			)
+		default:
+			u.ejectedUntil = now.Add(od.ejectionTime)
+			u.ejections++
+			ejected++
+			u.refreshAvailability(now)
+			changed = true
+			LogIf(
+				"LB OD (%s): upstream has %d/%d failed flows. Upstream ejected for %v",
+				u.name,
+				s.failed,
+				s.flows,
+				od.ejectionTime,
+			)
+		}
+		hc.m.Unlock()
+	}
+
+	return changed
+}
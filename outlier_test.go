@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetOutlierDetection(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   OutlierDetectionConfig
+		err      error
+		expected outlierDetection
+	}{
+		{
+			name:     "defaults",
+			config:   OutlierDetectionConfig{MaxFailureRatio: 50},
+			err:      nil,
+			expected: outlierDetection{maxFailureRatio: 50, minFlows: odMinFlows, ejectionTime: odEjectionTime * time.Second, maxEjected: odMaxEjected},
+		},
+		{
+			name:     "settings",
+			config:   OutlierDetectionConfig{MaxFailureRatio: 20, MinFlows: 3, EjectionTime: 60, MaxEjected: 100},
+			err:      nil,
+			expected: outlierDetection{maxFailureRatio: 20, minFlows: 3, ejectionTime: 60 * time.Second, maxEjected: 100},
+		},
+		{name: "no max failure ratio", config: OutlierDetectionConfig{}, err: errOdMaxFailureRatio},
+		{name: "max failure ratio above 100", config: OutlierDetectionConfig{MaxFailureRatio: 101}, err: errOdMaxFailureRatio},
+		{name: "max ejected above 100", config: OutlierDetectionConfig{MaxFailureRatio: 50, MaxEjected: 101}, err: errOdMaxEjected},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			od, err := getOutlierDetection(&tc.config)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%v', but got '%v'", tc.err, err)
+			}
+			if err == nil && *od != tc.expected {
+				t.Errorf("expected '%+v', but got '%+v'", tc.expected, *od)
+			}
+		})
+	}
+}
+
+func TestDetectOutliers(t *testing.T) {
+	newUpstream := func(name, ip string) *upstream {
+		return &upstream{name: name, address: net.ParseIP(ip), port: 80, available: true}
+	}
+	u1 := newUpstream("u1", "10.0.0.1")
+	u2 := newUpstream("u2", "10.0.0.2")
+	u3 := newUpstream("u3", "10.0.0.3")
+	u3.healthCheck = healthCheck{active: true, healthy: true, countConfig: 1, failConfig: 1}
+	u4 := newUpstream("u4", "10.0.0.4")
+	ug := &upstreamGroup{
+		name:      "ug1",
+		upstreams: []*upstream{u1, u2, u3, u4},
+		outlier:   &outlierDetection{maxFailureRatio: 50, minFlows: 4, ejectionTime: 30 * time.Second, maxEjected: 50},
+	}
+	now := time.Now()
+
+	// u1 above the threshold, u2 at the threshold and u4 below the min flows
+	stats := map[string]ctStats{
+		"10.0.0.1:80": {flows: 10, failed: 6},
+		"10.0.0.2:80": {flows: 10, failed: 5},
+		"10.0.0.4:80": {flows: 3, failed: 3},
+	}
+	if !ug.detectOutliers(stats, now) {
+		t.Errorf("expected availability change")
+	}
+	if u1.available || !u1.ejected() || u1.ejections != 1 {
+		t.Errorf("expected u1 to be ejected")
+	}
+	for _, u := range []*upstream{u2, u3, u4} {
+		if !u.available || u.ejected() {
+			t.Errorf("expected %s not to be ejected", u.name)
+		}
+	}
+
+	// max ejected is 2 out of 4 upstreams
+	stats = map[string]ctStats{
+		"10.0.0.1:80": {flows: 10, failed: 10},
+		"10.0.0.2:80": {flows: 10, failed: 10},
+		"10.0.0.3:80": {flows: 10, failed: 10},
+		"10.0.0.4:80": {flows: 10, failed: 10},
+	}
+	ug.detectOutliers(stats, now.Add(time.Second))
+	if u1.ejections != 1 {
+		t.Errorf("expected an ejected upstream not to be ejected again")
+	}
+	ejected := 0
+	for _, u := range ug.upstreams {
+		if u.ejected() {
+			ejected++
+		}
+	}
+	if ejected != 2 || !u2.ejected() {
+		t.Errorf("expected u1 and u2 to be ejected, but got %d ejected upstreams", ejected)
+	}
+
+	// active health check successes don't restore an ejected upstream
+	u3.ejectedUntil = now.Add(30 * time.Second)
+	u3.available = false
+	if changed, _ := u3.hcUpdate("10.0.0.3:80", nil); changed || u3.available {
+		t.Errorf("expected u3 to stay unavailable while ejected")
+	}
+	// u3 reaches its health check failure threshold while ejected
+	u3.hcUpdate("10.0.0.3:80", errors.New("connection refused"))
+
+	// ejection time over
+	if !ug.detectOutliers(map[string]ctStats{}, now.Add(31*time.Second)) {
+		t.Errorf("expected availability change")
+	}
+	for _, u := range []*upstream{u1, u2} {
+		if !u.available || u.ejected() {
+			t.Errorf("expected %s to be restored", u.name)
+		}
+	}
+	if u3.available || u3.ejected() {
+		t.Errorf("expected u3 ejection to be over, but u3 to stay unavailable due to health check failure")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+type proxyProto byte // PROXY protocol version sent to the upstreams
+
+const (
+	proxyProtoUnknown proxyProto = iota // undefined
+	proxyProtoNone                      // no PROXY protocol header
+	proxyProtoV1                        // PROXY protocol v1 (text)
+	proxyProtoV2                        // PROXY protocol v2 (binary)
+)
+
+// PROXY protocol settings
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	proxyV2VerCmdProxy  = 0x21 // version 2 and PROXY command
+	proxyV2FamTcp4      = 0x11 // AF_INET and STREAM
+	proxyV2FamTcp6      = 0x21 // AF_INET6 and STREAM
+	proxyV2TlvTargetLen = 255  // max length of the target name TLV value
+	// PP2_TYPE_MIN_CUSTOM. Application specific TLV used to send the lobby target name
+	proxyV2TlvTypeTarget = 0xE0
+)
+
+// PROXY protocol v2 header signature
+var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// PROXY protocol errors
+var (
+	errProxyProto = errors.New(
+		"PROXY protocol version not found",
+	)
+	errProxyAddr = errors.New(
+		"PROXY protocol header requires TCP addresses",
+	)
+)
+
+// getProxyProto returns the proxyProto (PROXY protocol version) from a string
+// No PROXY protocol header is the default
+func getProxyProto(pp string) (proxyProto, error) {
+	switch pp {
+	case "", "none":
+		return proxyProtoNone, nil
+	case "v1":
+		return proxyProtoV1, nil
+	case "v2":
+		return proxyProtoV2, nil
+	}
+
+	return proxyProtoUnknown, fmt.Errorf("'%s' '%w'", pp, errProxyProto)
+}
+
+// returns the string value of the proxyProto (PROXY protocol version)
+func (pp proxyProto) String() string {
+	switch pp {
+	case proxyProtoNone:
+		return "none"
+	case proxyProtoV1:
+		return "v1"
+	case proxyProtoV2:
+		return "v2"
+	}
+	return "unknown"
+}
+
+// proxyV1Addr returns the PROXY protocol v1 text representation of an IPv4 or IPv6 address
+// IPv4-mapped IPv6 addresses are kept in the IPv6 format, as both addresses must be of the same family
+func proxyV1Addr(ip net.IP) string {
+	if len(ip) == net.IPv6len {
+		return netip.AddrFrom16([16]byte(ip)).String()
+	}
+
+	return ip.String()
+}
+
+// proxyHeader returns the PROXY protocol header for a connection from src to dst
+// The v2 header includes a TLV with the target name
+// An empty header is returned if no PROXY protocol is used
+func proxyHeader(pp proxyProto, src, dst net.Addr, targetName string) ([]byte, error) {
+	if pp == proxyProtoNone {
+		return []byte{}, nil
+	}
+
+	sa, sok := src.(*net.TCPAddr)
+	da, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return nil, errProxyAddr
+	}
+
+	// Addresses of different families are sent as IPv6
+	sip, dip := sa.IP.To4(), da.IP.To4()
+	v4 := sip != nil && dip != nil
+	if !v4 {
+		sip, dip = sa.IP.To16(), da.IP.To16()
+	}
+
+	switch pp {
+	case proxyProtoV1:
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, proxyV1Addr(sip), proxyV1Addr(dip), sa.Port, da.Port)), nil
+	case proxyProtoV2:
+		var addrs bytes.Buffer
+		fam := byte(proxyV2FamTcp6)
+		if v4 {
+			fam = proxyV2FamTcp4
+		}
+		addrs.Write(sip)
+		addrs.Write(dip)
+		binary.Write(&addrs, binary.BigEndian, uint16(sa.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(da.Port))
+
+		// Target name TLV
+		tn := []byte(targetName)
+		if len(tn) > proxyV2TlvTargetLen {
+			tn = tn[:proxyV2TlvTargetLen]
+		}
+		addrs.WriteByte(proxyV2TlvTypeTarget)
+		binary.Write(&addrs, binary.BigEndian, uint16(len(tn)))
+		addrs.Write(tn)
+
+		var h bytes.Buffer
+		h.Write(proxyV2Sig)
+		h.WriteByte(proxyV2VerCmdProxy)
+		h.WriteByte(fam)
+		binary.Write(&h, binary.BigEndian, uint16(addrs.Len()))
+		h.Write(addrs.Bytes())
+
+		return h.Bytes(), nil
+	}
+
+	return nil, errProxyProto
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestGetProxyProto(t *testing.T) {
+	testCases := []struct {
+		input  string
+		err    error
+		result proxyProto
+	}{
+		{input: "", err: nil, result: proxyProtoNone},
+		{input: "none", err: nil, result: proxyProtoNone},
+		{input: "v1", err: nil, result: proxyProtoV1},
+		{input: "v2", err: nil, result: proxyProtoV2},
+		{input: "v3", err: errProxyProto, result: proxyProtoUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			pp, err := getProxyProto(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.err, err)
+			}
+			if pp != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.result, pp)
+			}
+		})
+	}
+}
+
+func TestProxyProtoString(t *testing.T) {
+	testCases := []struct {
+		input  proxyProto
+		result string
+	}{
+		{input: proxyProtoNone, result: "none"},
+		{input: proxyProtoV1, result: "v1"},
+		{input: proxyProtoV2, result: "v2"},
+		{input: proxyProtoUnknown, result: "unknown"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.result, func(t *testing.T) {
+			r := tc.input.String()
+			if r != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.result, tc.result, r)
+			}
+		})
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+
+	testCases := []struct {
+		name   string
+		pp     proxyProto
+		src    net.Addr
+		dst    net.Addr
+		err    error
+		result []byte
+	}{
+		{name: "none", pp: proxyProtoNone, src: src4, dst: dst4, err: nil, result: []byte{}},
+		{name: "v1 tcp4", pp: proxyProtoV1, src: src4, dst: dst4, err: nil, result: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n")},
+		{name: "v1 tcp6", pp: proxyProtoV1, src: src6, dst: dst4, err: nil, result: []byte("PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 56324 443\r\n")},
+		{
+			name: "v2 tcp4",
+			pp:   proxyProtoV2,
+			src:  src4,
+			dst:  dst4,
+			err:  nil,
+			result: append(append([]byte{}, proxyV2Sig...),
+				0x21, 0x11, 0x00, 0x12, // version and command, family, length
+				192, 168, 0, 1, // source address
+				10, 0, 0, 1, // destination address
+				0xdc, 0x04, // source port
+				0x01, 0xbb, // destination port
+				0xe0, 0x00, 0x03, 'w', 'e', 'b', // target name TLV
+			),
+		},
+		{name: "udp", pp: proxyProtoV1, src: &net.UDPAddr{}, dst: dst4, err: errProxyAddr, result: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := proxyHeader(tc.pp, tc.src, tc.dst, "web")
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, but got %v", tc.name, tc.err, err)
+			}
+			if !bytes.Equal(h, tc.result) {
+				t.Errorf("%s: expected %q, but got %q", tc.name, tc.result, h)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TLS settings
+// See RFC 8446 and RFC 6066
+const (
+	tlsRecordHeaderLen      = 5     // TLS record header length
+	tlsRecordMaxLen         = 16384 // TLS record max plaintext length
+	tlsRecordTypeHandshake  = 0x16  // TLS handshake record content type
+	tlsHandshakeClientHello = 0x01  // TLS ClientHello handshake message type
+	tlsExtServerName        = 0x00  // TLS server_name extension type
+	tlsServerNameHostName   = 0x00  // TLS server_name host_name type
+	sniWildcardPrefix       = "*."  // SNI wildcard pattern prefix
+)
+
+// SNI errors
+var (
+	errSniNotTls = errors.New(
+		"not a TLS handshake",
+	)
+	errSniMalformed = errors.New(
+		"malformed TLS ClientHello",
+	)
+)
+
+// readClientHello reads the first TLS record from r and returns the read bytes and the
+// server name (SNI) of the ClientHello it holds
+// The read bytes must be forwarded to the upstream as the TLS stream is not terminated
+// An empty server name is returned if the ClientHello has no server_name extension
+func readClientHello(r io.Reader) ([]byte, string, error) {
+	h := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return h, "", err
+	}
+	if h[0] != tlsRecordTypeHandshake {
+		return h, "", errSniNotTls
+	}
+
+	l := int(binary.BigEndian.Uint16(h[3:5]))
+	if l > tlsRecordMaxLen {
+		return h, "", errSniMalformed
+	}
+
+	rec := make([]byte, tlsRecordHeaderLen+l)
+	copy(rec, h)
+	n, err := io.ReadFull(r, rec[tlsRecordHeaderLen:])
+	if err != nil {
+		return rec[:tlsRecordHeaderLen+n], "", err
+	}
+
+	sn, err := parseSni(rec[tlsRecordHeaderLen:])
+
+	return rec, sn, err
+}
+
+// parseSni returns the server name of a TLS ClientHello handshake message
+// An empty server name is returned if there is no server_name extension
+// The ClientHello is expected to fit a single TLS record, which is the case for all common clients
+func parseSni(b []byte) (string, error) {
+	p := &sniParser{b: b}
+
+	// handshake type and length
+	if p.uint8() != tlsHandshakeClientHello {
+		return "", errSniNotTls
+	}
+	p.skip(3)
+	// legacy_version and random
+	p.skip(2 + 32)
+	// legacy_session_id
+	p.skip(int(p.uint8()))
+	// cipher_suites
+	p.skip(int(p.uint16()))
+	// legacy_compression_methods
+	p.skip(int(p.uint8()))
+	if p.err != nil {
+		return "", p.err
+	}
+	if len(p.b) == 0 {
+		// no extensions
+		return "", nil
+	}
+
+	// extensions
+	ext := &sniParser{b: p.bytes(int(p.uint16()))}
+	for p.err == nil && ext.err == nil && len(ext.b) > 0 {
+		t := ext.uint16()
+		data := ext.bytes(int(ext.uint16()))
+		if t != tlsExtServerName {
+			continue
+		}
+
+		// server_name_list
+		snl := &sniParser{b: data}
+		list := &sniParser{b: snl.bytes(int(snl.uint16()))}
+		for snl.err == nil && list.err == nil && len(list.b) > 0 {
+			nt := list.uint8()
+			name := list.bytes(int(list.uint16()))
+			if list.err == nil && nt == tlsServerNameHostName {
+				return strings.ToLower(string(name)), nil
+			}
+		}
+		if snl.err != nil {
+			return "", snl.err
+		}
+		if list.err != nil {
+			return "", list.err
+		}
+
+		// server_name extension without a host_name
+		return "", nil
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	if ext.err != nil {
+		return "", ext.err
+	}
+
+	return "", nil
+}
+
+// sniParser is a minimal big endian reader for the TLS ClientHello
+// Once a read goes out of bounds, err is set and all further reads return zero values
+type sniParser struct {
+	b   []byte
+	err error
+}
+
+func (p *sniParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n > len(p.b) {
+		p.err = fmt.Errorf("%w: unexpected end of message", errSniMalformed)
+		return nil
+	}
+	r := p.b[:n]
+	p.b = p.b[n:]
+
+	return r
+}
+
+func (p *sniParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *sniParser) uint8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (p *sniParser) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+// isSniPattern checks if a string is a valid SNI route pattern
+// A pattern is a domain name, optionally prefixed with '*.' to match any single label subdomain
+func isSniPattern(s string) bool {
+	return isFqdn(strings.TrimPrefix(s, sniWildcardPrefix))
+}
+
+// matchSni checks if a server name matches an SNI route pattern
+// Names are compared case insensitively and '*.example.com' matches 'www.example.com',
+// but not 'example.com' nor 'a.www.example.com'
+func matchSni(pattern, sn string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	sn = strings.ToLower(strings.TrimSuffix(sn, "."))
+
+	if !strings.HasPrefix(pattern, sniWildcardPrefix) {
+		return pattern == sn
+	}
+
+	label, domain, found := strings.Cut(sn, ".")
+	return found && label != "" && domain == pattern[len(sniWildcardPrefix):]
+}
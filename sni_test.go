@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record sent by a TLS client with the given server name
+func clientHello(t *testing.T, sn string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		defer c.Close()
+		tls.Client(c, &tls.Config{ServerName: sn, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	b, _, err := readClientHello(s)
+	if err != nil {
+		t.Fatalf("failed to read ClientHello: %v", err)
+	}
+
+	return b
+}
+
+func TestReadClientHello(t *testing.T) {
+	testCases := []struct {
+		name string
+		sn   string
+	}{
+		{name: "server name", sn: "www.example.com"},
+		{name: "upper case server name", sn: "WWW.Example.COM"},
+		{name: "no server name", sn: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hello := clientHello(t, tc.sn)
+			b, sn, err := readClientHello(bytes.NewReader(hello))
+			if err != nil {
+				t.Errorf("expected no error, but got '%v'", err)
+			}
+			if !bytes.Equal(b, hello) {
+				t.Errorf("expected the read bytes to match the ClientHello record")
+			}
+			if want := bytes.ToLower([]byte(tc.sn)); sn != string(want) {
+				t.Errorf("expected server name '%s', but got '%s'", want, sn)
+			}
+		})
+	}
+
+	// errors
+	hello := clientHello(t, "www.example.com")
+	errTestCases := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{name: "not TLS", b: []byte("GET / HTTP/1.1\r\n\r\n"), err: errSniNotTls},
+		{name: "not a ClientHello", b: append([]byte{0x16, 0x03, 0x01, 0x00, 0x04}, 0x02, 0x00, 0x00, 0x00), err: errSniNotTls},
+		{name: "oversized record", b: []byte{0x16, 0x03, 0x01, 0xff, 0xff}, err: errSniMalformed},
+		{name: "truncated ClientHello", b: append([]byte{0x16, 0x03, 0x01, 0x00, 0x30}, hello[5:0x35]...), err: errSniMalformed},
+	}
+	for _, tc := range errTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := readClientHello(bytes.NewReader(tc.b)); !errors.Is(err, tc.err) {
+				t.Errorf("expected '%v', but got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestIsSniPattern(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want bool
+	}{
+		{s: "example.com", want: true},
+		{s: "www.example.com", want: true},
+		{s: "*.example.com", want: true},
+		{s: "*", want: false},
+		{s: "*.", want: false},
+		{s: "www.*.com", want: false},
+		{s: "1.1.1.1", want: false},
+		{s: "", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			if got := isSniPattern(tc.s); got != tc.want {
+				t.Errorf("expected '%v', but got '%v'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchSni(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		sn      string
+		want    bool
+	}{
+		{pattern: "www.example.com", sn: "www.example.com", want: true},
+		{pattern: "www.example.com", sn: "WWW.EXAMPLE.COM", want: true},
+		{pattern: "www.example.com.", sn: "www.example.com", want: true},
+		{pattern: "www.example.com", sn: "api.example.com", want: false},
+		{pattern: "*.example.com", sn: "www.example.com", want: true},
+		{pattern: "*.example.com", sn: "example.com", want: false},
+		{pattern: "*.example.com", sn: "a.www.example.com", want: false},
+		{pattern: "*.example.com", sn: ".example.com", want: false},
+		{pattern: "*.example.com", sn: "", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pattern+" "+tc.sn, func(t *testing.T) {
+			if got := matchSni(tc.pattern, tc.sn); got != tc.want {
+				t.Errorf("expected '%v', but got '%v'", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteSni(t *testing.T) {
+	def := &upstreamGroup{name: "default"}
+	wc := &upstreamGroup{name: "wildcard"}
+	api := &upstreamGroup{name: "api"}
+	tg := &target{
+		upstreamGroup: def,
+		routes: []*route{
+			{sni: []string{"*.example.com"}, upstreamGroup: wc},
+			{sni: []string{"example.com", "api.example.com"}, upstreamGroup: api},
+		},
+	}
+
+	testCases := []struct {
+		sn   string
+		want *upstreamGroup
+	}{
+		{sn: "api.example.com", want: api},
+		{sn: "example.com", want: api},
+		{sn: "www.example.com", want: wc},
+		{sn: "www.example.org", want: def},
+		{sn: "", want: def},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.sn, func(t *testing.T) {
+			if got := tg.routeSni(tc.sn); got != tc.want {
+				t.Errorf("expected upstream group '%s', but got '%s'", tc.want.name, got.name)
+			}
+		})
+	}
+}
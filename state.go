@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// state returns the health check counters and last probe result
+func (hc *healthCheck) state() string {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	last := "never"
+	if !hc.lastProbe.IsZero() {
+		last = fmt.Sprintf("%s ago", time.Since(hc.lastProbe).Truncate(time.Second))
+		if hc.lastErr != nil {
+			last += fmt.Sprintf(" failed: %v", hc.lastErr)
+		} else {
+			last += " succeeded"
+		}
+	}
+
+	return fmt.Sprintf(
+		"health check '%s': successes %d/%d; failures %d/%d; probes %d; failed probes %d; interval %v; last probe %s",
+		hc.protocol.String(),
+		hc.count,
+		hc.countConfig,
+		hc.failCount,
+		hc.failConfig,
+		hc.probes,
+		hc.failures,
+		hc.interval,
+		last,
+	)
+}
+
+// state returns the upstream address, availability, outlier ejections, flap dampening and health check state
+func (u *upstream) state() string {
+	u.healthCheck.m.Lock()
+	s := fmt.Sprintf("upstream '%s': address '%s'; available '%t'", u.name, u.address.String(), u.available)
+	if u.ejected() {
+		s += fmt.Sprintf("; ejected for %v", time.Until(u.ejectedUntil).Truncate(time.Second))
+	}
+	if u.ejections != 0 {
+		s += fmt.Sprintf("; outlier ejections %d", u.ejections)
+	}
+	if d := u.damp; d != nil {
+		now := time.Now()
+		s += fmt.Sprintf("; flaps %d; dampening penalty %.0f/%.0f", d.flaps, d.penaltyAt(now), d.suppressLimit)
+		if d.suppressed {
+			s += fmt.Sprintf("; suppressed for %v", d.reuseIn(now).Truncate(time.Second))
+		}
+		if d.suppressions != 0 {
+			s += fmt.Sprintf("; suppressions %d", d.suppressions)
+		}
+	}
+	u.healthCheck.m.Unlock()
+	if !u.healthCheck.active {
+		return s + "; no health check"
+	}
+
+	return s + "; " + u.healthCheck.state()
+}
+
+// dumpState logs the state of all the load balancer targets, upstream groups and upstreams
+func (l *lb) dumpState() {
+	LogIf("STATE: load balancer '%s'", l.String())
+	for _, t := range l.targets {
+		LogIf("STATE: target '%s': %s/%d", t.name, t.protocol.String(), t.port)
+		for _, ug := range t.upstreamGroups() {
+			if ug.panicking.Load() {
+				LogIf("STATE:   upstream group '%s': panic mode", ug.name)
+			} else {
+				LogIf("STATE:   upstream group '%s'", ug.name)
+			}
+			for _, u := range ug.upstreams {
+				LogIf("STATE:     %s", u.state())
+			}
+		}
+	}
+}
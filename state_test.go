@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	memLog := bytes.Buffer{}
+	log.SetOutput(&memLog)
+	defer log.SetOutput(os.Stderr) // os.Stderr is the default output
+
+	u1 := &upstream{
+		name:      "u1",
+		address:   net.ParseIP("192.0.2.1"),
+		available: false,
+		healthCheck: healthCheck{
+			active:            true,
+			protocol:          hcProtoTcp,
+			checkInterval:     10,
+			unhealthyInterval: 30,
+			countConfig:       3,
+			failConfig:        2,
+		},
+	}
+	u1.hcUpdate("192.0.2.1:80", nil)
+	u1.healthCheck.m.Lock()
+	u1.healthCheck.lastErr = errors.New("connection refused")
+	u1.healthCheck.m.Unlock()
+	u2 := &upstream{
+		name:      "u2",
+		address:   net.ParseIP("192.0.2.2"),
+		available: true,
+	}
+	u3 := &upstream{
+		name:      "u3",
+		address:   net.ParseIP("192.0.2.3"),
+		available: false,
+	}
+	u3.damp, _ = getFlapDampening(&DampeningConfig{SuppressLimit: 1500}, true)
+	now := time.Now()
+	u3.damp.update(u3.name, false, now)
+	u3.damp.update(u3.name, true, now)
+	l := &lb{
+		et: lbEngineTest,
+		targets: []*target{
+			{
+				name:     "t1",
+				protocol: lbProtoTcp,
+				port:     80,
+				upstreamGroup: &upstreamGroup{
+					name:      "ug1",
+					upstreams: []*upstream{u1, u2, u3},
+				},
+			},
+		},
+	}
+
+	l.dumpState()
+
+	for _, e := range []string{
+		"target 't1': tcp/80",
+		"upstream group 'ug1'",
+		"upstream 'u1': address '192.0.2.1'; available 'false'; health check 'tcp': successes 1/3; failures 0/2; probes 1; failed probes 0; interval 30s",
+		"failed: connection refused",
+		"upstream 'u2': address '192.0.2.2'; available 'true'; no health check",
+		"upstream 'u3': address '192.0.2.3'; available 'false'; flaps 2; dampening penalty 2000/1500; suppressed for",
+		"suppressions 1",
+	} {
+		if !strings.Contains(memLog.String(), e) {
+			t.Errorf("expected state dump to contain '%s', but got:\n%s", e, memLog.String())
+		}
+	}
+}
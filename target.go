@@ -1,6 +1,9 @@
 package main
 
 import (
+	"net"
+	"strings"
+
 	"github.com/google/nftables"
 )
 
@@ -10,7 +13,75 @@ type target struct {
 	protocol      lbProto
 	ip            string
 	port          uint16
-	upstreamGroup *upstreamGroup
+	interfaces    []string       // ingress interfaces. All interfaces if empty
+	proxyProtocol proxyProto     // PROXY protocol header sent to the upstreams. Only userspace engine
+	upstreamGroup *upstreamGroup // default upstream group
+	routes        []*route       // routes to other upstream groups. Only userspace engine
 	nftRuleInit   bool
 	nftPrerRule   []*nftables.Rule
+	nftIifSet     *nftables.Set
+	// least-connections vmap slot shares last applied by the lb engine
+	leastConnShares []int
+}
+
+// A route sends the target traffic matching its criteria to an upstream group
+type route struct {
+	sni           []string // TLS server names. Wildcard patterns such as '*.example.com' are allowed. Only tcp targets
+	host          []string // HTTP hosts. Wildcard patterns such as '*.example.com' are allowed. Only http targets
+	pathPrefix    string   // HTTP path prefix. Only http targets
+	upstreamGroup *upstreamGroup
+}
+
+// upstreamGroups returns the default upstream group of the target followed by the route upstream groups
+func (t *target) upstreamGroups() []*upstreamGroup {
+	ugs := []*upstreamGroup{t.upstreamGroup}
+	for _, r := range t.routes {
+		ugs = append(ugs, r.upstreamGroup)
+	}
+
+	return ugs
+}
+
+// routeSni returns the upstream group for a TLS server name
+// Exact server names take precedence over wildcard patterns
+// The default upstream group is returned if no route matches
+func (t *target) routeSni(sn string) *upstreamGroup {
+	if sn != "" {
+		for _, wildcard := range []bool{false, true} {
+			for _, r := range t.routes {
+				for _, p := range r.sni {
+					if strings.HasPrefix(p, sniWildcardPrefix) == wildcard && matchSni(p, sn) {
+						return r.upstreamGroup
+					}
+				}
+			}
+		}
+	}
+
+	return t.upstreamGroup
+}
+
+// routeHttp returns the upstream group for an HTTP request host and path
+// Routes with exact hosts take precedence over routes with wildcard hosts, which take precedence over routes without hosts
+// Among those, the route with the longest matching path prefix is used
+// The default upstream group is returned if no route matches
+func (t *target) routeHttp(host, path string) *upstreamGroup {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ug := t.upstreamGroup
+	bestHost, bestPath := -1, -1
+	for _, r := range t.routes {
+		hs := matchHosts(r.host, host)
+		if hs < 0 || !matchPathPrefix(r.pathPrefix, path) {
+			continue
+		}
+		if hs > bestHost || (hs == bestHost && len(r.pathPrefix) > bestPath) {
+			ug = r.upstreamGroup
+			bestHost, bestPath = hs, len(r.pathPrefix)
+		}
+	}
+
+	return ug
 }
@@ -63,3 +63,7 @@ func (tlb *testLb) updateTarget(t *target) error {
 func (tlb *testLb) updateUpstream(u *upstream, auip *[]net.IP) error {
 	return nil
 }
+
+func (tlb *testLb) cleanup(instance string) error {
+	return nil
+}
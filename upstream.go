@@ -4,23 +4,42 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/nftables"
 )
 
 type (
-	hcProto  byte // healtcheck protocol
-	ugFoMode byte // upstream group failover mode
+	hcProto     byte // healtcheck protocol
+	ugFoMode    byte // upstream group failover mode
+	persistMode byte // upstream group client persistence mode
 )
 
 const (
-	hcProtoUnknown hcProto = iota // undefined
-	hcProtoTcp                    // tcp
-	hcProtoUdp                    // udp
-	hcProtoSctp                   // sctp
-	hcProtoHttp                   // http
-	hcProtoGrpc                   // grpc
+	hcProtoUnknown       hcProto = iota // undefined
+	hcProtoTcp                          // tcp
+	hcProtoUdp                          // udp
+	hcProtoSctp                         // sctp
+	hcProtoHttp                         // http
+	hcProtoGrpc                         // grpc
+	hcProtoHttps                        // https
+	hcProtoTcpSendExpect                // tcp-send-expect
+	hcProtoRedis                        // redis
+	hcProtoMysql                        // mysql
+	hcProtoPostgres                     // postgres
+	hcProtoSmtp                         // smtp
+	hcProtoFtp                          // ftp
+	hcProtoIcmp                         // icmp
+	hcProtoDns                          // dns
+	hcProtoExec                         // exec
+)
+
+const (
+	persistModeUnknown persistMode = iota // undefined
+	persistModeNone                       // no client persistence
+	persistModeSrcAddr                    // client source IP address persistence
 )
 
 const numUgFoModes = 5 // amount of ugFoMode's
@@ -41,6 +60,9 @@ var (
 	errUgFM = errors.New(
 		"error providing next upstream failover mode",
 	)
+	errPersistMode = errors.New(
+		"client persistence mode not found",
+	)
 )
 
 func getHcProto(hcp string) (hcProto, error) {
@@ -55,6 +77,26 @@ func getHcProto(hcp string) (hcProto, error) {
 		return hcProtoHttp, nil
 	case "grpc":
 		return hcProtoGrpc, nil
+	case "https":
+		return hcProtoHttps, nil
+	case "tcp-send-expect":
+		return hcProtoTcpSendExpect, nil
+	case "redis":
+		return hcProtoRedis, nil
+	case "mysql":
+		return hcProtoMysql, nil
+	case "postgres":
+		return hcProtoPostgres, nil
+	case "smtp":
+		return hcProtoSmtp, nil
+	case "ftp":
+		return hcProtoFtp, nil
+	case "icmp":
+		return hcProtoIcmp, nil
+	case "dns":
+		return hcProtoDns, nil
+	case "exec":
+		return hcProtoExec, nil
 	}
 
 	return hcProtoUnknown, fmt.Errorf("'%s' '%w'", hcp, errHcp)
@@ -72,6 +114,50 @@ func (hcp hcProto) String() string {
 		return "http"
 	case hcProtoGrpc:
 		return "grpc"
+	case hcProtoHttps:
+		return "https"
+	case hcProtoTcpSendExpect:
+		return "tcp-send-expect"
+	case hcProtoRedis:
+		return "redis"
+	case hcProtoMysql:
+		return "mysql"
+	case hcProtoPostgres:
+		return "postgres"
+	case hcProtoSmtp:
+		return "smtp"
+	case hcProtoFtp:
+		return "ftp"
+	case hcProtoIcmp:
+		return "icmp"
+	case hcProtoDns:
+		return "dns"
+	case hcProtoExec:
+		return "exec"
+	}
+	return "unknown"
+}
+
+// getPersistMode returns the persistMode (client persistence mode) from a string
+// No client persistence is the default
+func getPersistMode(pm string) (persistMode, error) {
+	switch pm {
+	case "", "none":
+		return persistModeNone, nil
+	case "source-address":
+		return persistModeSrcAddr, nil
+	}
+
+	return persistModeUnknown, fmt.Errorf("'%s' '%w'", pm, errPersistMode)
+}
+
+// returns the string value of the persistMode (client persistence mode)
+func (pm persistMode) String() string {
+	switch pm {
+	case persistModeNone:
+		return "none"
+	case persistModeSrcAddr:
+		return "source-address"
 	}
 	return "unknown"
 }
@@ -80,20 +166,44 @@ type upstreamDns struct {
 	addresses []string      // DNS addresses to be used to resolve the upstream host domain name
 	confTtl   uint32        // user configured DNS TTL to overwrite DNS resolved TTL
 	ttl       uint32        // DNS TTL to be used. confTtl will be used if set. Otherwise, the DNS resolved TTL
+	next      time.Time     // next DNS check time
 	chDcStop  chan struct{} // channel to listen to upstream dns stop requests
 	ticker    *time.Ticker  // DNS check timer. Always set to upstreamDns.ttl
 }
 
 type healthCheck struct {
-	active        bool          // healthcheck active or inactive
-	protocol      hcProto       // healthcheck protocol
-	port          uint16        // healtcheck port
-	checkInterval uint16        // healtcheck check interval in seconds
-	timeout       uint8         // healthcheck check timeout
-	countConfig   uint8         // healthcheck configured consecutive successful checks required to become available
-	count         uint8         // healthcheck variable used to count progress of consecutive successful checks
-	chHcStop      chan struct{} // channel to listen to healthcheck stop requests
-	ticker        *time.Ticker  // healtcheck timer
+	active            bool          // healthcheck active or inactive
+	protocol          hcProto       // healthcheck protocol
+	port              uint16        // healtcheck port
+	host              string        // healthcheck host. The upstream address is probed if empty
+	source            hcSource      // healthcheck probes source address and interface
+	checkInterval     uint16        // healtcheck check interval in seconds
+	timeout           uint8         // healthcheck check timeout
+	countConfig       uint8         // healthcheck configured consecutive successful checks required to become available
+	count             uint8         // healthcheck variable used to count progress of consecutive successful checks
+	healthy           bool          // healthcheck verdict. The upstream availability also depends on outlier ejection and flap dampening
+	failConfig        uint8         // healthcheck configured consecutive failed checks required to become unavailable
+	failCount         uint8         // healthcheck variable used to count progress of consecutive failed checks
+	unhealthyInterval uint16        // healthcheck check interval in seconds while the upstream is unavailable
+	backoffMax        uint16        // healthcheck backoff max check interval in seconds while the upstream is unavailable. No backoff if 0
+	jitter            uint8         // healthcheck backoff check interval random variation percentage
+	interval          time.Duration // healthcheck current check interval
+	m                 sync.Mutex    // healthcheck counters and upstream availability mutex
+	probes            uint64        // healthcheck total probes
+	failures          uint64        // healthcheck total failed probes
+	lastProbe         time.Time     // healthcheck last probe time
+	lastErr           error         // healthcheck last probe error. nil if the last probe succeeded
+	chHcStop          chan struct{} // channel to listen to healthcheck stop requests
+	ticker            *time.Ticker  // healtcheck timer
+	http              *hcHttp       // http and https healthcheck settings
+	grpc              *hcGrpc       // grpc healthcheck settings
+	udp               *hcUdp        // udp healthcheck settings
+	tcp               *hcTcp        // protocol aware tcp healthcheck settings
+	icmp              *hcIcmp       // icmp healthcheck settings
+	dns               *hcDns        // dns healthcheck settings
+	exec              *hcExec       // exec healthcheck settings
+	// healthcheck configuration. Used to match upstreams across reconfigurations
+	config HealthCheckConfig
 }
 
 // An upstream is a host where the traffic can be distributed to
@@ -106,6 +216,16 @@ type upstream struct {
 	address     net.IP      // upstream IP address. It is either the IP address from upstream host or the resolved upstream host domain name
 	available   bool        // upstream state. available or unavailable
 	healthCheck healthCheck // upstream healtcheck configuration
+	activeConns uint32      // upstream established connections. Only tracked for the least-connections distribution mode
+	fwmark      uint32      // firewall mark set on the packets sent to the upstream. 0 means no mark
+	// client persistence timeout in seconds from the upstream group. 0 if client persistence is disabled
+	persistTimeout uint32
+	nftPersistSet  *nftables.Set // client persistence set
+	// outlier ejection end. Zero if the upstream isn't ejected. Guarded by the healthcheck mutex
+	ejectedUntil time.Time
+	ejections    uint64 // total outlier ejections
+	// flap dampening settings and state. nil if disabled. Guarded by the healthcheck mutex
+	damp *flapDampening
 }
 
 // returns the ugFoMode ID
@@ -146,7 +266,13 @@ func (ugFM ugFoMode) nextMode() (ugFoMode, error) {
 type upstreamGroup struct {
 	name                 string
 	distMode             distMode
+	distHash             distHash
+	persistMode          persistMode
+	persistTimeout       uint32
 	upstreams            []*upstream
+	outlier              *outlierDetection
+	minHealthy           uint8       // min available upstreams percentage. Below it, the group is in panic mode. 0 disables the panic mode
+	panicking            atomic.Bool // whether the group is in panic mode
 	failoverMode         ugFoMode
 	previousFailoverMode ugFoMode
 	nftUgChain           []*nftables.Chain
@@ -154,3 +280,73 @@ type upstreamGroup struct {
 	nftUgChainRule       []*nftables.Rule
 	nftCounter           *nftables.CounterObj
 }
+
+// servingUpstreams returns the upstreams the upstream group traffic is distributed to
+// These are the available upstreams, unless the available upstreams percentage is below the
+// min healthy percentage. The group is then in panic mode: availability is ignored and the traffic is
+// distributed to all the upstreams with an address, so that wrongly failing health checks don't
+// concentrate all the traffic on a few upstreams
+func (ug *upstreamGroup) servingUpstreams() []*upstream {
+	var au []*upstream
+	for _, u := range ug.upstreams {
+		if u.available {
+			au = append(au, u)
+		}
+	}
+
+	panicking := ug.minHealthy != 0 && len(au)*100 < len(ug.upstreams)*int(ug.minHealthy)
+	if ug.panicking.Swap(panicking) != panicking {
+		if panicking {
+			LogWf(
+				"LB: PANIC MODE: only %d/%d upstreams of upstream group '%s' are available, below the min healthy %d%%. Ignoring upstreams availability and distributing traffic to all upstreams",
+				len(au),
+				len(ug.upstreams),
+				ug.name,
+				ug.minHealthy,
+			)
+		} else {
+			LogWf(
+				"LB: PANIC MODE OVER: %d/%d upstreams of upstream group '%s' are available. Distributing traffic to the available upstreams",
+				len(au),
+				len(ug.upstreams),
+				ug.name,
+			)
+		}
+	}
+	if !panicking {
+		return au
+	}
+
+	au = au[:0]
+	for _, u := range ug.upstreams {
+		if u.address != nil {
+			au = append(au, u)
+		}
+	}
+
+	return au
+}
+
+// refreshAvailability sets the upstream availability from its health check verdict, outlier ejection and flap dampening
+// Upstreams without active health check are considered healthy
+// It must be called with the healthcheck mutex locked
+func (u *upstream) refreshAvailability(now time.Time) {
+	up := (!u.healthCheck.active || u.healthCheck.healthy) && !u.ejected()
+	if u.damp != nil {
+		up = u.damp.update(u.name, up, now)
+	}
+	u.available = up
+}
+
+// holdReason returns why a healthy upstream is held unavailable
+// It must be called with the healthcheck mutex locked
+func (u *upstream) holdReason(now time.Time) string {
+	if u.ejected() {
+		return fmt.Sprintf("outlier ejected for %v", u.ejectedUntil.Sub(now).Truncate(time.Second))
+	}
+	if u.damp != nil && u.damp.suppressed {
+		return fmt.Sprintf("flaps suppressed for %v", u.damp.reuseIn(now).Truncate(time.Second))
+	}
+
+	return "unknown"
+}
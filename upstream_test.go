@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"slices"
 	"testing"
 )
 
@@ -108,3 +111,89 @@ func TestNextMode(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPersistMode(t *testing.T) {
+	testCases := []struct {
+		input  string
+		err    error
+		result persistMode
+	}{
+		{input: "", err: nil, result: persistModeNone},
+		{input: "none", err: nil, result: persistModeNone},
+		{input: "source-address", err: nil, result: persistModeSrcAddr},
+		{input: "cookie", err: errPersistMode, result: persistModeUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			pm, err := getPersistMode(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.err, err)
+			}
+			if pm != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.input, tc.result, pm)
+			}
+		})
+	}
+}
+
+func TestPersistModeString(t *testing.T) {
+	testCases := []struct {
+		input  persistMode
+		result string
+	}{
+		{input: persistModeNone, result: "none"},
+		{input: persistModeSrcAddr, result: "source-address"},
+		{input: persistModeUnknown, result: "unknown"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.result, func(t *testing.T) {
+			r := tc.input.String()
+			if r != tc.result {
+				t.Errorf("%s: expected %v, but got %v", tc.result, tc.result, r)
+			}
+		})
+	}
+}
+
+func TestServingUpstreams(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	testCases := []struct {
+		name       string
+		minHealthy uint8
+		available  []bool
+		addressed  []bool
+		expected   []string
+		panicking  bool
+	}{
+		{name: "no min healthy", minHealthy: 0, available: []bool{true, false, false, false}, addressed: []bool{true, true, true, true}, expected: []string{"u1"}, panicking: false},
+		{name: "at min healthy", minHealthy: 50, available: []bool{true, false, true, false}, addressed: []bool{true, true, true, true}, expected: []string{"u1", "u3"}, panicking: false},
+		{name: "below min healthy", minHealthy: 50, available: []bool{true, false, false, false}, addressed: []bool{true, true, true, true}, expected: []string{"u1", "u2", "u3", "u4"}, panicking: true},
+		{name: "below min healthy without address", minHealthy: 50, available: []bool{false, false, false, false}, addressed: []bool{true, false, true, true}, expected: []string{"u1", "u3", "u4"}, panicking: true},
+		{name: "all available", minHealthy: 100, available: []bool{true, true, true, true}, addressed: []bool{true, true, true, true}, expected: []string{"u1", "u2", "u3", "u4"}, panicking: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ug := &upstreamGroup{name: "ug1", minHealthy: tc.minHealthy}
+			for i := range tc.available {
+				u := &upstream{name: fmt.Sprintf("u%d", i+1), available: tc.available[i]}
+				if tc.addressed[i] {
+					u.address = ip
+				}
+				ug.upstreams = append(ug.upstreams, u)
+			}
+
+			var names []string
+			for _, u := range ug.servingUpstreams() {
+				names = append(names, u.name)
+			}
+			if !slices.Equal(names, tc.expected) {
+				t.Errorf("expected '%v', but got '%v'", tc.expected, names)
+			}
+			if ug.panicking.Load() != tc.panicking {
+				t.Errorf("expected panicking '%t', but got '%t'", tc.panicking, ug.panicking.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Some hardcoded settings
+const (
+	uspDialTimeout = 5 * time.Second // timeout to connect to an upstream
+	uspPeekTimeout = 5 * time.Second // timeout to receive the TLS ClientHello from a client
+	// HTTP targets
+	uspHttpHeaderTimeout = 10 * time.Second // timeout to receive the request headers from a client
+	uspHttpIdleConns     = 64               // max idle keep-alive connections per upstream
+	uspHttpIdleTimeout   = 90 * time.Second // idle keep-alive upstream connections timeout
+)
+
+// supported lb engine protocols and distribution modes
+var uspSuppCapabilities = map[lbProto]map[distMode]bool{
+	lbProtoTcp: {
+		distModeRR: true,
+	},
+	lbProtoHttp: {
+		distModeRR: true,
+	},
+}
+
+// An uspUpstream is the userspace engine snapshot of an available upstream
+// Snapshots are used so the forwarding doesn't race with the health and DNS checks
+type uspUpstream struct {
+	name    string // upstream name
+	address string // upstream address and port
+}
+
+// An uspGroup holds the available upstreams of an upstream group
+type uspGroup struct {
+	upstreams []uspUpstream // available upstreams
+	next      int           // next upstream index for round-robin
+}
+
+// An uspConns tracks the active connections and the forwarding go routines of the userspace engine
+// Upon a reconfiguration it is handed over to the new engine,
+// so the connections of the previous configuration are still closed and waited for when the engine stops
+type uspConns struct {
+	conns map[net.Conn]struct{} // active client and upstream connections
+	wg    sync.WaitGroup        // wait group to keep track of the forwarding go routines
+	m     sync.Mutex            // active connections mutex
+}
+
+// userspace engine struct
+// Connections are accepted by Lobby and forwarded to the upstreams
+// Requests of http targets are proxied to the upstreams
+type usp struct {
+	targets   []*target                    // load balancer targets
+	listeners []*uspListener               // target listeners
+	transport *http.Transport              // http upstreams keep-alive connections pool
+	groups    map[*upstreamGroup]*uspGroup // upstream groups snapshots
+	conns     *uspConns                    // active connections and forwarding go routines
+	m         sync.Mutex                   // userspace engine changes mutex
+}
+
+// USP errors
+var (
+	errUspInit = errors.New(
+		"Error while initializing the userspace engine",
+	)
+	errUspListen = errors.New(
+		"Error when listening on target",
+	)
+	errUspReconfig = errors.New(
+		"Error while reconfiguring the userspace engine",
+	)
+	errUspAssert = errors.New(
+		"Error when asserting lb engine of type userspace",
+	)
+	errUspNoUpstream = errors.New(
+		"No upstreams available",
+	)
+)
+
+// An uspListener is a target listener, with the engine and target its connections are forwarded by and for
+// Upon a reconfiguration, the listener of a target with unchanged protocol, ip and port is handed over to the new engine
+// without closing its socket, so the connections waiting in its accept backlog are not reset
+type uspListener struct {
+	ln  net.Listener // target listening socket
+	key string       // target protocol, ip and port
+	srv *http.Server // http target server. nil for tcp targets
+	n   *usp         // engine forwarding the accepted connections
+	t   *target      // target of the accepted connections
+	h   http.Handler // http target handler of the engine
+	m   sync.Mutex   // engine and target mutex
+}
+
+// uspListenerKey returns the key identifying the listener of a target
+func uspListenerKey(t *target) string {
+	return t.protocol.String() + "/" + net.JoinHostPort(t.ip, strconv.Itoa(int(t.port)))
+}
+
+// set sets the engine and target the accepted connections are forwarded by and for
+func (ul *uspListener) set(n *usp, t *target) {
+	ul.m.Lock()
+	defer ul.m.Unlock()
+
+	ul.n = n
+	ul.t = t
+	if ul.srv != nil {
+		ul.h = n.httpHandler(t)
+	}
+}
+
+// get returns the engine and target the accepted connections are forwarded by and for
+func (ul *uspListener) get() (*usp, *target) {
+	ul.m.Lock()
+	defer ul.m.Unlock()
+
+	return ul.n, ul.t
+}
+
+// close stops accepting new connections
+// The http target server is closed with its idle and active client connections
+func (ul *uspListener) close() {
+	if ul.srv != nil {
+		ul.srv.Close()
+		return
+	}
+	ul.ln.Close()
+}
+
+// shutdown stops accepting new connections
+// The http target server is gracefully stopped. Idle client connections are closed and active requests are completed
+func (ul *uspListener) shutdown() {
+	if ul.srv != nil {
+		ul.srv.Shutdown(context.Background())
+		return
+	}
+	ul.ln.Close()
+}
+
+// start listens on all targets and starts accepting connections
+func (n *usp) start(l *lb) error {
+	LogDf("USP: userspace engine initialization requested")
+
+	n.targets = l.targets
+	n.groups = make(map[*upstreamGroup]*uspGroup)
+	if n.conns == nil {
+		n.conns = &uspConns{conns: make(map[net.Conn]struct{})}
+	}
+	n.transport = &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: uspDialTimeout}).DialContext,
+		MaxIdleConnsPerHost: uspHttpIdleConns,
+		IdleConnTimeout:     uspHttpIdleTimeout,
+	}
+
+	for _, t := range l.targets {
+		n.updateTarget(t)
+	}
+
+	// The listeners handed over by the previous configuration engine are kept
+	// Only the targets without one get a new listening socket
+	prev := n.listeners
+	n.listeners = nil
+	var opened []*uspListener
+	for _, t := range l.targets {
+		key := uspListenerKey(t)
+		if i := slices.IndexFunc(prev, func(ul *uspListener) bool { return ul.key == key }); i >= 0 {
+			LogIf("USP: keeping listener on '%s' for target '%s'", prev[i].ln.Addr().String(), t.name)
+			n.listeners = append(n.listeners, prev[i])
+			continue
+		}
+
+		ul, err := n.listen(t)
+		if err != nil {
+			for _, ul := range opened {
+				ul.close()
+			}
+			n.listeners = prev
+			return fmt.Errorf("%w: %w: %w", errUspInit, errUspListen, err)
+		}
+		LogIf("USP: listening on '%s' for target '%s'", ul.ln.Addr().String(), t.name)
+		opened = append(opened, ul)
+		n.listeners = append(n.listeners, ul)
+	}
+
+	// The connections accepted from now on are forwarded by this engine
+	for i, t := range l.targets {
+		n.listeners[i].set(n, t)
+	}
+	for _, ul := range opened {
+		n.conns.wg.Add(1)
+		if ul.srv != nil {
+			go ul.serve(n.conns)
+			continue
+		}
+		go ul.accept(n.conns)
+	}
+
+	return nil
+}
+
+// listen opens the listening socket of a target
+// SO_REUSEPORT isn't set, so it fails if another process, such as another lobby instance, already listens on the target
+func (n *usp) listen(t *target) (*uspListener, error) {
+	network := t.protocol.String()
+	if t.protocol == lbProtoHttp {
+		network = lbProtoTcp.String()
+	}
+	ln, err := net.Listen(network, net.JoinHostPort(t.ip, strconv.Itoa(int(t.port))))
+	if err != nil {
+		return nil, err
+	}
+
+	ul := &uspListener{ln: ln, key: uspListenerKey(t)}
+	if t.protocol == lbProtoHttp {
+		ul.srv = &http.Server{
+			Handler:           ul,
+			ReadHeaderTimeout: uspHttpHeaderTimeout,
+			ConnState:         n.conns.connState,
+		}
+	}
+
+	return ul, nil
+}
+
+// accept accepts the target connections until the listener is closed
+// The connections are forwarded by the engine the listener is currently set to
+func (ul *uspListener) accept(cs *uspConns) {
+	defer cs.wg.Done()
+
+	for {
+		c, err := ul.ln.Accept()
+		n, t := ul.get()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				LogDf("USP: stopped listening for target '%s'", t.name)
+				return
+			}
+			LogWf("USP: failed to accept connection for target '%s': %v", t.name, err)
+			continue
+		}
+
+		cs.wg.Add(1)
+		go n.forward(c, t)
+	}
+}
+
+// forward connects the client connection to the next upstream of the target upstream group
+// With target routes, the upstream group is selected by the TLS server name of the ClientHello
+// The PROXY protocol header is sent first if the target requires it
+func (n *usp) forward(c net.Conn, t *target) {
+	defer n.conns.wg.Done()
+	defer c.Close()
+	if !n.conns.track(c) {
+		return
+	}
+	defer n.conns.untrack(c)
+
+	// Route the connection based on the TLS server name
+	// The ClientHello is read from the client and then forwarded as it is to the upstream
+	ug := t.upstreamGroup
+	var hello []byte
+	if len(t.routes) != 0 {
+		c.SetReadDeadline(time.Now().Add(uspPeekTimeout))
+		b, sn, err := readClientHello(c)
+		c.SetReadDeadline(time.Time{})
+		if err != nil {
+			LogDf("USP: failed to read TLS server name from '%s' for target '%s': %v", c.RemoteAddr().String(), t.name, err)
+			if !errors.Is(err, errSniNotTls) && !errors.Is(err, errSniMalformed) {
+				return
+			}
+		}
+		hello = b
+		ug = t.routeSni(sn)
+		LogDVf("USP: TLS server name '%s' from '%s' routed to upstream group '%s'", sn, c.RemoteAddr().String(), ug.name)
+	}
+
+	uc, u, err := n.dial(ug)
+	if err != nil {
+		LogIf("USP: failed to forward connection from '%s' for target '%s': %v", c.RemoteAddr().String(), t.name, err)
+		return
+	}
+	defer uc.Close()
+	if !n.conns.track(uc) {
+		return
+	}
+	defer n.conns.untrack(uc)
+	LogDVf("USP: forwarding connection from '%s' to upstream '%s'", c.RemoteAddr().String(), u.name)
+
+	h, err := proxyHeader(t.proxyProtocol, c.RemoteAddr(), c.LocalAddr(), t.name)
+	if err != nil {
+		LogWf("USP: failed to build PROXY protocol header for target '%s': %v", t.name, err)
+		return
+	}
+	if len(h) != 0 {
+		if _, err := uc.Write(h); err != nil {
+			LogIf("USP: failed to send PROXY protocol header to upstream '%s': %v", u.name, err)
+			return
+		}
+	}
+	if len(hello) != 0 {
+		if _, err := uc.Write(hello); err != nil {
+			LogIf("USP: failed to send TLS ClientHello to upstream '%s': %v", u.name, err)
+			return
+		}
+	}
+
+	pipe(c, uc)
+}
+
+// pipe copies the data between both connections until both directions are closed
+// Each direction is half-closed when its source is done, so the peer can finish sending
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
+
+// candidates returns the available upstreams of an upstream group, starting with the next one in round-robin
+func (n *usp) candidates(ug *upstreamGroup) []uspUpstream {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	var cs []uspUpstream
+	if g, ok := n.groups[ug]; ok && len(g.upstreams) != 0 {
+		for i := 0; i < len(g.upstreams); i++ {
+			cs = append(cs, g.upstreams[(g.next+i)%len(g.upstreams)])
+		}
+		g.next = (g.next + 1) % len(g.upstreams)
+	}
+
+	return cs
+}
+
+// dial connects to the next available upstream of an upstream group in round-robin
+// If an upstream fails to connect, the next one is tried until all available upstreams were tried
+func (n *usp) dial(ug *upstreamGroup) (net.Conn, uspUpstream, error) {
+	for _, u := range n.candidates(ug) {
+		uc, err := net.DialTimeout("tcp", u.address, uspDialTimeout)
+		if err != nil {
+			LogIf("USP: failed to connect to upstream '%s' at '%s': %v", u.name, u.address, err)
+			continue
+		}
+		return uc, u, nil
+	}
+
+	return nil, uspUpstream{}, errUspNoUpstream
+}
+
+// track records an active connection so it can be closed when the engine stops
+// It returns false if the engine is already stopped
+func (cs *uspConns) track(c net.Conn) bool {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+
+	if cs.conns == nil {
+		return false
+	}
+	cs.conns[c] = struct{}{}
+
+	return true
+}
+
+// untrack removes an active connection record
+func (cs *uspConns) untrack(c net.Conn) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+
+	delete(cs.conns, c)
+}
+
+// close closes all active connections and stops tracking new ones
+// It returns once all the forwarding go routines are completed
+func (cs *uspConns) close() {
+	cs.m.Lock()
+	for c := range cs.conns {
+		c.Close()
+	}
+	cs.conns = nil
+	cs.m.Unlock()
+
+	cs.wg.Wait()
+}
+
+// connState tracks the http target client connections, so they can be closed when the engine stops
+func (cs *uspConns) connState(c net.Conn, s http.ConnState) {
+	switch s {
+	case http.StateNew:
+		if !cs.track(c) {
+			c.Close()
+		}
+	case http.StateHijacked, http.StateClosed:
+		cs.untrack(c)
+	}
+}
+
+// stop closes the listeners and all active connections, including the ones of the previous configurations
+// It returns once all the forwarding go routines are completed
+func (n *usp) stop() error {
+	LogIf("USP: a stop was requested. Closing listeners and connections")
+
+	for _, ul := range n.listeners {
+		ul.close()
+	}
+	n.listeners = nil
+	if n.transport != nil {
+		n.transport.CloseIdleConnections()
+	}
+
+	if n.conns != nil {
+		n.conns.close()
+	}
+
+	return nil
+}
+
+// updateTarget refreshes the snapshots of the available upstreams of the target upstream groups
+func (n *usp) updateTarget(t *target) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	for _, ug := range t.upstreamGroups() {
+		n.updateGroup(t, ug)
+	}
+
+	return nil
+}
+
+// updateGroup refreshes the snapshot of the available upstreams of an upstream group
+// The userspace engine mutex must be locked by the caller
+func (n *usp) updateGroup(t *target, ug *upstreamGroup) {
+	g, ok := n.groups[ug]
+	if !ok {
+		g = &uspGroup{}
+		n.groups[ug] = g
+	}
+
+	g.upstreams = nil
+	for _, u := range ug.servingUpstreams() {
+		if u.address != nil {
+			g.upstreams = append(g.upstreams, uspUpstream{
+				name:    u.name,
+				address: net.JoinHostPort(u.address.String(), strconv.Itoa(int(u.port))),
+			})
+		}
+	}
+	if g.next >= len(g.upstreams) {
+		g.next = 0
+	}
+	LogIf("USP: %d/%d upstreams available for target '%s' upstream group '%s'", len(g.upstreams), len(ug.upstreams), t.name, ug.name)
+}
+
+// updateUpstream refreshes the snapshots of the targets using the upstream with its new address
+func (n *usp) updateUpstream(u *upstream, auip *[]net.IP) error {
+	LogDf("USP: update for upstream '%s' requested", u.name)
+
+	for _, t := range n.targets {
+		for _, ug := range t.upstreamGroups() {
+			for _, gu := range ug.upstreams {
+				if gu == u {
+					n.m.Lock()
+					n.updateGroup(t, ug)
+					n.m.Unlock()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconfig hands over the listeners of the targets with unchanged protocol, ip and port to the new engine
+// The other previous listeners are closed first, so their addresses can be reused by the new targets
+// The previous load balancer active connections are kept until they are closed.
+// They are handed over to the new engine, which closes them if it is stopped before
+func (n *usp) reconfig(nl *lb) error {
+	LogDVf("USP: userspace engine reconfig was requested")
+	nn, ok := nl.e.(*usp) // assert if it is a userspace lb engine
+	if !ok {
+		return fmt.Errorf("%w: %w", errUspReconfig, errUspAssert)
+	}
+
+	var kept, closed []*uspListener
+	for _, ul := range n.listeners {
+		if slices.ContainsFunc(nl.targets, func(t *target) bool { return uspListenerKey(t) == ul.key }) {
+			kept = append(kept, ul)
+			continue
+		}
+		ul.ln.Close()
+		closed = append(closed, ul)
+	}
+
+	nn.conns = n.conns
+	nn.listeners = kept
+	if err := nn.start(nl); err != nil {
+		return fmt.Errorf("%w: %w", errUspReconfig, err)
+	}
+
+	// Active requests of the closed http targets are completed before the upstream connections are closed
+	n.conns.wg.Add(1)
+	go func() {
+		defer n.conns.wg.Done()
+		for _, ul := range closed {
+			ul.shutdown()
+		}
+		n.transport.CloseIdleConnections()
+	}()
+
+	LogDVf("USP: userspace engine reconfig was successfully completed")
+	return nil
+}
+
+// cleanup is a no-op as the userspace engine doesn't leave kernel resources behind
+func (n *usp) cleanup(instance string) error {
+	return nil
+}
+
+// getCapabilities provides the userspace engine supported lb capabilities
+func (n *usp) getCapabilities() map[lbProto]map[distMode]bool {
+	return uspSuppCapabilities
+}
+
+// checkPermissions is a no-op as the userspace engine doesn't manage the host networking
+// Listening on ports below 1024 requires the CAP_NET_BIND_SERVICE capability, which is reported when listening
+func (n *usp) checkPermissions() error {
+	LogDf("USP: permissions check succeeded")
+	return nil
+}
+
+// checkDependencies is a no-op as the userspace engine has no external dependencies
+func (n *usp) checkDependencies() error {
+	LogDf("USP: dependencies check succeeded")
+	return nil
+}
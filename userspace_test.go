@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeTcpPort returns a currently free local TCP port
+func freeTcpPort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer ln.Close()
+
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestUsp(t *testing.T) {
+	// upstream replying with the received PROXY protocol header and echoing the data
+	uln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for upstream: %v", err)
+	}
+	defer uln.Close()
+	go func() {
+		for {
+			c, err := uln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	u := &upstream{
+		name:      "u1",
+		protocol:  lbProtoTcp,
+		address:   net.ParseIP("127.0.0.1"),
+		port:      uint16(uln.Addr().(*net.TCPAddr).Port),
+		available: true,
+	}
+	tg := &target{
+		name:          "web",
+		protocol:      lbProtoTcp,
+		ip:            "127.0.0.1",
+		port:          freeTcpPort(t),
+		proxyProtocol: proxyProtoV1,
+		upstreamGroup: &upstreamGroup{name: "ug1", distMode: distModeRR, upstreams: []*upstream{u}},
+	}
+	l := &lb{targets: []*target{tg}}
+	n := &usp{}
+	if err := n.start(l); err != nil {
+		t.Fatalf("failed to start userspace engine: %v", err)
+	}
+	defer n.stop()
+
+	// forwarded connection with PROXY protocol header
+	c, err := net.Dial("tcp", net.JoinHostPort(tg.ip, strconv.Itoa(int(tg.port))))
+	if err != nil {
+		t.Fatalf("failed to connect to target: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("failed to write to target: %v", err)
+	}
+	r := bufio.NewReader(c)
+	h, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(h, "PROXY TCP4 127.0.0.1 127.0.0.1 ") || !strings.HasSuffix(h, " "+strconv.Itoa(int(tg.port))+"\r\n") {
+		t.Errorf("expected PROXY protocol header, but got '%q' (%v)", h, err)
+	}
+	if d, err := r.ReadString('\n'); err != nil || d != "hello\n" {
+		t.Errorf("expected 'hello', but got '%q' (%v)", d, err)
+	}
+	c.Close()
+
+	// connection is closed when no upstreams are available
+	u.available = false
+	n.updateTarget(tg)
+	c, err = net.Dial("tcp", net.JoinHostPort(tg.ip, strconv.Itoa(int(tg.port))))
+	if err != nil {
+		t.Fatalf("failed to connect to target: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected '%v', but got '%v'", io.EOF, err)
+	}
+	c.Close()
+}
+
+func TestUspReconfig(t *testing.T) {
+	// echo upstream
+	uln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for upstream: %v", err)
+	}
+	defer uln.Close()
+	go func() {
+		for {
+			c, err := uln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	newLb := func(port uint16) *lb {
+		u := &upstream{
+			name:      "u1",
+			protocol:  lbProtoTcp,
+			address:   net.ParseIP("127.0.0.1"),
+			port:      uint16(uln.Addr().(*net.TCPAddr).Port),
+			available: true,
+		}
+		return &lb{targets: []*target{{
+			name:          "web",
+			protocol:      lbProtoTcp,
+			ip:            "127.0.0.1",
+			port:          port,
+			proxyProtocol: proxyProtoNone,
+			upstreamGroup: &upstreamGroup{name: "ug1", distMode: distModeRR, upstreams: []*upstream{u}},
+		}}}
+	}
+	echo := func(r *bufio.Reader, c net.Conn) error {
+		if _, err := c.Write([]byte("hello\n")); err != nil {
+			return err
+		}
+		if d, err := r.ReadString('\n'); err != nil || d != "hello\n" {
+			return fmt.Errorf("expected 'hello', but got '%q' (%v)", d, err)
+		}
+		return nil
+	}
+
+	port := freeTcpPort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	n := &usp{}
+	if err := n.start(newLb(port)); err != nil {
+		t.Fatalf("failed to start userspace engine: %v", err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to target: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if err := echo(r, c); err != nil {
+		t.Fatal(err)
+	}
+
+	nl := newLb(port)
+	nl.e = &usp{}
+	if err := n.reconfig(nl); err != nil {
+		t.Fatalf("failed to reconfigure userspace engine: %v", err)
+	}
+
+	// the unchanged target listener is handed over, and no other process may listen on the target
+	if nl.e.(*usp).listeners[0] != n.listeners[0] {
+		t.Errorf("expected the target listener to be handed over to the new engine")
+	}
+	if ln, err := net.Listen("tcp", addr); !errors.Is(err, syscall.EADDRINUSE) {
+		if err == nil {
+			ln.Close()
+		}
+		t.Errorf("expected '%v' when listening on the target, but got '%v'", syscall.EADDRINUSE, err)
+	}
+
+	// the previous configuration connection is kept and new connections are accepted by the new engine
+	if err := echo(r, c); err != nil {
+		t.Errorf("previous configuration connection: %v", err)
+	}
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to target: %v", err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echo(bufio.NewReader(nc), nc); err != nil {
+		t.Errorf("new configuration connection: %v", err)
+	}
+
+	// a target with a changed port gets a new listener and the previous one is closed
+	port2 := freeTcpPort(t)
+	nl2 := newLb(port2)
+	nl2.e = &usp{}
+	if err := nl.e.reconfig(nl2); err != nil {
+		t.Fatalf("failed to reconfigure userspace engine: %v", err)
+	}
+	nc2, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port2))))
+	if err != nil {
+		t.Fatalf("failed to connect to changed target: %v", err)
+	}
+	defer nc2.Close()
+	nc2.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := echo(bufio.NewReader(nc2), nc2); err != nil {
+		t.Errorf("changed target connection: %v", err)
+	}
+	if oc, err := net.Dial("tcp", addr); err == nil {
+		oc.Close()
+		t.Errorf("expected the previous target listener to be closed")
+	}
+
+	// stopping the new engine closes the previous configurations connections too
+	if err := nl2.e.stop(); err != nil {
+		t.Fatalf("failed to stop userspace engine: %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected '%v' on the previous configuration connection, but got '%v'", io.EOF, err)
+	}
+}
+
+func TestUspSniRoute(t *testing.T) {
+	// upstreams replying with their name
+	newUpstream := func(name string) *upstream {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen for upstream: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte(name + "\n"))
+				c.Close()
+			}
+		}()
+
+		return &upstream{
+			name:      name,
+			protocol:  lbProtoTcp,
+			address:   net.ParseIP("127.0.0.1"),
+			port:      uint16(ln.Addr().(*net.TCPAddr).Port),
+			available: true,
+		}
+	}
+
+	tg := &target{
+		name:          "tls",
+		protocol:      lbProtoTcp,
+		ip:            "127.0.0.1",
+		port:          freeTcpPort(t),
+		proxyProtocol: proxyProtoNone,
+		upstreamGroup: &upstreamGroup{name: "ug-default", distMode: distModeRR, upstreams: []*upstream{newUpstream("default")}},
+		routes: []*route{
+			{
+				sni:           []string{"*.example.com"},
+				upstreamGroup: &upstreamGroup{name: "ug-example", distMode: distModeRR, upstreams: []*upstream{newUpstream("example")}},
+			},
+		},
+	}
+	l := &lb{targets: []*target{tg}}
+	n := &usp{}
+	if err := n.start(l); err != nil {
+		t.Fatalf("failed to start userspace engine: %v", err)
+	}
+	defer n.stop()
+
+	testCases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "matching server name", data: clientHello(t, "www.example.com"), want: "example"},
+		{name: "not matching server name", data: clientHello(t, "www.example.org"), want: "default"},
+		{name: "not TLS", data: []byte("hello\n"), want: "default"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", net.JoinHostPort(tg.ip, strconv.Itoa(int(tg.port))))
+			if err != nil {
+				t.Fatalf("failed to connect to target: %v", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Write(tc.data); err != nil {
+				t.Fatalf("failed to write to target: %v", err)
+			}
+			if got, err := bufio.NewReader(c).ReadString('\n'); err != nil || got != tc.want+"\n" {
+				t.Errorf("expected upstream '%s', but got '%q' (%v)", tc.want, got, err)
+			}
+		})
+	}
+}
+
+func TestUspHttp(t *testing.T) {
+	// upstreams replying with their name and the received request details
+	newUpstream := func(name string) *upstream {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s %s|%s", name, r.Host, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("Forwarded"))
+		}))
+		t.Cleanup(srv.Close)
+		a := srv.Listener.Addr().(*net.TCPAddr)
+
+		return &upstream{
+			name:      name,
+			protocol:  lbProtoHttp,
+			address:   a.IP,
+			port:      uint16(a.Port),
+			available: true,
+		}
+	}
+
+	api := newUpstream("api")
+	tg := &target{
+		name:          "web",
+		protocol:      lbProtoHttp,
+		ip:            "127.0.0.1",
+		port:          freeTcpPort(t),
+		proxyProtocol: proxyProtoNone,
+		upstreamGroup: &upstreamGroup{name: "ug-default", distMode: distModeRR, upstreams: []*upstream{newUpstream("default")}},
+		routes: []*route{
+			{
+				pathPrefix:    "/api",
+				upstreamGroup: &upstreamGroup{name: "ug-api", distMode: distModeRR, upstreams: []*upstream{api}},
+			},
+		},
+	}
+	l := &lb{targets: []*target{tg}}
+	n := &usp{}
+	if err := n.start(l); err != nil {
+		t.Fatalf("failed to start userspace engine: %v", err)
+	}
+	defer n.stop()
+
+	addr := net.JoinHostPort(tg.ip, strconv.Itoa(int(tg.port)))
+	url := "http://" + addr
+	testCases := []struct {
+		name   string
+		path   string
+		status int
+		want   string
+	}{
+		{name: "default upstream group", path: "/", status: http.StatusOK, want: "default " + addr + " / 127.0.0.1|for=127.0.0.1;host=\"" + addr + "\";proto=http"},
+		{name: "path prefix route", path: "/api/users", status: http.StatusOK, want: "api " + addr + " /api/users "},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := http.Get(url + tc.path)
+			if err != nil {
+				t.Fatalf("failed to request target: %v", err)
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tc.status || !strings.HasPrefix(string(b), tc.want) {
+				t.Errorf("expected '%d' '%s', but got '%d' '%s'", tc.status, tc.want, res.StatusCode, b)
+			}
+		})
+	}
+
+	// service unavailable when no upstreams are available
+	api.available = false
+	n.updateTarget(tg)
+	res, err := http.Get(url + "/api")
+	if err != nil {
+		t.Fatalf("failed to request target: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status '%d', but got '%d'", http.StatusServiceUnavailable, res.StatusCode)
+	}
+}